@@ -0,0 +1,492 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// With a standard normal prior the posterior variance is about
+	// 1 / (1 + sum of item information), and a Rasch item gives at most 0.25
+	// at the student's ability. A standard error of 0.4 therefore takes at
+	// least 21 well targeted items; the maximum leaves room for a pool that
+	// does not match the student exactly.
+	defaultTargetStandardError = 0.4
+	defaultMaxItems            = 30
+	minCalibrationResponses    = 5
+	abilityLimit               = 4.0
+
+	sessionInProgress = "in_progress"
+	sessionFinished   = "finished"
+)
+
+// Placement_Session is one adaptive run of the placement test. The engine
+// uses the Rasch (one parameter logistic) model: the probability that a
+// student of ability theta answers an item of difficulty b correctly is
+// 1 / (1 + exp(b - theta)). Item difficulties live on Placement_Test and
+// stay 0 until calibratePlacementTests has seen enough answers.
+type Placement_Session struct {
+	gorm.Model
+	PlacementsessionID        uint      `gorm:"column:placement_session_id;primaryKey;autoIncrement;unique" json:"placement_session_id"`
+	StudentID                 uint      `json:"student_id"`
+	Student                   Student   `gorm:"references:StudentID"`
+	InterestID                uint      `json:"interest_id"`
+	Interest                  Interest  `gorm:"references:InterestID"`
+	Status                    string    `json:"status"`
+	Ability                   float64   `json:"ability"`
+	Standard_error            float64   `json:"standard_error"`
+	Target_standard_error     float64   `json:"target_standard_error"`
+	Max_items                 int       `json:"max_items"`
+	Items_answered            int       `json:"items_answered"`
+	Current_placement_test_id uint      `json:"current_placement_test_id"`
+	Started_at                time.Time `json:"started_at"`
+	PlacementtestresultID     uint      `json:"placement_test_result_id"`
+}
+
+type irtResponse struct {
+	difficulty float64
+	correct    bool
+}
+
+func raschProbability(theta, difficulty float64) float64 {
+	return 1 / (1 + math.Exp(difficulty-theta))
+}
+
+func clampAbility(value float64) float64 {
+	return math.Max(-abilityLimit, math.Min(abilityLimit, value))
+}
+
+// estimateAbility returns the expected a posteriori ability and its
+// posterior standard deviation under a standard normal prior. Unlike maximum
+// likelihood it stays finite when every answer so far is right (or wrong).
+func estimateAbility(responses []irtResponse) (float64, float64) {
+	const step = 0.05
+
+	var weightSum, mean, square float64
+	for theta := -abilityLimit; theta <= abilityLimit+1e-9; theta += step {
+		logWeight := -theta * theta / 2
+		for _, response := range responses {
+			p := raschProbability(theta, response.difficulty)
+			if response.correct {
+				logWeight += math.Log(p)
+			} else {
+				logWeight += math.Log(1 - p)
+			}
+		}
+		weight := math.Exp(logWeight)
+		weightSum += weight
+		mean += theta * weight
+		square += theta * theta * weight
+	}
+
+	if weightSum == 0 {
+		return 0, 1
+	}
+	mean /= weightSum
+	variance := square/weightSum - mean*mean
+	return mean, math.Sqrt(math.Max(variance, 0))
+}
+
+// calibrateDifficulties runs joint maximum likelihood estimation of Rasch
+// item difficulties. responses maps student -> item -> correct. Items are
+// centred on a mean difficulty of zero so abilities stay on the same scale
+// between calibrations.
+func calibrateDifficulties(responses map[uint]map[uint]bool) map[uint]float64 {
+	difficulty := map[uint]float64{}
+	ability := map[uint]float64{}
+
+	itemRight, itemTotal := map[uint]float64{}, map[uint]float64{}
+	for student, items := range responses {
+		right := 0.0
+		for item, correct := range items {
+			itemTotal[item]++
+			if correct {
+				itemRight[item]++
+				right++
+			}
+		}
+		ability[student] = math.Log((right + 0.5) / (float64(len(items)) - right + 0.5))
+	}
+	for item, total := range itemTotal {
+		difficulty[item] = math.Log((total - itemRight[item] + 0.5) / (itemRight[item] + 0.5))
+	}
+
+	for iteration := 0; iteration < 50; iteration++ {
+		maxChange := 0.0
+
+		for student, items := range responses {
+			var residual, information float64
+			for item, correct := range items {
+				p := raschProbability(ability[student], difficulty[item])
+				if correct {
+					residual += 1 - p
+				} else {
+					residual -= p
+				}
+				information += p * (1 - p)
+			}
+			if information > 0 {
+				change := math.Max(-1, math.Min(1, residual/information))
+				ability[student] = clampAbility(ability[student] + change)
+			}
+		}
+
+		itemResidual, itemInformation := map[uint]float64{}, map[uint]float64{}
+		for student, items := range responses {
+			for item, correct := range items {
+				p := raschProbability(ability[student], difficulty[item])
+				if correct {
+					itemResidual[item] += p - 1
+				} else {
+					itemResidual[item] += p
+				}
+				itemInformation[item] += p * (1 - p)
+			}
+		}
+
+		total := 0.0
+		for item := range difficulty {
+			if itemInformation[item] > 0 {
+				change := math.Max(-1, math.Min(1, itemResidual[item]/itemInformation[item]))
+				difficulty[item] = clampAbility(difficulty[item] + change)
+				maxChange = math.Max(maxChange, math.Abs(change))
+			}
+			total += difficulty[item]
+		}
+		if len(difficulty) > 0 {
+			mean := total / float64(len(difficulty))
+			for item := range difficulty {
+				difficulty[item] -= mean
+			}
+		}
+
+		if maxChange < 0.001 {
+			break
+		}
+	}
+
+	return difficulty
+}
+
+func calibratePlacementTests(c *gin.Context) {
+	query := db.Model(&Placement_Test{})
+	if interestID := c.Query("interest_id"); interestID != "" {
+		query = query.Where("interest_id = ?", interestID)
+	}
+
+	var placementTests []Placement_Test
+	if err := query.Find(&placementTests).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load placement tests"})
+		return
+	}
+
+	var ids []uint
+	byID := map[uint]Placement_Test{}
+	for _, placementTest := range placementTests {
+		ids = append(ids, placementTest.PlacementtestID)
+		byID[placementTest.PlacementtestID] = placementTest
+	}
+
+	var answers []Placement_Test_Answer
+	if len(ids) > 0 {
+		if err := db.Where("placementtest_id IN ?", ids).Order("created_at").Find(&answers).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load placement test answers"})
+			return
+		}
+	}
+
+	// The latest answer per student and item counts. Answers are regraded
+	// because rows saved before grading existed have no score.
+	responses := map[uint]map[uint]bool{}
+	for _, answer := range answers {
+		if responses[answer.StudentID] == nil {
+			responses[answer.StudentID] = map[uint]bool{}
+		}
+		placementTest := byID[answer.PlacementtestID]
+		score := gradeAnswer(placementTest.Question_type, placementTestSpec(placementTest), answer.Student_answer)
+		responses[answer.StudentID][answer.PlacementtestID] = score >= 1
+	}
+
+	counts := map[uint]int{}
+	for _, items := range responses {
+		for item := range items {
+			counts[item]++
+		}
+	}
+
+	difficulties := calibrateDifficulties(responses)
+
+	calibrated := []gin.H{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, placementTest := range placementTests {
+			id := placementTest.PlacementtestID
+			difficulty := 0.0
+			if counts[id] >= minCalibrationResponses {
+				difficulty = difficulties[id]
+			}
+			if err := tx.Model(&placementTest).Updates(map[string]interface{}{"difficulty": difficulty, "calibration_count": counts[id]}).Error; err != nil {
+				return err
+			}
+			calibrated = append(calibrated, gin.H{"placement_test_id": id, "difficulty": difficulty, "responses": counts[id]})
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save calibration"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"calibrated": calibrated, "students": len(responses)})
+}
+
+// sessionResponses rebuilds the responses of a session from its answers.
+func sessionResponses(tx *gorm.DB, session Placement_Session) ([]irtResponse, map[uint]bool) {
+	var answers []Placement_Test_Answer
+	tx.Preload("Placementtest").Where("placementsession_id = ?", session.PlacementsessionID).Find(&answers)
+
+	var responses []irtResponse
+	asked := map[uint]bool{}
+	for _, answer := range answers {
+		asked[answer.PlacementtestID] = true
+		responses = append(responses, irtResponse{difficulty: answer.Placementtest.Difficulty, correct: answer.Score >= 1})
+	}
+	return responses, asked
+}
+
+// nextPlacementTest picks the unasked item with the most information at the
+// current ability, which for the Rasch model is the item whose difficulty is
+// closest to it.
+func nextPlacementTest(session Placement_Session, asked map[uint]bool) (Placement_Test, bool) {
+	var pool []Placement_Test
+	db.Where("interest_id = ?", session.InterestID).Find(&pool)
+
+	var best Placement_Test
+	found := false
+	for _, placementTest := range pool {
+		if asked[placementTest.PlacementtestID] {
+			continue
+		}
+		if !found || math.Abs(placementTest.Difficulty-session.Ability) < math.Abs(best.Difficulty-session.Ability) {
+			best = placementTest
+			found = true
+		}
+	}
+	return best, found
+}
+
+func presentPlacementTest(placementTest Placement_Test) gin.H {
+	spec := placementTestSpec(placementTest)
+	question := gin.H{
+		"placement_test_id": placementTest.PlacementtestID,
+		"question":          placementTest.Question,
+		"question_type":     normalizeQuestionType(placementTest.Question_type),
+	}
+	if normalizeQuestionType(placementTest.Question_type) != questionTrueFalse {
+		question["options"] = spec.Options
+		question["prompts"] = spec.Prompts
+	}
+	return question
+}
+
+// finishPlacementSession records the ability estimate as the student's
+// Placement_Test_Result. Score keeps the number of correct answers for
+// clients that still read it.
+func finishPlacementSession(tx *gorm.DB, session *Placement_Session, responses []irtResponse) error {
+	correct := 0
+	for _, response := range responses {
+		if response.correct {
+			correct++
+		}
+	}
+
+	result := Placement_Test_Result{
+		StudentID:      session.StudentID,
+		InterestID:     session.InterestID,
+		Score:          correct,
+		Ability:        &session.Ability,
+		Standard_error: &session.Standard_error,
+		Test_date:      time.Now(),
+	}
+	if err := tx.Create(&result).Error; err != nil {
+		return err
+	}
+
+	session.Status = sessionFinished
+	session.Current_placement_test_id = 0
+	session.PlacementtestresultID = result.PlacementtestresultID
+	return nil
+}
+
+func startPlacementSession(c *gin.Context) {
+	var input struct {
+		StudentID             uint    `json:"student_id"`
+		InterestID            uint    `json:"interest_id"`
+		Target_standard_error float64 `json:"target_standard_error"`
+		Max_items             int     `json:"max_items"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var student Student
+	if err := db.First(&student, input.StudentID).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Student with that ID not found"})
+		return
+	}
+
+	var interest Interest
+	if err := db.First(&interest, input.InterestID).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Interest with that ID not found"})
+		return
+	}
+
+	if input.Target_standard_error <= 0 {
+		input.Target_standard_error = defaultTargetStandardError
+	}
+	if input.Max_items <= 0 {
+		input.Max_items = defaultMaxItems
+	}
+
+	session := Placement_Session{
+		StudentID:             input.StudentID,
+		InterestID:            input.InterestID,
+		Status:                sessionInProgress,
+		Standard_error:        1,
+		Target_standard_error: input.Target_standard_error,
+		Max_items:             input.Max_items,
+		Started_at:            time.Now(),
+	}
+
+	first, ok := nextPlacementTest(session, map[uint]bool{})
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Interest has no placement test questions"})
+		return
+	}
+	session.Current_placement_test_id = first.PlacementtestID
+
+	if err := db.Create(&session).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start placement session"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"session": session, "question": presentPlacementTest(first)})
+}
+
+func getPlacementSessionByID(c *gin.Context) {
+	var session Placement_Session
+	if err := db.First(&session, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Placement Session not found"})
+		return
+	}
+
+	response := gin.H{"session": session}
+	if session.Status == sessionInProgress {
+		var current Placement_Test
+		if err := db.First(&current, "placement_test_id = ?", session.Current_placement_test_id).Error; err == nil {
+			response["question"] = presentPlacementTest(current)
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func answerPlacementSession(c *gin.Context) {
+	var session Placement_Session
+	if err := db.First(&session, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Placement Session not found"})
+		return
+	}
+
+	if session.Status != sessionInProgress {
+		c.JSON(http.StatusConflict, gin.H{"error": "Placement Session is already finished", "session": session})
+		return
+	}
+
+	var input struct {
+		PlacementtestID uint   `json:"placement_test_id"`
+		Student_answer  string `json:"student_answer"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if input.PlacementtestID != session.Current_placement_test_id {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Answer the current question first", "current_placement_test_id": session.Current_placement_test_id})
+		return
+	}
+
+	var placementTest Placement_Test
+	if err := db.First(&placementTest, "placement_test_id = ?", input.PlacementtestID).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Placement Test with that ID not found"})
+		return
+	}
+
+	var next Placement_Test
+	var more, answered bool
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Claim the current question first. A second submission of the same
+		// answer finds it claimed and stops here, so an item is never
+		// counted twice.
+		claim := tx.Model(&Placement_Session{}).
+			Where("placement_session_id = ? AND status = ? AND current_placement_test_id = ?", session.PlacementsessionID, sessionInProgress, input.PlacementtestID).
+			Update("current_placement_test_id", 0)
+		if claim.Error != nil {
+			return claim.Error
+		}
+		if claim.RowsAffected == 0 {
+			answered = true
+			return nil
+		}
+
+		revision, err := currentPlacementTestRevision(tx, &placementTest)
+		if err != nil {
+			return err
+		}
+		answer := Placement_Test_Answer{
+			PlacementtestID:         input.PlacementtestID,
+			PlacementtestrevisionID: revision.PlacementtestrevisionID,
+			StudentID:               session.StudentID,
+			Student_answer:          input.Student_answer,
+			Score:                   gradeAnswer(placementTest.Question_type, placementTestSpec(placementTest), input.Student_answer),
+			PlacementsessionID:      session.PlacementsessionID,
+		}
+		if err := tx.Create(&answer).Error; err != nil {
+			return err
+		}
+
+		responses, asked := sessionResponses(tx, session)
+		session.Ability, session.Standard_error = estimateAbility(responses)
+		session.Items_answered = len(responses)
+		session.Current_placement_test_id = 0
+
+		next, more = nextPlacementTest(session, asked)
+		more = more && session.Standard_error > session.Target_standard_error && session.Items_answered < session.Max_items
+		if more {
+			session.Current_placement_test_id = next.PlacementtestID
+		} else if err := finishPlacementSession(tx, &session, responses); err != nil {
+			return err
+		}
+		return tx.Save(&session).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record answer"})
+		return
+	}
+	if answered {
+		c.JSON(http.StatusConflict, gin.H{"error": "That question was already answered"})
+		return
+	}
+
+	if !more {
+		c.JSON(http.StatusOK, gin.H{"session": session, "finished": true})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"session": session, "question": presentPlacementTest(next), "finished": false})
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	linkOK      = "ok"
+	linkFailing = "failing"
+	linkBroken  = "broken"
+)
+
+const (
+	// A link is reported broken after this many failed checks in a row, so
+	// a site that is down for a moment is not reported.
+	linkBrokenAfter  = 2
+	linkMaxRedirects = 10
+	linkCheckWorkers = 8
+	linkCheckTimeout = 15 * time.Second
+)
+
+// Attachment_Link_Check is the latest result of probing an attachment's
+// source link. Source is the link that was checked, so a result is ignored
+// once the attachment points somewhere else.
+type Attachment_Link_Check struct {
+	gorm.Model
+	AttachmentlinkcheckID uint       `gorm:"column:attachment_link_check_id;primaryKey;autoIncrement;unique" json:"attachment_link_check_id"`
+	AttachmentID          uint       `gorm:"uniqueIndex" json:"attachment_id"`
+	Source                string     `json:"source"`
+	Status                string     `json:"status"`
+	Status_code           int        `json:"status_code"`
+	Final_url             string     `json:"final_url"`
+	Redirects             int        `json:"redirects"`
+	Error                 string     `json:"error"`
+	Failures              int        `json:"consecutive_failures"`
+	Checked_at            time.Time  `json:"checked_at"`
+	Last_success_at       *time.Time `json:"last_success_at"`
+}
+
+type linkResult struct {
+	statusCode int
+	finalURL   string
+	redirects  int
+	err        error
+}
+
+// linkChecker probes links with HEAD, falling back to GET for servers that
+// do not answer HEAD properly.
+type linkChecker struct {
+	client  *http.Client
+	running sync.Mutex
+}
+
+func newLinkChecker(client *http.Client) *linkChecker {
+	return &linkChecker{client: client}
+}
+
+var attachmentLinkChecker = newLinkChecker(publicLinkClient())
+
+// errInternalAddress is returned for links that lead into the server's own
+// network.
+var errInternalAddress = errors.New("link points to an internal address")
+
+// sharedAddressSpace is the carrier-grade NAT range, which is not public
+// either.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// refuseInternalAddress stops the link checker from connecting to loopback,
+// private, link-local and similar addresses, so a teacher's link cannot be
+// used to probe the internal network or cloud metadata. It runs on the
+// resolved address of every connection, which covers redirects and names
+// that resolve to such addresses too.
+func refuseInternalAddress(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip) {
+		return errInternalAddress
+	}
+	return nil
+}
+
+// publicLinkClient is the client the link checker uses outside tests. It
+// does not use a proxy, since the address check only sees the proxy.
+func publicLinkClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{
+		Timeout:   linkCheckTimeout,
+		KeepAlive: 30 * time.Second,
+		Control:   refuseInternalAddress,
+	}).DialContext
+	return &http.Client{Timeout: linkCheckTimeout, Transport: transport}
+}
+
+func (lc *linkChecker) probe(ctx context.Context, method string, link string) linkResult {
+	result := linkResult{finalURL: link}
+
+	req, err := http.NewRequestWithContext(ctx, method, link, nil)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	req.Header.Set("User-Agent", "go-api-link-checker/1.0")
+
+	// Count the redirects on a copy of the client so the shared one is left
+	// alone.
+	client := *lc.client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > linkMaxRedirects {
+			return fmt.Errorf("more than %d redirects", linkMaxRedirects)
+		}
+		result.redirects = len(via)
+		result.finalURL = req.URL.String()
+		return nil
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		result.err = err
+		return result
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	result.statusCode = resp.StatusCode
+	return result
+}
+
+// check reports how link answers. A link is healthy when it ends in a 2xx
+// response after following redirects.
+func (lc *linkChecker) check(ctx context.Context, link string) linkResult {
+	if !isOnlyLink(link) {
+		return linkResult{finalURL: link, err: errors.New("source is not an http or https link")}
+	}
+
+	result := lc.probe(ctx, http.MethodHead, link)
+	if result.err == nil && result.statusCode/100 == 2 {
+		return result
+	}
+	// Plenty of servers reject or mishandle HEAD, so only trust a failure
+	// that GET agrees with.
+	return lc.probe(ctx, http.MethodGet, link)
+}
+
+func (r linkResult) healthy() bool {
+	return r.err == nil && r.statusCode/100 == 2
+}
+
+// recordLinkCheck stores result as the latest check of attachment.
+func recordLinkCheck(attachment Attachment, result linkResult, checkedAt time.Time) (Attachment_Link_Check, error) {
+	var check Attachment_Link_Check
+	db.Where("attachment_id = ?", attachment.AttachmentID).Limit(1).Find(&check)
+	if check.Source != attachment.Source {
+		check.Failures, check.Last_success_at = 0, nil
+	}
+
+	check.AttachmentID = attachment.AttachmentID
+	check.Source = attachment.Source
+	check.Status_code = result.statusCode
+	check.Final_url = result.finalURL
+	check.Redirects = result.redirects
+	check.Checked_at = checkedAt
+	check.Error = ""
+	if result.err != nil {
+		check.Error = result.err.Error()
+	} else if !result.healthy() {
+		check.Error = http.StatusText(result.statusCode)
+	}
+
+	if result.healthy() {
+		check.Status, check.Failures = linkOK, 0
+		check.Last_success_at = &checkedAt
+	} else {
+		check.Failures++
+		check.Status = linkFailing
+		if check.Failures >= linkBrokenAfter {
+			check.Status = linkBroken
+		}
+	}
+
+	if check.AttachmentlinkcheckID == 0 {
+		err := db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "attachment_id"}},
+			UpdateAll: true,
+		}).Create(&check).Error
+		return check, err
+	}
+	return check, db.Save(&check).Error
+}
+
+// run checks the links of attachments with a few workers at a time and
+// returns the stored results. Only one run happens at a time.
+func (lc *linkChecker) run(ctx context.Context, attachments []Attachment) []Attachment_Link_Check {
+	lc.running.Lock()
+	defer lc.running.Unlock()
+	return lc.checkAll(ctx, attachments)
+}
+
+// tryRun is run, unless a run is already in progress, in which case it
+// reports false straight away.
+func (lc *linkChecker) tryRun(ctx context.Context, attachments []Attachment) ([]Attachment_Link_Check, bool) {
+	if !lc.running.TryLock() {
+		return nil, false
+	}
+	defer lc.running.Unlock()
+	return lc.checkAll(ctx, attachments), true
+}
+
+func (lc *linkChecker) checkAll(ctx context.Context, attachments []Attachment) []Attachment_Link_Check {
+	results := make([]Attachment_Link_Check, len(attachments))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < linkCheckWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				result := lc.check(ctx, attachments[i].Source)
+				// A check cut short because the caller went away says
+				// nothing about the link.
+				if ctx.Err() != nil {
+					continue
+				}
+				check, err := recordLinkCheck(attachments[i], result, time.Now())
+				if err != nil {
+					log.Println("Failed to record link check:", err)
+				}
+				results[i] = check
+			}
+		}()
+	}
+	for i := range attachments {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// linkAttachments are the attachments that point to a link rather than an
+// uploaded file.
+func linkAttachments() *gorm.DB {
+	return db.Where("attachmentfile_id = 0 OR attachmentfile_id IS NULL")
+}
+
+// checkAttachmentLinks probes every attachment link in the background, once
+// at start and then every interval.
+func checkAttachmentLinks(interval time.Duration) {
+	for {
+		var attachments []Attachment
+		linkAttachments().Find(&attachments)
+		attachmentLinkChecker.run(context.Background(), attachments)
+		time.Sleep(interval)
+	}
+}
+
+// runAttachmentLinkCheck checks links now instead of waiting for the next
+// background run, either one attachment with ?attachment_id or all of them.
+// It answers 409 while another run, such as the background one, is going.
+func runAttachmentLinkCheck(c *gin.Context) {
+	if _, ok := requireStaff(c); !ok {
+		return
+	}
+
+	query := linkAttachments()
+	if id := c.Query("attachment_id"); id != "" {
+		query = query.Where("attachment_id = ?", id)
+	}
+
+	var attachments []Attachment
+	query.Find(&attachments)
+	if len(attachments) == 0 && c.Query("attachment_id") != "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment with a source link not found"})
+		return
+	}
+
+	checks, ok := attachmentLinkChecker.tryRun(c.Request.Context(), attachments)
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "A link check is already running, try again later"})
+		return
+	}
+
+	summary := map[string]int{linkOK: 0, linkFailing: 0, linkBroken: 0}
+	for _, check := range checks {
+		summary[check.Status]++
+	}
+	c.JSON(http.StatusOK, gin.H{"checked": len(checks), "summary": summary, "checks": checks})
+}
+
+type brokenLink struct {
+	Attachment_Link_Check
+	Description        string `json:"description"`
+	LearningmaterialID uint   `json:"learning_material_id"`
+	Title              string `json:"title"`
+	SubjectID          uint   `json:"subject_id"`
+}
+
+type linkOwnerReport struct {
+	Owner string       `json:"owner"`
+	Links []brokenLink `json:"links"`
+}
+
+// getAttachmentLinkReport lists links that are not healthy, grouped by the
+// owner of the learning material they belong to, who is whoever last
+// edited it. ?status=broken (the default), failing or all.
+func getAttachmentLinkReport(c *gin.Context) {
+	if _, ok := requireStaff(c); !ok {
+		return
+	}
+
+	statuses := []string{linkBroken}
+	switch c.DefaultQuery("status", linkBroken) {
+	case linkBroken:
+	case linkFailing:
+		statuses = []string{linkFailing}
+	case "all":
+		statuses = []string{linkFailing, linkBroken}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be broken, failing or all"})
+		return
+	}
+
+	var rows []struct {
+		Attachment_Link_Check
+		Description        string
+		LearningmaterialID uint
+		Title              string
+		SubjectID          uint
+		Updated_by         string
+	}
+	db.Table("attachment_link_checks").
+		Select("attachment_link_checks.*, attachments.description, attachments.learningmaterial_id, learning_materials.title, learning_materials.subject_id, learning_materials.updated_by").
+		Joins("JOIN attachments ON attachments.attachment_id = attachment_link_checks.attachment_id AND attachments.deleted_at IS NULL").
+		Joins("JOIN learning_materials ON learning_materials.learning_material_id = attachments.learningmaterial_id AND learning_materials.deleted_at IS NULL").
+		Where("attachment_link_checks.deleted_at IS NULL").
+		Where("attachment_link_checks.source = attachments.source").
+		Where("attachment_link_checks.status IN ?", statuses).
+		Order("attachment_link_checks.attachment_id").
+		Scan(&rows)
+
+	owners := map[string]*linkOwnerReport{}
+	for _, row := range rows {
+		owner := row.Updated_by
+		if owner == "" {
+			owner = "unassigned"
+		}
+		if owners[owner] == nil {
+			owners[owner] = &linkOwnerReport{Owner: owner}
+		}
+		owners[owner].Links = append(owners[owner].Links, brokenLink{
+			Attachment_Link_Check: row.Attachment_Link_Check,
+			Description:           row.Description,
+			LearningmaterialID:    row.LearningmaterialID,
+			Title:                 row.Title,
+			SubjectID:             row.SubjectID,
+		})
+	}
+
+	report := make([]linkOwnerReport, 0, len(owners))
+	for _, owner := range owners {
+		report = append(report, *owner)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Owner < report[j].Owner })
+
+	c.JSON(http.StatusOK, gin.H{"links": len(rows), "owners": report})
+}
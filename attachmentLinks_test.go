@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/models"
+)
+
+func newLinkTestServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/no-head", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/missing", http.NotFound)
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/moved-again", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/moved-again", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ok", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestLinkCheckerCheck(t *testing.T) {
+	server := newLinkTestServer(t)
+	checker := newLinkChecker(server.Client())
+
+	tests := []struct {
+		path       string
+		healthy    bool
+		statusCode int
+		redirects  int
+		finalPath  string
+	}{
+		{path: "/ok", healthy: true, statusCode: http.StatusOK, finalPath: "/ok"},
+		{path: "/no-head", healthy: true, statusCode: http.StatusOK, finalPath: "/no-head"},
+		{path: "/missing", healthy: false, statusCode: http.StatusNotFound, finalPath: "/missing"},
+		{path: "/moved", healthy: true, statusCode: http.StatusOK, redirects: 2, finalPath: "/ok"},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			result := checker.check(context.Background(), server.URL+test.path)
+			if result.healthy() != test.healthy {
+				t.Errorf("healthy = %v, want %v (err %v)", result.healthy(), test.healthy, result.err)
+			}
+			if result.statusCode != test.statusCode {
+				t.Errorf("status code = %d, want %d", result.statusCode, test.statusCode)
+			}
+			if result.redirects != test.redirects {
+				t.Errorf("redirects = %d, want %d", result.redirects, test.redirects)
+			}
+			if result.finalURL != server.URL+test.finalPath {
+				t.Errorf("final URL = %q, want %q", result.finalURL, server.URL+test.finalPath)
+			}
+		})
+	}
+}
+
+func TestLinkCheckerStopsRedirectLoops(t *testing.T) {
+	server := newLinkTestServer(t)
+	result := newLinkChecker(server.Client()).check(context.Background(), server.URL+"/loop")
+	if result.healthy() || result.err == nil || !strings.Contains(result.err.Error(), "redirects") {
+		t.Fatalf("check = %+v, want a too many redirects error", result)
+	}
+}
+
+func TestLinkCheckerRejectsOtherSchemes(t *testing.T) {
+	result := newLinkChecker(http.DefaultClient).check(context.Background(), "ftp://example.com/file")
+	if result.err == nil {
+		t.Fatal("want an error for an ftp link")
+	}
+}
+
+func TestRefuseInternalAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		refused bool
+	}{
+		{"127.0.0.1:80", true},
+		{"10.1.2.3:443", true},
+		{"172.16.0.1:80", true},
+		{"192.168.1.10:8080", true},
+		{"169.254.169.254:80", true},
+		{"100.64.0.1:80", true},
+		{"0.0.0.0:80", true},
+		{"[::1]:80", true},
+		{"[fe80::1]:80", true},
+		{"[fd00::1]:80", true},
+		{"[::ffff:192.168.1.1]:80", true},
+		{"93.184.216.34:443", false},
+		{"[2606:4700::1111]:443", false},
+	}
+	for _, test := range tests {
+		err := refuseInternalAddress("tcp", test.address, nil)
+		if refused := errors.Is(err, errInternalAddress); refused != test.refused {
+			t.Errorf("refuseInternalAddress(%q) = %v, want refused %v", test.address, err, test.refused)
+		}
+	}
+}
+
+func TestPublicLinkClientRefusesLoopback(t *testing.T) {
+	server := newLinkTestServer(t)
+	result := newLinkChecker(publicLinkClient()).check(context.Background(), server.URL+"/ok")
+	if !errors.Is(result.err, errInternalAddress) {
+		t.Fatalf("check of %s = %+v, want errInternalAddress", server.URL, result)
+	}
+}
+
+func TestLinkCheckerTryRunWhileRunning(t *testing.T) {
+	checker := newLinkChecker(http.DefaultClient)
+
+	checker.running.Lock()
+	if _, ok := checker.tryRun(context.Background(), nil); ok {
+		t.Error("tryRun ran while another run was in progress")
+	}
+	checker.running.Unlock()
+
+	if _, ok := checker.tryRun(context.Background(), nil); !ok {
+		t.Error("tryRun refused to run with no run in progress")
+	}
+}
+
+func TestAttachmentLinkRoutesRequireStaff(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	asUser := func(c *gin.Context) {
+		if id := c.GetHeader("X-Test-User"); id != "" {
+			c.Set("user", models.User{UserID: id})
+		}
+	}
+	router.GET("/admin/attachment-links", asUser, getAttachmentLinkReport)
+	router.POST("/admin/attachment-links/check", asUser, runAttachmentLinkCheck)
+
+	tests := []struct {
+		user   string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"STD1", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		for _, route := range []struct{ method, path string }{
+			{http.MethodGet, "/admin/attachment-links"},
+			{http.MethodPost, "/admin/attachment-links/check"},
+		} {
+			req := httptest.NewRequest(route.method, route.path, nil)
+			req.Header.Set("X-Test-User", test.user)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != test.status {
+				t.Errorf("%s %s as %q = %d, want %d", route.method, route.path, test.user, w.Code, test.status)
+			}
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const maxUploadSize = 20 << 20
+
+const (
+	defaultDownloadURLTTL = 15 * time.Minute
+	maxDownloadURLTTL     = 24 * time.Hour
+)
+
+// uploadTypes are the file types attachments may have, detected from the
+// content rather than trusted from the client. Types browsers run, such as
+// HTML and SVG, are deliberately left out.
+var uploadTypes = map[string]bool{
+	"application/pdf": true,
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"text/plain":      true,
+}
+
+// Attachment_File is one stored file. Files are stored under the SHA-256
+// of their content, so uploading the same file again reuses it.
+type Attachment_File struct {
+	gorm.Model
+	AttachmentfileID uint   `gorm:"column:attachment_file_id;primaryKey;autoIncrement;unique" json:"attachment_file_id"`
+	Sha256           string `gorm:"uniqueIndex" json:"sha256"`
+	Size             int64  `json:"size"`
+	Content_type     string `json:"content_type"`
+	Backend          string `json:"backend"`
+}
+
+var downloadKey struct {
+	once sync.Once
+	key  []byte
+}
+
+// downloadSigningKey is DOWNLOAD_URL_SECRET, or SECRET, or a random key
+// when neither is set, in which case links stop working on restart.
+func downloadSigningKey() []byte {
+	downloadKey.once.Do(func() {
+		for _, name := range []string{"DOWNLOAD_URL_SECRET", "SECRET"} {
+			if secret := os.Getenv(name); secret != "" {
+				downloadKey.key = []byte(secret)
+				return
+			}
+		}
+		downloadKey.key = make([]byte, 32)
+		rand.Read(downloadKey.key)
+	})
+	return downloadKey.key
+}
+
+func downloadSignature(attachmentID uint, expires int64) string {
+	mac := hmac.New(sha256.New, downloadSigningKey())
+	fmt.Fprintf(mac, "attachment:%d:%d", attachmentID, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signedDownloadURL returns a download link for a file attachment that
+// works without credentials until it expires. Links are only issued to
+// logged in users, who may pass them on, for example to an <img> tag.
+func signedDownloadURL(attachment Attachment, ttl time.Duration) (string, time.Time) {
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	return fmt.Sprintf("/attachment/%d/download?expires=%d&signature=%s", attachment.AttachmentID, expires.Unix(), downloadSignature(attachment.AttachmentID, expires.Unix())), expires
+}
+
+// withDownloadURLs adds download links for logged in users. Anyone else
+// sees the attachments without them.
+func withDownloadURLs(c *gin.Context, attachments []Attachment) {
+	if _, ok := authenticatedUser(c); !ok {
+		return
+	}
+	for i := range attachments {
+		if attachments[i].AttachmentfileID != 0 {
+			attachments[i].Download_url, _ = signedDownloadURL(attachments[i], defaultDownloadURLTTL)
+		}
+	}
+}
+
+// uploadFileName keeps the base name of the uploaded file for downloads.
+func uploadFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == "/" {
+		return "attachment"
+	}
+	return name
+}
+
+// storeUpload saves the file in storage unless a file with the same content
+// is already stored and returns its record.
+func storeUpload(c *gin.Context, file *os.File, sum string, size int64, contentType string) (Attachment_File, bool, error) {
+	var stored Attachment_File
+	db.Where("sha256 = ?", sum).Limit(1).Find(&stored)
+	if stored.AttachmentfileID != 0 {
+		return stored, true, nil
+	}
+
+	if _, err := putBlob(c.Request.Context(), blobStore, sum, file, size, contentType); err != nil {
+		return stored, false, err
+	}
+
+	stored = Attachment_File{Sha256: sum, Size: size, Content_type: contentType, Backend: blobStore.Name()}
+	if err := db.Create(&stored).Error; err != nil {
+		// Someone uploaded the same file at the same time.
+		var existing Attachment_File
+		if db.Where("sha256 = ?", sum).First(&existing).Error == nil {
+			return existing, true, nil
+		}
+		return stored, false, err
+	}
+	return stored, false, nil
+}
+
+// putBlob stores body under its content hash unless the storage already
+// has it, for example from an upload whose record was never created, and
+// reports whether it was already there.
+func putBlob(ctx context.Context, storage blobStorage, sum string, body io.ReadSeeker, size int64, contentType string) (bool, error) {
+	exists, err := storage.Exists(ctx, sum)
+	if err != nil || exists {
+		return exists, err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return false, storage.Put(ctx, sum, body, size, contentType)
+}
+
+// uploadAttachment takes a multipart form with file, learning_material_id
+// and an optional description.
+func uploadAttachment(c *gin.Context) {
+	if _, ok := requireStaff(c); !ok {
+		return
+	}
+
+	// Leave room for the rest of the form around the file.
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadSize+1<<20)
+
+	upload, header, err := c.Request.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File is larger than %d MB", maxUploadSize>>20)})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A file is required in the file field"})
+		return
+	}
+	defer upload.Close()
+
+	var learningMaterial Learning_Material
+	if err := db.First(&learningMaterial, c.PostForm("learning_material_id")).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Learning Material with that ID not found"})
+		return
+	}
+
+	tmp, err := os.CreateTemp("", "attachment-*")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store upload"})
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(upload, maxUploadSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read upload"})
+		return
+	}
+	if size > maxUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File is larger than %d MB", maxUploadSize>>20)})
+		return
+	}
+	if size == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File is empty"})
+		return
+	}
+
+	head := make([]byte, 512)
+	n, _ := tmp.ReadAt(head, 0)
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	if !uploadTypes[contentType] {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported file type " + contentType})
+		return
+	}
+
+	stored, deduplicated, err := storeUpload(c, tmp, hex.EncodeToString(hash.Sum(nil)), size, contentType)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store upload"})
+		return
+	}
+
+	attachment := Attachment{
+		LearningmaterialID: learningMaterial.LearningmaterialID,
+		Description:        c.PostForm("description"),
+		AttachmentfileID:   stored.AttachmentfileID,
+		File_name:          uploadFileName(header.Filename),
+		Content_type:       stored.Content_type,
+		Size:               stored.Size,
+	}
+	if err := db.Create(&attachment).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create attachment"})
+		return
+	}
+	created := []Attachment{attachment}
+	withDownloadURLs(c, created)
+
+	c.JSON(http.StatusCreated, gin.H{"attachment": created[0], "deduplicated": deduplicated})
+}
+
+// getAttachmentURL issues a logged in user a fresh download link.
+// ?expires_in is its lifetime in seconds, up to maxDownloadURLTTL.
+func getAttachmentURL(c *gin.Context) {
+	if _, ok := authenticatedUser(c); !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Log in first"})
+		return
+	}
+
+	var attachment Attachment
+	if err := db.First(&attachment, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+
+	if attachment.AttachmentfileID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Attachment is a link, use its source"})
+		return
+	}
+
+	ttl := defaultDownloadURLTTL
+	if value := c.Query("expires_in"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxDownloadURLTTL {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("expires_in must be between 1 and %d seconds", int(maxDownloadURLTTL.Seconds()))})
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	url, expires := signedDownloadURL(attachment, ttl)
+	c.JSON(http.StatusOK, gin.H{"url": url, "expires_at": expires})
+}
+
+var (
+	errInvalidDownloadSignature = errors.New("invalid download signature")
+	errDownloadExpired          = errors.New("download link has expired")
+)
+
+// downloadTimeLeft checks the expires and signature of a download link and
+// returns how long it stays valid.
+func downloadTimeLeft(attachmentID uint, expires, signature string, now time.Time) (time.Duration, error) {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || !hmac.Equal([]byte(signature), []byte(downloadSignature(attachmentID, expiresAt))) {
+		return 0, errInvalidDownloadSignature
+	}
+	remaining := time.Unix(expiresAt, 0).Sub(now)
+	if remaining <= 0 {
+		return 0, errDownloadExpired
+	}
+	return remaining, nil
+}
+
+// downloadAttachment serves a file attachment to anyone holding a valid,
+// unexpired signed link.
+func downloadAttachment(c *gin.Context) {
+	var attachment Attachment
+	if err := db.First(&attachment, c.Param("id")).Error; err != nil || attachment.AttachmentfileID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+
+	remaining, err := downloadTimeLeft(attachment.AttachmentID, c.Query("expires"), c.Query("signature"), time.Now())
+	if errors.Is(err, errDownloadExpired) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Download link has expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid download signature"})
+		return
+	}
+
+	var stored Attachment_File
+	if err := db.First(&stored, attachment.AttachmentfileID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment file not found"})
+		return
+	}
+
+	body, err := blobStore.Get(c.Request.Context(), stored.Sha256)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, errBlobNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": "Attachment file is not available"})
+		return
+	}
+	defer body.Close()
+
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.File_name}))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", int(remaining.Seconds())))
+	c.DataFromReader(http.StatusOK, stored.Size, stored.Content_type, body, nil)
+}
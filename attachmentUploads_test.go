@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/models"
+)
+
+func TestDownloadSignature(t *testing.T) {
+	signature := downloadSignature(7, 1700000000)
+	if signature != downloadSignature(7, 1700000000) {
+		t.Fatal("signature is not stable")
+	}
+	if signature == downloadSignature(8, 1700000000) {
+		t.Error("signature does not depend on the attachment")
+	}
+	if signature == downloadSignature(7, 1700000001) {
+		t.Error("signature does not depend on the expiry")
+	}
+	if strings.ContainsAny(signature, "+/=") {
+		t.Errorf("signature %q is not URL safe", signature)
+	}
+}
+
+func TestDownloadTimeLeft(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	valid := now.Add(10 * time.Minute).Unix()
+	expired := now.Add(-time.Second).Unix()
+
+	tests := []struct {
+		name      string
+		expires   string
+		signature string
+		remaining time.Duration
+		err       error
+	}{
+		{"valid", fmt.Sprint(valid), downloadSignature(7, valid), 10 * time.Minute, nil},
+		{"expired", fmt.Sprint(expired), downloadSignature(7, expired), 0, errDownloadExpired},
+		{"expiring now", fmt.Sprint(now.Unix()), downloadSignature(7, now.Unix()), 0, errDownloadExpired},
+		{"another attachment", fmt.Sprint(valid), downloadSignature(8, valid), 0, errInvalidDownloadSignature},
+		{"extended expiry", fmt.Sprint(valid + 3600), downloadSignature(7, valid), 0, errInvalidDownloadSignature},
+		{"missing signature", fmt.Sprint(valid), "", 0, errInvalidDownloadSignature},
+		{"unparsable expiry", "soon", downloadSignature(7, 0), 0, errInvalidDownloadSignature},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			remaining, err := downloadTimeLeft(7, test.expires, test.signature, now)
+			if !errors.Is(err, test.err) || remaining != test.remaining {
+				t.Errorf("downloadTimeLeft = %v, %v, want %v, %v", remaining, err, test.remaining, test.err)
+			}
+		})
+	}
+}
+
+// countingStorage counts the puts that reach the wrapped storage.
+type countingStorage struct {
+	blobStorage
+	puts int
+}
+
+func (s *countingStorage) Put(ctx context.Context, key string, body io.ReadSeeker, size int64, contentType string) error {
+	s.puts++
+	return s.blobStorage.Put(ctx, key, body, size, contentType)
+}
+
+func TestPutBlobStoresContentOnce(t *testing.T) {
+	ctx := context.Background()
+	local, err := newLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := &countingStorage{blobStorage: local}
+	sum := sha256Hex("same bytes")
+
+	// A half read body is rewound before it is stored.
+	body := strings.NewReader("same bytes")
+	body.Seek(4, io.SeekStart)
+	if existed, err := putBlob(ctx, storage, sum, body, 10, "text/plain"); err != nil || existed {
+		t.Fatalf("first putBlob = %v, %v, want false, nil", existed, err)
+	}
+	if existed, err := putBlob(ctx, storage, sum, strings.NewReader("same bytes"), 10, "text/plain"); err != nil || !existed {
+		t.Fatalf("second putBlob = %v, %v, want true, nil", existed, err)
+	}
+	if storage.puts != 1 {
+		t.Errorf("stored the same content %d times, want once", storage.puts)
+	}
+
+	stored, err := local.Get(ctx, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stored.Close()
+	if content, _ := io.ReadAll(stored); string(content) != "same bytes" {
+		t.Errorf("stored %q, want %q", content, "same bytes")
+	}
+}
+
+func TestUploadAttachmentRequiresStaff(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/attachment/upload", func(c *gin.Context) {
+		if id := c.GetHeader("X-Test-User"); id != "" {
+			c.Set("user", models.User{UserID: id})
+		}
+	}, uploadAttachment)
+
+	tests := []struct {
+		user   string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"STD1", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/attachment/upload", strings.NewReader("file"))
+		req.Header.Set("X-Test-User", test.user)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("upload as %q = %d, want %d", test.user, w.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Quiz_Attempt_Question records which quizzes an attempt drew, in which
+// order, and how their options were shuffled. Option_order lists the
+// canonical option letters in the order the student saw them, so displayed
+// letter i maps back to Option_order[i].
+type Quiz_Attempt_Question struct {
+	gorm.Model
+	QuizattemptquestionID uint   `gorm:"column:quiz_attempt_question_id;primaryKey;autoIncrement;unique" json:"quiz_attempt_question_id"`
+	QuizattemptID         uint   `json:"quiz_attempt_id"`
+	QuizID                uint   `json:"quiz_id"`
+	QuizrevisionID        uint   `json:"quiz_revision_id"`
+	Position              int    `json:"position"`
+	Option_order          string `json:"option_order"`
+}
+
+// presentedQuiz is what a student sees during an attempt: shuffled options
+// and no answer key.
+type presentedQuiz struct {
+	QuizID        uint     `json:"quiz_id"`
+	Position      int      `json:"position"`
+	Question      string   `json:"question"`
+	Question_type string   `json:"question_type"`
+	Options       []string `json:"options,omitempty"`
+	Prompts       []string `json:"prompts,omitempty"`
+}
+
+func hasShuffledOptions(questionType string) bool {
+	switch normalizeQuestionType(questionType) {
+	case questionSingleChoice, questionMultipleSelect, questionOrdering, questionMatching:
+		return true
+	}
+	return false
+}
+
+// drawAttemptQuestions samples and orders the subject's quizzes for a new
+// attempt from the attempt's seed, so the same seed always reproduces the
+// same draw.
+func drawAttemptQuestions(attempt Quiz_Attempt, policy Quiz_Policy, pool []Quiz) []Quiz_Attempt_Question {
+	rng := rand.New(rand.NewSource(attempt.Seed))
+
+	order := make([]int, len(pool))
+	for i := range order {
+		order[i] = i
+	}
+	if policy.Shuffle_questions || (policy.Question_count > 0 && policy.Question_count < len(pool)) {
+		rng.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	}
+	if policy.Question_count > 0 && policy.Question_count < len(order) {
+		order = order[:policy.Question_count]
+		if !policy.Shuffle_questions {
+			// Sampling alone should not reorder the questions.
+			sort.Ints(order)
+		}
+	}
+
+	var questions []Quiz_Attempt_Question
+	for position, index := range order {
+		quiz := pool[index]
+
+		letters := make([]string, len(quizSpec(quiz).Options))
+		for i := range letters {
+			letters[i] = optionLetter(i)
+		}
+		if policy.Shuffle_options && hasShuffledOptions(quiz.Question_type) {
+			rng.Shuffle(len(letters), func(i, j int) { letters[i], letters[j] = letters[j], letters[i] })
+		}
+
+		questions = append(questions, Quiz_Attempt_Question{
+			QuizattemptID: attempt.QuizattemptID,
+			QuizID:        quiz.QuizID,
+			Position:      position + 1,
+			Option_order:  strings.Join(letters, ","),
+		})
+	}
+	return questions
+}
+
+// attemptQuestions returns the drawn questions of an attempt. Attempts
+// started before questions were drawn per attempt get every quiz of the
+// subject in its original order.
+func attemptQuestions(attempt Quiz_Attempt) []Quiz_Attempt_Question {
+	var questions []Quiz_Attempt_Question
+	db.Where("quizattempt_id = ?", attempt.QuizattemptID).Order("position").Find(&questions)
+	if len(questions) > 0 {
+		return questions
+	}
+
+	var quizzes []Quiz
+	db.Where("subject_id = ?", attempt.SubjectID).Order("quiz_id").Find(&quizzes)
+	for i, quiz := range quizzes {
+		questions = append(questions, Quiz_Attempt_Question{QuizattemptID: attempt.QuizattemptID, QuizID: quiz.QuizID, Position: i + 1})
+	}
+	return questions
+}
+
+// canonicalAnswer translates an answer given in displayed letters into the
+// canonical letters the answer key uses.
+func canonicalAnswer(questionType string, optionOrder string, answer string) string {
+	if optionOrder == "" || !hasShuffledOptions(questionType) {
+		return answer
+	}
+	order := strings.Split(optionOrder, ",")
+
+	toCanonical := func(letter string) string {
+		index := optionIndex(letter)
+		if index < 0 || index >= len(order) {
+			return letter
+		}
+		return order[index]
+	}
+
+	switch normalizeQuestionType(questionType) {
+	case questionSingleChoice:
+		return toCanonical(answer)
+	case questionMatching:
+		pairs, ok := parseMatchingPairs(answer)
+		if !ok {
+			return answer
+		}
+		var mapped []string
+		for prompt, option := range pairs {
+			mapped = append(mapped, prompt+"="+toCanonical(option))
+		}
+		return strings.Join(mapped, ",")
+	}
+
+	var mapped []string
+	for _, letter := range splitLetters(answer) {
+		mapped = append(mapped, toCanonical(letter))
+	}
+	return strings.Join(mapped, ",")
+}
+
+func presentQuiz(quiz Quiz, question Quiz_Attempt_Question) presentedQuiz {
+	spec := quizSpec(quiz)
+	presented := presentedQuiz{
+		QuizID:        quiz.QuizID,
+		Position:      question.Position,
+		Question:      quiz.Question,
+		Question_type: normalizeQuestionType(quiz.Question_type),
+		Prompts:       spec.Prompts,
+	}
+
+	if normalizeQuestionType(quiz.Question_type) == questionTrueFalse || len(spec.Options) == 0 {
+		return presented
+	}
+
+	if question.Option_order == "" {
+		presented.Options = spec.Options
+		return presented
+	}
+
+	for _, letter := range strings.Split(question.Option_order, ",") {
+		index := optionIndex(letter)
+		if index >= 0 && index < len(spec.Options) {
+			presented.Options = append(presented.Options, spec.Options[index])
+		}
+	}
+	return presented
+}
+
+func presentAttempt(attempt Quiz_Attempt) []presentedQuiz {
+	quizzes := map[uint]Quiz{}
+	for _, quiz := range attemptQuizzes(attempt) {
+		quizzes[quiz.QuizID] = quiz
+	}
+
+	presented := []presentedQuiz{}
+	for _, question := range attemptQuestions(attempt) {
+		if quiz, ok := quizzes[question.QuizID]; ok {
+			presented = append(presented, presentQuiz(quiz, question))
+		}
+	}
+	return presented
+}
+
+func getQuizAttemptQuestions(c *gin.Context) {
+	attempt, ok := loadAttempt(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, presentAttempt(attempt))
+}
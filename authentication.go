@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/models"
+)
+
+// authenticatedUser returns the user that middleware.RequireAuth attached to
+// the request, if the request carried a valid token.
+func authenticatedUser(c *gin.Context) (models.User, bool) {
+	value, ok := c.Get("user")
+	if !ok {
+		return models.User{}, false
+	}
+	user, ok := value.(models.User)
+	return user, ok
+}
+
+// authenticatedStaff returns the authenticated user if it is staff, such as
+// an instructor or administrator. Students sign themselves up as STD users,
+// so every other user was created by an administrator and counts as staff.
+func authenticatedStaff(c *gin.Context) (models.User, bool) {
+	user, ok := authenticatedUser(c)
+	if !ok || strings.HasPrefix(user.UserID, "STD") {
+		return models.User{}, false
+	}
+	return user, true
+}
+
+// requireStaff answers 401 or 403 and returns false unless staff is logged
+// in. Use it after middleware.RequireAuth, which does not reject requests
+// by itself.
+func requireStaff(c *gin.Context) (models.User, bool) {
+	if _, ok := authenticatedUser(c); !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Log in first"})
+		return models.User{}, false
+	}
+	user, ok := authenticatedStaff(c)
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only staff can do this"})
+	}
+	return user, ok
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	bulkModeAtomic  = "atomic"
+	bulkModePartial = "partial"
+)
+
+// maxBulkBodySize limits a bulk request body, which is read whole.
+const maxBulkBodySize = 8 << 20
+
+// bulkRowError reports a rejected row. Row is 1-based: the line of an NDJSON
+// body, or the position in a JSON array.
+type bulkRowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// decodeBulkBody reads either a JSON array or NDJSON (one object per line)
+// from the request body, depending on the Content-Type header. It also
+// returns the row each item came from, as bulkRowError reports it.
+func decodeBulkBody[T any](c *gin.Context) ([]T, []int, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBulkBodySize))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var items []T
+	var rows []int
+	if strings.Contains(c.ContentType(), "ndjson") || strings.Contains(c.ContentType(), "jsonlines") {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line++
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+			var item T
+			if err := json.Unmarshal([]byte(text), &item); err != nil {
+				return nil, nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			items = append(items, item)
+			rows = append(rows, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, nil, err
+		}
+		return items, rows, nil
+	}
+
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, nil, err
+	}
+	for i := range items {
+		rows = append(rows, i+1)
+	}
+	return items, rows, nil
+}
+
+// rejectBulkBody answers a request whose body could not be read or decoded.
+func rejectBulkBody(c *gin.Context, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Body is larger than %d MB", tooLarge.Limit>>20)})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
+
+func bulkMode(c *gin.Context) (string, bool) {
+	mode := c.DefaultQuery("mode", bulkModeAtomic)
+	return mode, mode == bulkModeAtomic || mode == bulkModePartial
+}
+
+// validateQuestionFields checks the parts shared by Quiz and Placement_Test.
+func validateQuestionFields(question, correctAnswer string, options ...string) string {
+	if strings.TrimSpace(question) == "" {
+		return "Question must not be empty"
+	}
+	for i, option := range options {
+		if strings.TrimSpace(option) == "" {
+			return fmt.Sprintf("Option %c must not be empty", 'a'+i)
+		}
+	}
+	if !isOptionLetter(correctAnswer) {
+		return "Correct answer must be one of a, b, c or d"
+	}
+	return ""
+}
+
+func existingIDs(model interface{}, column string, ids []uint) map[uint]bool {
+	var found []uint
+	db.Model(model).Where(column+" IN ?", ids).Pluck(column, &found)
+
+	exists := map[uint]bool{}
+	for _, id := range found {
+		exists[id] = true
+	}
+	return exists
+}
+
+// insertBulk applies the atomic/partial semantics to rows the caller has
+// already split into valid rows and row errors. Keys in extra are added to
+// the response body.
+func insertBulk[T any](c *gin.Context, mode string, valid []T, rowErrors []bulkRowError, extra gin.H) {
+	if mode == bulkModeAtomic && len(rowErrors) > 0 {
+		response := gin.H{"error": "Validation failed, nothing was inserted", "errors": rowErrors}
+		for key, value := range extra {
+			response[key] = value
+		}
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+
+	if len(valid) > 0 {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			return tx.Create(&valid).Error
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert rows: " + err.Error()})
+			return
+		}
+	}
+
+	status := http.StatusCreated
+	if len(rowErrors) > 0 {
+		status = http.StatusMultiStatus
+	}
+	response := gin.H{"created": len(valid), "failed": len(rowErrors), "errors": rowErrors, "items": valid}
+	for key, value := range extra {
+		response[key] = value
+	}
+	c.JSON(status, response)
+}
+
+func createQuizBulk(c *gin.Context) {
+	mode, ok := bulkMode(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be atomic or partial"})
+		return
+	}
+
+	quizzes, rows, err := decodeBulkBody[Quiz](c)
+	if err != nil {
+		rejectBulkBody(c, err)
+		return
+	}
+	if len(quizzes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No quizzes to create"})
+		return
+	}
+
+	var subjectIDs []uint
+	for _, quiz := range quizzes {
+		subjectIDs = append(subjectIDs, quiz.SubjectID)
+	}
+	subjects := existingIDs(&Subject{}, "subject_id", subjectIDs)
+
+	var valid []Quiz
+	rowErrors := []bulkRowError{}
+	for i, quiz := range quizzes {
+		if !subjects[quiz.SubjectID] {
+			rowErrors = append(rowErrors, bulkRowError{Row: rows[i], Error: "Subject with that ID not found"})
+			continue
+		}
+		quiz.Question_type = normalizeQuestionType(quiz.Question_type)
+		if msg := validateQuiz(quiz); msg != "" {
+			rowErrors = append(rowErrors, bulkRowError{Row: rows[i], Error: msg})
+			continue
+		}
+		if quiz.Spec != nil {
+			normalizeAnswerKey(quiz.Question_type, quiz.Spec)
+			quiz.Correct_answer = correctAnswerSummary(quiz.Question_type, *quiz.Spec)
+		}
+		valid = append(valid, quiz)
+	}
+
+	insertBulk(c, mode, valid, rowErrors, nil)
+}
+
+func createPlacementTestBulk(c *gin.Context) {
+	mode, ok := bulkMode(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be atomic or partial"})
+		return
+	}
+
+	placementTests, rows, err := decodeBulkBody[Placement_Test](c)
+	if err != nil {
+		rejectBulkBody(c, err)
+		return
+	}
+	if len(placementTests) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No placement tests to create"})
+		return
+	}
+
+	var interestIDs []uint
+	for _, placementTest := range placementTests {
+		interestIDs = append(interestIDs, placementTest.InterestID)
+	}
+	interests := existingIDs(&Interest{}, "interest_id", interestIDs)
+
+	var valid []Placement_Test
+	rowErrors := []bulkRowError{}
+	for i, placementTest := range placementTests {
+		if !interests[placementTest.InterestID] {
+			rowErrors = append(rowErrors, bulkRowError{Row: rows[i], Error: "Interest with that ID not found"})
+			continue
+		}
+		placementTest.Question_type = normalizeQuestionType(placementTest.Question_type)
+		if msg := validatePlacementTest(placementTest); msg != "" {
+			rowErrors = append(rowErrors, bulkRowError{Row: rows[i], Error: msg})
+			continue
+		}
+		if placementTest.Spec != nil {
+			normalizeAnswerKey(placementTest.Question_type, placementTest.Spec)
+			placementTest.Correct_answer = correctAnswerSummary(placementTest.Question_type, *placementTest.Spec)
+		}
+		valid = append(valid, placementTest)
+	}
+
+	insertBulk(c, mode, valid, rowErrors, nil)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamChatbot sends the reply to turn as Server-Sent Events:
+//
+//	start  {"conversation_id", "citations"}  before the reply
+//	delta  {"content"}                       for each piece of the reply
+//	done   {"conversation", "message"}       once the reply is stored
+//	error  {"error", "code"}                 if the reply failed
+//
+// When the client goes away the upstream request is cancelled and nothing
+// is stored, as with a failed reply.
+func streamChatbot(c *gin.Context, turn *chatTurn) {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	send := func(event string, data gin.H) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c.SSEvent(event, data)
+		c.Writer.Flush()
+		if c.IsAborted() {
+			// Writing failed, so the client is gone.
+			cancel()
+			return context.Canceled
+		}
+		return nil
+	}
+
+	if send("start", gin.H{"conversation_id": turn.conversation.ConversationID, "citations": turn.citations}) != nil {
+		return
+	}
+
+	reply, err := chatLLM.Stream(ctx, turn.messages, func(delta string) error {
+		return send("delta", gin.H{"content": delta})
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			log.Println("Chat stream cancelled, the client went away")
+			return
+		}
+		_, message := llmErrorResponse(err)
+		send("error", gin.H{"error": message, "code": asLLMError(err).Kind})
+		return
+	}
+
+	assistantMessage, err := turn.save(reply)
+	if err != nil {
+		send("error", gin.H{"error": "Failed to save conversation", "code": "save_failed"})
+		return
+	}
+	send("done", gin.H{"conversation": turn.conversation, "message": assistantMessage})
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+	"gorm.io/gorm"
+)
+
+// Learning_Material.Content is stored as written, in Content_format. The
+// sanitized HTML is cached in Rendered_content next to a hash of what it was
+// rendered from, so it is only rendered again when the source or
+// contentRendererVersion changes.
+const (
+	formatPlain    = "plain"
+	formatMarkdown = "markdown"
+	formatHTML     = "html"
+)
+
+// Bump contentRendererVersion whenever rendering or the sanitizer policy
+// changes so cached HTML is rendered again.
+const contentRendererVersion = 1
+
+const mimeMarkdown = "text/markdown"
+
+var paragraphBreak = regexp.MustCompile(`\n\s*\n`)
+
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM, mathExtension{}),
+	goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+)
+
+// contentPolicy allows the usual user-generated HTML including images and
+// tables, plus the classes fenced code blocks and math use for client-side
+// highlighting and typesetting. Scripts, styles, event handlers and
+// javascript: URLs are all removed.
+var contentPolicy = func() *bluemonday.Policy {
+	policy := bluemonday.UGCPolicy()
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+#-]+$`)).OnElements("code")
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^math (inline|display)$`)).OnElements("span")
+	policy.AllowURLSchemes("http", "https", "mailto")
+	policy.AddTargetBlankToFullyQualifiedLinks(true)
+	return policy
+}()
+
+// contentFormat applies the default format and reports whether it is
+// known. Content without a format is plain text, as all content was before
+// formats existed.
+func contentFormat(format *string) bool {
+	*format = strings.ToLower(strings.TrimSpace(*format))
+	if *format == "" {
+		*format = formatPlain
+	}
+	return *format == formatPlain || *format == formatMarkdown || *format == formatHTML
+}
+
+// renderContent turns content into sanitized HTML.
+func renderContent(format string, content string) (string, error) {
+	var out string
+	switch format {
+	case formatMarkdown:
+		var buf bytes.Buffer
+		if err := markdown.Convert([]byte(content), &buf); err != nil {
+			return "", err
+		}
+		out = buf.String()
+	case formatHTML:
+		out = content
+	default:
+		var paragraphs []string
+		for _, paragraph := range paragraphBreak.Split(strings.ReplaceAll(content, "\r\n", "\n"), -1) {
+			if paragraph = strings.TrimSpace(paragraph); paragraph != "" {
+				paragraphs = append(paragraphs, "<p>"+strings.ReplaceAll(html.EscapeString(paragraph), "\n", "<br>\n")+"</p>")
+			}
+		}
+		out = strings.Join(paragraphs, "\n")
+	}
+	return contentPolicy.Sanitize(out), nil
+}
+
+func renderHash(format string, content string) string {
+	sum := sha256.Sum256([]byte(strconv.Itoa(contentRendererVersion) + "\x00" + format + "\x00" + content))
+	return hex.EncodeToString(sum[:])
+}
+
+// renderMaterial fills in the rendered HTML of material if the cached copy
+// is missing or stale and reports whether it changed.
+func renderMaterial(material *Learning_Material) (bool, error) {
+	if !contentFormat(&material.Content_format) {
+		material.Content_format = formatPlain
+	}
+	hash := renderHash(material.Content_format, material.Content)
+	if hash == material.Rendered_hash {
+		return false, nil
+	}
+
+	rendered, err := renderContent(material.Content_format, material.Content)
+	if err != nil {
+		return false, err
+	}
+	material.Rendered_content, material.Rendered_hash = rendered, hash
+	return true, nil
+}
+
+// cachedMaterial makes sure the cached HTML of a stored material is current
+// and saves it. Reads only call renderMaterial so a GET never writes.
+func cachedMaterial(tx *gorm.DB, material *Learning_Material) error {
+	changed, err := renderMaterial(material)
+	if err != nil || !changed {
+		return err
+	}
+	return tx.Model(material).Updates(map[string]interface{}{
+		"content_format":   material.Content_format,
+		"rendered_content": material.Rendered_content,
+		"rendered_hash":    material.Rendered_hash,
+	}).Error
+}
+
+// migrateRenderedContent renders content stored before rendering existed or
+// with an older renderer.
+func migrateRenderedContent() {
+	var batch []Learning_Material
+	db.FindInBatches(&batch, exportBatchSize, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			cachedMaterial(db, &batch[i])
+		}
+		return nil
+	})
+}
+
+// negotiateMaterial answers with the rendered HTML or the source when the
+// client asks for text/html, text/markdown or text/plain, and reports
+// whether it did. Anything else gets the usual JSON.
+func negotiateMaterial(c *gin.Context, material Learning_Material) bool {
+	switch c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML, mimeMarkdown, gin.MIMEPlain) {
+	case gin.MIMEHTML:
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(material.Rendered_content))
+	case mimeMarkdown:
+		if material.Content_format != formatMarkdown {
+			c.JSON(http.StatusNotAcceptable, gin.H{"error": "Learning Material is not written in markdown"})
+			return true
+		}
+		c.Data(http.StatusOK, mimeMarkdown+"; charset=utf-8", []byte(material.Content))
+	case gin.MIMEPlain:
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(material.Content))
+	default:
+		return false
+	}
+	c.Header("Vary", "Accept")
+	return true
+}
+
+// mathExtension adds TeX math to Markdown: $...$ inline and $$...$$ for
+// display math, which may span lines. The TeX is left for a client-side
+// library such as KaTeX or MathJax to typeset, so it is only escaped.
+type mathExtension struct{}
+
+var kindMath = ast.NewNodeKind("Math")
+
+type mathNode struct {
+	ast.BaseInline
+	tex     []byte
+	display bool
+}
+
+func (n *mathNode) Kind() ast.NodeKind { return kindMath }
+
+func (n *mathNode) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"TeX": string(n.tex)}, nil)
+}
+
+type mathParser struct{}
+
+func (mathParser) Trigger() []byte { return []byte{'$'} }
+
+// Parse follows the usual TeX-in-Markdown rules so prices are left alone:
+// inline math must not start or end with a space and must close on the
+// same line.
+func (mathParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	delimiter := 1
+	if len(line) > 1 && line[1] == '$' {
+		delimiter = 2
+	}
+	if delimiter == 1 && (len(line) < 2 || line[1] == ' ' || line[1] == '\n') {
+		return nil
+	}
+
+	lineNumber, position := block.Position()
+	block.Advance(delimiter)
+
+	var tex []byte
+	for {
+		line, _ := block.PeekLine()
+		if line == nil {
+			break
+		}
+		if end := closingDelimiter(line, delimiter); end >= 0 {
+			tex = append(tex, line[:end]...)
+			block.Advance(end + delimiter)
+			if len(bytes.TrimSpace(tex)) == 0 {
+				break
+			}
+			return &mathNode{tex: tex, display: delimiter == 2}
+		}
+		if delimiter == 1 {
+			break
+		}
+		tex = append(tex, line...)
+		block.AdvanceLine()
+	}
+
+	block.SetPosition(lineNumber, position)
+	return nil
+}
+
+// closingDelimiter returns where the closing $ or $$ starts in line, or -1.
+func closingDelimiter(line []byte, delimiter int) int {
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\':
+			i++
+		case delimiter == 2 && i+1 < len(line) && line[i] == '$' && line[i+1] == '$':
+			return i
+		case delimiter == 1 && line[i] == '$' && i > 0 && line[i-1] != ' ' && (i+1 == len(line) || line[i+1] < '0' || line[i+1] > '9'):
+			return i
+		}
+	}
+	return -1
+}
+
+type mathRenderer struct{}
+
+func (r mathRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindMath, r.render)
+}
+
+func (mathRenderer) render(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*mathNode)
+	if n.display {
+		w.WriteString(`<span class="math display">\[`)
+		w.Write(util.EscapeHTML(n.tex))
+		w.WriteString(`\]</span>`)
+	} else {
+		w.WriteString(`<span class="math inline">\(`)
+		w.Write(util.EscapeHTML(n.tex))
+		w.WriteString(`\)</span>`)
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+func (mathExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithInlineParsers(util.Prioritized(mathParser{}, 150)))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(mathRenderer{}, 500)))
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	chunkSourceSubject  = "subject"
+	chunkSourceMaterial = "material"
+)
+
+const (
+	chunkWords   = 180
+	chunkOverlap = 30
+	// retrievalLimit is how many chunks are put in front of the model for a
+	// question, and minRetrievalScore how similar a chunk must be to count.
+	retrievalLimit    = 4
+	minRetrievalScore = 0.1
+	// groundingTokens caps how much of the history budget course content
+	// may take.
+	groundingTokens = 1500
+)
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// chatCitation points from a reply back to the content it was grounded in.
+// Index is the [n] the model cites it by.
+type chatCitation struct {
+	Index              int     `json:"index"`
+	Source_type        string  `json:"source_type"`
+	SubjectID          uint    `json:"subject_id"`
+	LearningmaterialID uint    `json:"learning_material_id,omitempty"`
+	Title              string  `json:"title"`
+	Score              float64 `json:"score"`
+}
+
+type contentSource struct {
+	chunkSource
+	SubjectID          uint
+	LearningmaterialID uint
+	Title              string
+	Text               string
+}
+
+// plainText turns sanitized HTML back into text for embedding.
+func plainText(rendered string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(htmlTag.ReplaceAllString(rendered, " "))), " ")
+}
+
+// chunkText splits text into passages of chunkWords words that overlap by
+// chunkOverlap words, so a sentence cut at one boundary is whole in the
+// next passage.
+func chunkText(text string) []string {
+	words := strings.Fields(text)
+	var chunks []string
+	for start := 0; start < len(words); start += chunkWords - chunkOverlap {
+		end := min(start+chunkWords, len(words))
+		chunks = append(chunks, strings.Join(words[start:end], " "))
+		if end == len(words) {
+			break
+		}
+	}
+	return chunks
+}
+
+// contentSources lists what the chatbot may draw on: every subject and
+// every published learning material.
+func contentSources() []contentSource {
+	var sources []contentSource
+
+	var subjects []Subject
+	db.Find(&subjects)
+	for _, subject := range subjects {
+		sources = append(sources, contentSource{
+			chunkSource: chunkSource{Type: chunkSourceSubject, ID: subject.SubjectID},
+			SubjectID:   subject.SubjectID,
+			Title:       subject.Subject_name,
+			Text:        subject.Subject_name + ". " + subject.Description,
+		})
+	}
+
+	var materials []Learning_Material
+	db.Scopes(publishedMaterials).Find(&materials)
+	for _, material := range materials {
+		title := material.Title
+		if title == "" {
+			title = fmt.Sprintf("Learning Material %d", material.LearningmaterialID)
+		}
+		sources = append(sources, contentSource{
+			chunkSource:        chunkSource{Type: chunkSourceMaterial, ID: material.LearningmaterialID},
+			SubjectID:          material.SubjectID,
+			LearningmaterialID: material.LearningmaterialID,
+			Title:              title,
+			Text:               strings.TrimSpace(material.Title + "\n" + plainText(material.Rendered_content)),
+		})
+	}
+	return sources
+}
+
+func sourceHash(source contentSource) string {
+	sum := sha256.Sum256([]byte(contentEmbedder.Name() + "\x00" + fmt.Sprint(source.SubjectID) + "\x00" + source.Title + "\x00" + source.Text))
+	return hex.EncodeToString(sum[:])
+}
+
+// syncContentIndex embeds sources that are new or changed since they were
+// indexed and removes those that were deleted or unpublished.
+func syncContentIndex(ctx context.Context) error {
+	return indexSources(ctx, contentSources())
+}
+
+// indexSources brings the index in line with sources. A source that fails
+// is logged and keeps its old chunks until the next run, so one bad source
+// does not hold up the rest.
+func indexSources(ctx context.Context, sources []contentSource) error {
+	indexed, err := contentVectors.Indexed(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, source := range sources {
+		hash := sourceHash(source)
+		current, ok := indexed[source.chunkSource]
+		delete(indexed, source.chunkSource)
+		if ok && current == hash {
+			continue
+		}
+
+		// A source with no text has nothing to embed, but whatever it said
+		// before must go.
+		texts := chunkText(source.Text)
+		if len(texts) == 0 {
+			if ok {
+				if err := contentVectors.Delete(ctx, source.chunkSource); err != nil {
+					log.Printf("Failed to remove %s %d from the content index: %v", source.Type, source.ID, err)
+				}
+			}
+			continue
+		}
+
+		if err := indexSource(ctx, source, hash, texts); err != nil {
+			log.Printf("Failed to index %s %d: %v", source.Type, source.ID, err)
+		}
+	}
+
+	for source := range indexed {
+		if err := contentVectors.Delete(ctx, source); err != nil {
+			log.Printf("Failed to remove %s %d from the content index: %v", source.Type, source.ID, err)
+		}
+	}
+	return nil
+}
+
+// indexSource embeds the passages of one source and replaces its chunks.
+func indexSource(ctx context.Context, source contentSource, hash string, texts []string) error {
+	vectors, err := contentEmbedder.Embed(ctx, texts)
+	if err != nil {
+		return err
+	}
+	if len(vectors) != len(texts) {
+		return fmt.Errorf("embedder returned %d vectors for %d passages", len(vectors), len(texts))
+	}
+	chunks := make([]Content_Chunk, len(texts))
+	for i, text := range texts {
+		chunks[i] = Content_Chunk{
+			Source_type:        source.Type,
+			Source_id:          source.ID,
+			SubjectID:          source.SubjectID,
+			LearningmaterialID: source.LearningmaterialID,
+			Chunk:              i,
+			Title:              source.Title,
+			Content:            text,
+			Source_hash:        hash,
+			Embedding:          encodeVector(vectors[i]),
+		}
+	}
+	return contentVectors.Replace(ctx, source.chunkSource, chunks)
+}
+
+// indexContent keeps the content index in step with subjects and learning
+// materials in the background, so edits reach the chatbot within interval.
+func indexContent(interval time.Duration) {
+	for {
+		if err := syncContentIndex(context.Background()); err != nil {
+			log.Println("Failed to index content for the chatbot:", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// enrolledSubjectIDs are the subjects a student is or was enrolled in,
+// leaving out dropped ones.
+func enrolledSubjectIDs(studentID uint) []uint {
+	var subjectIDs []uint
+	db.Model(&Subject_Joined{}).Where("student_id = ? AND status <> ?", studentID, enrollmentDropped).Distinct().Pluck("subject_id", &subjectIDs)
+	return subjectIDs
+}
+
+// retrieveContent finds the passages of the student's subjects most
+// related to question.
+func retrieveContent(ctx context.Context, studentID uint, question string) ([]chunkMatch, error) {
+	return retrieveSubjectContent(ctx, enrolledSubjectIDs(studentID), question)
+}
+
+// retrieveSubjectContent finds the passages of subjectIDs most related to
+// question, leaving out those below minRetrievalScore.
+func retrieveSubjectContent(ctx context.Context, subjectIDs []uint, question string) ([]chunkMatch, error) {
+	if len(subjectIDs) == 0 {
+		return nil, nil
+	}
+
+	vectors, err := contentEmbedder.Embed(ctx, []string{question})
+	if err != nil {
+		return nil, err
+	}
+	matches, err := contentVectors.Search(ctx, vectors[0], subjectIDs, retrievalLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	relevant := matches[:0]
+	for _, match := range matches {
+		if match.Score >= minRetrievalScore {
+			relevant = append(relevant, match)
+		}
+	}
+	return relevant, nil
+}
+
+// groundingMessage puts the retrieved passages in a system message, numbered
+// so the model can cite them, and returns the citations for them. Passages
+// that do not fit in groundingTokens are left out.
+func groundingMessage(matches []chunkMatch) (chatMessage, []chatCitation) {
+	var excerpts strings.Builder
+	var citations []chatCitation
+	budget := groundingTokens
+	for _, match := range matches {
+		excerpt := fmt.Sprintf("[%d] %s\n%s\n\n", len(citations)+1, match.Title, match.Content)
+		if estimateTokens(excerpt) > budget {
+			continue
+		}
+		budget -= estimateTokens(excerpt)
+		excerpts.WriteString(excerpt)
+		citations = append(citations, chatCitation{
+			Index:              len(citations) + 1,
+			Source_type:        match.Source_type,
+			SubjectID:          match.SubjectID,
+			LearningmaterialID: match.LearningmaterialID,
+			Title:              match.Title,
+			Score:              match.Score,
+		})
+	}
+	if len(citations) == 0 {
+		return chatMessage{}, nil
+	}
+
+	return chatMessage{
+		Role: roleSystem,
+		Content: "You are the tutor for the student's courses. Answer from the course excerpts below where they are relevant, " +
+			"citing them by number like [1]. If they do not cover the question, say so before answering from general knowledge.\n\n" +
+			strings.TrimSpace(excerpts.String()),
+	}, citations
+}
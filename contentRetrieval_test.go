@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// countingEmbedder wraps an embedder, counts the texts it embeds and fails
+// for any text containing fail.
+type countingEmbedder struct {
+	embedder
+	fail     string
+	embedded *int
+}
+
+func (e countingEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	for _, text := range texts {
+		if e.fail != "" && strings.Contains(text, e.fail) {
+			return nil, errors.New("embedding failed")
+		}
+	}
+	*e.embedded += len(texts)
+	return e.embedder.Embed(ctx, texts)
+}
+
+// useTestIndex points the content index at an in-memory store for the
+// test and returns it with the count of embedded texts.
+func useTestIndex(t *testing.T, fail string) (*memoryVectorStore, *int) {
+	previousEmbedder, previousVectors := contentEmbedder, contentVectors
+	t.Cleanup(func() { contentEmbedder, contentVectors = previousEmbedder, previousVectors })
+
+	store, embedded := newMemoryVectorStore(), new(int)
+	contentEmbedder = countingEmbedder{embedder: hashEmbedder{dimensions: 256}, fail: fail, embedded: embedded}
+	contentVectors = store
+	return store, embedded
+}
+
+func words(n int) string {
+	parts := make([]string, n)
+	for i := range parts {
+		parts[i] = fmt.Sprintf("w%d", i)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestChunkText(t *testing.T) {
+	if chunks := chunkText("  \n "); len(chunks) != 0 {
+		t.Errorf("blank text gave %d chunks, want 0", len(chunks))
+	}
+	if chunks := chunkText(words(10)); len(chunks) != 1 || chunks[0] != words(10) {
+		t.Errorf("short text gave %q, want it whole", chunks)
+	}
+
+	chunks := chunkText(words(400))
+	if len(chunks) != 3 {
+		t.Fatalf("400 words gave %d chunks, want 3", len(chunks))
+	}
+	step := chunkWords - chunkOverlap
+	for i, chunk := range chunks {
+		if first := strings.Fields(chunk)[0]; first != fmt.Sprintf("w%d", i*step) {
+			t.Errorf("chunk %d starts at %s, want w%d", i, first, i*step)
+		}
+	}
+	if last := strings.Fields(chunks[2]); last[len(last)-1] != "w399" {
+		t.Errorf("last chunk ends at %s, want w399", last[len(last)-1])
+	}
+}
+
+func TestIndexSources(t *testing.T) {
+	store, embedded := useTestIndex(t, "")
+	ctx := context.Background()
+
+	subject := contentSource{chunkSource: chunkSource{Type: chunkSourceSubject, ID: 1}, SubjectID: 1, Title: "Go", Text: "Go. Concurrency with goroutines"}
+	material := contentSource{chunkSource: chunkSource{Type: chunkSourceMaterial, ID: 2}, SubjectID: 1, LearningmaterialID: 2, Title: "Channels", Text: words(200)}
+	empty := contentSource{chunkSource: chunkSource{Type: chunkSourceMaterial, ID: 3}, SubjectID: 1, LearningmaterialID: 3, Title: "Draft", Text: ""}
+
+	if err := indexSources(ctx, []contentSource{subject, material, empty}); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.chunks) != 2 || len(store.chunks[subject.chunkSource]) != 1 || len(store.chunks[material.chunkSource]) != 2 {
+		t.Fatalf("indexed %v, want 1 subject chunk and 2 material chunks", store.chunks)
+	}
+	if _, ok := store.chunks[empty.chunkSource]; ok {
+		t.Error("a source without text was indexed")
+	}
+	if *embedded != 3 {
+		t.Errorf("embedded %d texts, want 3", *embedded)
+	}
+
+	// Unchanged sources are not embedded again.
+	*embedded = 0
+	if err := indexSources(ctx, []contentSource{subject, material, empty}); err != nil {
+		t.Fatal(err)
+	}
+	if *embedded != 0 {
+		t.Errorf("embedded %d texts on a run with no changes, want 0", *embedded)
+	}
+
+	// A source emptied since it was indexed loses its chunks, and one
+	// that is gone is removed.
+	material.Text = ""
+	if err := indexSources(ctx, []contentSource{material}); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.chunks) != 0 {
+		t.Errorf("index still has %v, want nothing", store.chunks)
+	}
+}
+
+func TestIndexSourcesContinuesAfterFailure(t *testing.T) {
+	store, _ := useTestIndex(t, "broken")
+	ctx := context.Background()
+
+	good := contentSource{chunkSource: chunkSource{Type: chunkSourceMaterial, ID: 1}, SubjectID: 1, Title: "Good", Text: "fine text"}
+	bad := contentSource{chunkSource: chunkSource{Type: chunkSourceMaterial, ID: 2}, SubjectID: 1, Title: "Bad", Text: "old text"}
+	if err := indexSources(ctx, []contentSource{good, bad}); err != nil {
+		t.Fatal(err)
+	}
+	oldHash := store.chunks[bad.chunkSource][0].Source_hash
+
+	bad.Text = "broken text"
+	good.Text = "new fine text"
+	if err := indexSources(ctx, []contentSource{bad, good}); err != nil {
+		t.Fatal(err)
+	}
+	if chunks := store.chunks[good.chunkSource]; len(chunks) != 1 || chunks[0].Content != "new fine text" {
+		t.Errorf("good source = %v, want it reindexed after the failure", chunks)
+	}
+	if chunks := store.chunks[bad.chunkSource]; len(chunks) != 1 || chunks[0].Source_hash != oldHash {
+		t.Errorf("failed source = %v, want its old chunks kept", chunks)
+	}
+}
+
+func TestRetrieveSubjectContent(t *testing.T) {
+	store, _ := useTestIndex(t, "")
+	ctx := context.Background()
+	add := func(id uint, subjectID uint, texts ...string) {
+		chunks := make([]Content_Chunk, len(texts))
+		for i, text := range texts {
+			chunks[i] = Content_Chunk{Source_type: chunkSourceMaterial, Source_id: id, SubjectID: subjectID, Chunk: i, Content: text, Embedding: encodeVector(embedOne(t, contentEmbedder, text))}
+		}
+		store.Replace(ctx, chunkSource{Type: chunkSourceMaterial, ID: id}, chunks)
+	}
+	add(1, 1, "Goroutines and channels", "Select waits on several channels")
+	add(2, 1, "HTML forms and inputs")
+	add(3, 2, "Channels in another subject")
+
+	matches, err := retrieveSubjectContent(ctx, []uint{1}, "waiting on channels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(store.searched, [][]uint{{1}}) {
+		t.Errorf("searched subjects %v, want only subject 1", store.searched)
+	}
+	if len(matches) != 2 {
+		t.Fatalf("got %d matches, want the 2 channel chunks of subject 1", len(matches))
+	}
+	for _, match := range matches {
+		if match.SubjectID != 1 || match.Source_id != 1 {
+			t.Errorf("matched material %d of subject %d, want material 1 of subject 1", match.Source_id, match.SubjectID)
+		}
+		if match.Score < minRetrievalScore {
+			t.Errorf("kept a match scoring %v, below %v", match.Score, minRetrievalScore)
+		}
+	}
+	if matches[0].Score < matches[1].Score {
+		t.Error("matches are not sorted best first")
+	}
+
+	// A student with no subjects is not searched for at all.
+	store.searched = nil
+	if matches, err := retrieveSubjectContent(ctx, nil, "channels"); err != nil || len(matches) != 0 {
+		t.Errorf("no subjects gave %v, %v, want nothing", matches, err)
+	}
+	if len(store.searched) != 0 {
+		t.Errorf("searched %v without subjects", store.searched)
+	}
+}
+
+func TestGroundingMessage(t *testing.T) {
+	matches := []chunkMatch{
+		{Content_Chunk: Content_Chunk{Source_type: chunkSourceMaterial, SubjectID: 1, LearningmaterialID: 7, Title: "Channels", Content: "Channels connect goroutines."}, Score: 0.8},
+		{Content_Chunk: Content_Chunk{Source_type: chunkSourceMaterial, SubjectID: 1, LearningmaterialID: 8, Title: "Too long", Content: strings.Repeat("x", groundingTokens*4)}, Score: 0.7},
+		{Content_Chunk: Content_Chunk{Source_type: chunkSourceSubject, SubjectID: 1, Title: "Go", Content: "A course on Go."}, Score: 0.5},
+	}
+
+	message, citations := groundingMessage(matches)
+	if message.Role != roleSystem {
+		t.Errorf("role = %q, want %q", message.Role, roleSystem)
+	}
+	want := []chatCitation{
+		{Index: 1, Source_type: chunkSourceMaterial, SubjectID: 1, LearningmaterialID: 7, Title: "Channels", Score: 0.8},
+		{Index: 2, Source_type: chunkSourceSubject, SubjectID: 1, Title: "Go", Score: 0.5},
+	}
+	if !reflect.DeepEqual(citations, want) {
+		t.Errorf("citations = %+v, want %+v", citations, want)
+	}
+	// The passage that did not fit is left out and the next one takes its
+	// number, so [n] in the message matches citation n.
+	if !strings.Contains(message.Content, "[1] Channels\nChannels connect goroutines.") || !strings.Contains(message.Content, "[2] Go\nA course on Go.") {
+		t.Errorf("message does not number the passages 1 and 2:\n%s", message.Content)
+	}
+	if strings.Contains(message.Content, "Too long") {
+		t.Error("message includes the passage over the token budget")
+	}
+}
+
+func TestGroundingMessageStaysWithinBudget(t *testing.T) {
+	var matches []chunkMatch
+	for i := 0; i < 10; i++ {
+		matches = append(matches, chunkMatch{Content_Chunk: Content_Chunk{Title: fmt.Sprint("Part ", i), Content: words(300)}})
+	}
+
+	message, citations := groundingMessage(matches)
+	if len(citations) == 0 || len(citations) == len(matches) {
+		t.Fatalf("kept %d of %d passages, want some left out", len(citations), len(matches))
+	}
+	used := 0
+	for i := range citations {
+		used += estimateTokens(fmt.Sprintf("[%d] %s\n%s\n\n", i+1, matches[i].Title, matches[i].Content))
+	}
+	if used > groundingTokens {
+		t.Errorf("passages take %d tokens, over the %d budget", used, groundingTokens)
+	}
+	if !strings.Contains(message.Content, fmt.Sprintf("[%d] Part %d", len(citations), len(citations)-1)) {
+		t.Errorf("message does not end with passage %d", len(citations))
+	}
+
+	if message, citations := groundingMessage(nil); message.Role != "" || citations != nil {
+		t.Errorf("no matches gave %+v, %v, want no message", message, citations)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"go-api/models"
+)
+
+const (
+	roleUser      = "user"
+	roleAssistant = "assistant"
+	roleSystem    = "system"
+)
+
+const (
+	// defaultChatHistoryTokens is how much earlier conversation is sent
+	// with each message unless CHAT_HISTORY_TOKENS says otherwise.
+	defaultChatHistoryTokens = 3000
+	// messageTokenOverhead covers the role and framing of each message.
+	messageTokenOverhead = 4
+	maxConversationTitle = 60
+	maxChatMessage       = 8000
+)
+
+type Conversation struct {
+	gorm.Model
+	ConversationID  uint      `gorm:"column:conversation_id;primaryKey;autoIncrement;unique" json:"conversation_id"`
+	StudentID       uint      `gorm:"index" json:"student_id"`
+	Title           string    `json:"title"`
+	Last_message_at time.Time `json:"last_message_at"`
+	Messages        []Message `gorm:"foreignKey:ConversationID;references:ConversationID" json:"messages,omitempty"`
+}
+
+type Message struct {
+	gorm.Model
+	MessageID      uint           `gorm:"column:message_id;primaryKey;autoIncrement;unique" json:"message_id"`
+	ConversationID uint           `gorm:"index" json:"conversation_id"`
+	Role           string         `json:"role"`
+	Content        string         `json:"content"`
+	Tokens         int            `json:"tokens"`
+	Citations      []chatCitation `gorm:"serializer:json" json:"citations,omitempty"`
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// authenticatedStudentID returns the student behind the user that
+// middleware.RequireAuth attached to the request. Student users are named
+// STD followed by the student ID.
+func authenticatedStudentID(c *gin.Context) (uint, bool) {
+	value, ok := c.Get("user")
+	if !ok {
+		return 0, false
+	}
+	user, ok := value.(models.User)
+	if !ok || !strings.HasPrefix(user.UserID, "STD") {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(user.UserID, "STD"), 10, 0)
+	if err != nil {
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func requireStudent(c *gin.Context) (uint, bool) {
+	studentID, ok := authenticatedStudentID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Log in as a student first"})
+	}
+	return studentID, ok
+}
+
+// estimateTokens approximates the tokens text costs, at about four
+// characters a token, without depending on the model's tokenizer.
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text)+3)/4 + messageTokenOverhead
+}
+
+func chatHistoryTokens() int {
+	if budget, err := strconv.Atoi(os.Getenv("CHAT_HISTORY_TOKENS")); err == nil && budget > 0 {
+		return budget
+	}
+	return defaultChatHistoryTokens
+}
+
+// conversationHistory returns the latest turns of a conversation that fit in
+// budget tokens, oldest first. Older turns are left out rather than cut
+// short.
+func conversationHistory(conversationID uint, budget int) []chatMessage {
+	var history []chatMessage
+	var batch []Message
+	offset := 0
+	for {
+		batch = batch[:0]
+		db.Where("conversation_id = ?", conversationID).Order("message_id DESC").Offset(offset).Limit(50).Find(&batch)
+		for _, message := range batch {
+			if message.Tokens > budget {
+				return reverseChat(history)
+			}
+			budget -= message.Tokens
+			history = append(history, chatMessage{Role: message.Role, Content: message.Content})
+		}
+		if len(batch) < 50 {
+			return reverseChat(history)
+		}
+		offset += len(batch)
+	}
+}
+
+func reverseChat(messages []chatMessage) []chatMessage {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages
+}
+
+// conversationTitle names a conversation after its first message.
+func conversationTitle(message string) string {
+	title := strings.Join(strings.Fields(message), " ")
+	if utf8.RuneCountInString(title) > maxConversationTitle {
+		runes := []rune(title)
+		title = strings.TrimSpace(string(runes[:maxConversationTitle-1])) + "…"
+	}
+	return title
+}
+
+// findConversation loads a conversation of the authenticated student.
+func findConversation(c *gin.Context, studentID uint, id string) (Conversation, bool) {
+	var conversation Conversation
+	if err := db.Where("student_id = ?", studentID).First(&conversation, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return conversation, false
+	}
+	return conversation, true
+}
+
+// chatTurn is a student's message with everything sent along with it.
+type chatTurn struct {
+	conversation Conversation
+	userMessage  Message
+	messages     []chatMessage
+	citations    []chatCitation
+}
+
+// newChatTurn grounds message in the passages of the student's subjects
+// most related to it and adds as much of the earlier conversation as fits
+// in the history budget.
+func newChatTurn(ctx context.Context, studentID uint, conversation Conversation, message string) *chatTurn {
+	turn := &chatTurn{
+		conversation: conversation,
+		userMessage:  Message{Role: roleUser, Content: message, Tokens: estimateTokens(message)},
+	}
+
+	// The chatbot still answers when retrieval fails, just without course
+	// content.
+	matches, err := retrieveContent(ctx, studentID, message)
+	if err != nil {
+		log.Println("Failed to retrieve content for the chatbot:", err)
+	}
+	grounding, citations := groundingMessage(matches)
+
+	budget := chatHistoryTokens() - turn.userMessage.Tokens
+	if len(citations) > 0 {
+		budget -= estimateTokens(grounding.Content)
+		turn.messages = append(turn.messages, grounding)
+		turn.citations = citations
+	}
+	turn.messages = append(turn.messages, conversationHistory(conversation.ConversationID, max(budget, 0))...)
+	turn.messages = append(turn.messages, chatMessage{Role: roleUser, Content: message})
+	return turn
+}
+
+// save stores the student's message and the reply, starting the
+// conversation if it is new. Nothing is stored for a turn without a reply.
+func (t *chatTurn) save(reply string) (Message, error) {
+	assistantMessage := Message{Role: roleAssistant, Content: reply, Tokens: estimateTokens(reply), Citations: t.citations}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		t.conversation.Last_message_at = time.Now()
+		if err := tx.Save(&t.conversation).Error; err != nil {
+			return err
+		}
+		t.userMessage.ConversationID = t.conversation.ConversationID
+		assistantMessage.ConversationID = t.conversation.ConversationID
+		return tx.Create(&[]*Message{&t.userMessage, &assistantMessage}).Error
+	})
+	return assistantMessage, err
+}
+
+// chatbot answers message in a conversation of the authenticated student.
+// Without conversation_id a new conversation is started. With stream set
+// the reply is sent as Server-Sent Events while it is written, see
+// streamChatbot.
+func chatbot(c *gin.Context) {
+	studentID, ok := requireStudent(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Message        string `json:"message"`
+		ConversationID uint   `json:"conversation_id"`
+		Stream         bool   `json:"stream"`
+	}
+
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	req.Message = strings.TrimSpace(req.Message)
+	if req.Message == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "message is required"})
+		return
+	}
+	if !hasMaxLenght(req.Message, maxChatMessage) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "message is too long"})
+		return
+	}
+
+	conversation := Conversation{StudentID: studentID, Title: conversationTitle(req.Message)}
+	if req.ConversationID != 0 {
+		if conversation, ok = findConversation(c, studentID, strconv.FormatUint(uint64(req.ConversationID), 10)); !ok {
+			return
+		}
+	}
+
+	turn := newChatTurn(c.Request.Context(), studentID, conversation, req.Message)
+	if req.Stream {
+		streamChatbot(c, turn)
+		return
+	}
+
+	reply, err := chatLLM.Complete(c.Request.Context(), turn.messages)
+	if err != nil {
+		status, message := llmErrorResponse(err)
+		if retryAfter := asLLMError(err).RetryAfter; retryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		}
+		c.JSON(status, gin.H{"error": message, "code": asLLMError(err).Kind})
+		return
+	}
+
+	assistantMessage, err := turn.save(reply)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save conversation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"conversation":     turn.conversation,
+		"message":          assistantMessage,
+		"context_messages": len(turn.messages),
+	})
+}
+
+func getConversations(c *gin.Context) {
+	studentID, ok := requireStudent(c)
+	if !ok {
+		return
+	}
+
+	var conversations []Conversation
+	db.Where("student_id = ?", studentID).Order("last_message_at DESC").Find(&conversations)
+	c.JSON(http.StatusOK, conversations)
+}
+
+func getConversationByID(c *gin.Context) {
+	studentID, ok := requireStudent(c)
+	if !ok {
+		return
+	}
+
+	conversation, ok := findConversation(c, studentID, c.Param("id"))
+	if !ok {
+		return
+	}
+	db.Where("conversation_id = ?", conversation.ConversationID).Order("message_id").Find(&conversation.Messages)
+	c.JSON(http.StatusOK, conversation)
+}
+
+func renameConversation(c *gin.Context) {
+	studentID, ok := requireStudent(c)
+	if !ok {
+		return
+	}
+
+	conversation, ok := findConversation(c, studentID, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Title string `json:"title"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	input.Title = strings.TrimSpace(input.Title)
+	if input.Title == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "title is required"})
+		return
+	}
+	if utf8.RuneCountInString(input.Title) > maxConversationTitle {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "title is too long"})
+		return
+	}
+
+	db.Model(&conversation).Update("title", input.Title)
+	c.JSON(http.StatusOK, conversation)
+}
+
+func deleteConversation(c *gin.Context) {
+	studentID, ok := requireStudent(c)
+	if !ok {
+		return
+	}
+
+	conversation, ok := findConversation(c, studentID, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("conversation_id = ?", conversation.ConversationID).Delete(&Message{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&conversation).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete conversation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Conversation deleted"})
+}
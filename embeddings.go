@@ -0,0 +1,350 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"gorm.io/gorm"
+)
+
+// embedder turns texts into vectors whose cosine similarity reflects how
+// related the texts are. Vectors from different embedders, or the same one
+// under another Name, are not comparable.
+type embedder interface {
+	Name() string
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// vectorStore keeps the embedded chunks of course content. Each source, a
+// subject or a learning material, is replaced as a whole when it changes.
+type vectorStore interface {
+	Replace(ctx context.Context, source chunkSource, chunks []Content_Chunk) error
+	Delete(ctx context.Context, source chunkSource) error
+	// Indexed returns the hash each indexed source was embedded from.
+	Indexed(ctx context.Context) (map[chunkSource]string, error)
+	// Search returns the chunks of subjectIDs most similar to vector, best
+	// first.
+	Search(ctx context.Context, vector []float32, subjectIDs []uint, limit int) ([]chunkMatch, error)
+}
+
+var (
+	contentEmbedder embedder
+	contentVectors  vectorStore
+)
+
+type chunkSource struct {
+	Type string
+	ID   uint
+}
+
+// Content_Chunk is a passage of a subject description or learning
+// material with its embedding.
+type Content_Chunk struct {
+	gorm.Model
+	ContentchunkID     uint   `gorm:"column:content_chunk_id;primaryKey;autoIncrement;unique" json:"content_chunk_id"`
+	Source_type        string `gorm:"index:idx_content_chunk_source" json:"source_type"`
+	Source_id          uint   `gorm:"index:idx_content_chunk_source" json:"source_id"`
+	SubjectID          uint   `gorm:"index" json:"subject_id"`
+	LearningmaterialID uint   `json:"learning_material_id"`
+	Chunk              int    `json:"chunk"`
+	Title              string `json:"title"`
+	Content            string `json:"content"`
+	Source_hash        string `json:"-"`
+	Embedding          []byte `json:"-"`
+}
+
+// embeddingTimeout limits one call to a remote embedder.
+const embeddingTimeout = 30 * time.Second
+
+type chunkMatch struct {
+	Content_Chunk
+	Score float64
+}
+
+// newEmbedderFromEnv picks the embedder from EMBEDDER: "hash" (the
+// default) needs no service, "openai" calls an OpenAI-compatible embeddings
+// API at EMBEDDING_URL with EMBEDDING_API_KEY and EMBEDDING_MODEL.
+func newEmbedderFromEnv() (embedder, error) {
+	switch name := os.Getenv("EMBEDDER"); name {
+	case "", "hash":
+		return hashEmbedder{dimensions: 512}, nil
+	case "openai":
+		remote := openAIEmbedder{
+			url:   os.Getenv("EMBEDDING_URL"),
+			model: os.Getenv("EMBEDDING_MODEL"),
+		}
+		if remote.url == "" {
+			remote.url = "https://api.openai.com/v1/embeddings"
+		}
+		if remote.model == "" {
+			return nil, errors.New("EMBEDDING_MODEL is required for the openai embedder")
+		}
+		remote.client = resty.New().
+			SetTimeout(embeddingTimeout).
+			SetHeader("Content-Type", "application/json").
+			SetAuthToken(os.Getenv("EMBEDDING_API_KEY"))
+		return remote, nil
+	default:
+		return nil, fmt.Errorf("unknown EMBEDDER %q", name)
+	}
+}
+
+// stopWords are left out of hashed embeddings since they say nothing
+// about what a text is about.
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "by": true,
+	"can": true, "do": true, "does": true, "for": true, "from": true, "how": true, "i": true, "in": true,
+	"is": true, "it": true, "of": true, "on": true, "or": true, "that": true, "the": true, "this": true,
+	"to": true, "was": true, "what": true, "when": true, "which": true, "why": true, "with": true, "you": true,
+}
+
+// hashEmbedder is a deterministic embedder that needs no model: words and
+// pairs of words are hashed into a fixed number of dimensions. It finds
+// passages sharing words with the question, which is enough for tests and
+// small deployments.
+type hashEmbedder struct {
+	dimensions int
+}
+
+func (e hashEmbedder) Name() string { return fmt.Sprintf("hash-%d", e.dimensions) }
+
+func (e hashEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		var words []string
+		for _, word := range searchTerms(text) {
+			if !stopWords[word] {
+				words = append(words, stem(word))
+			}
+		}
+
+		counts := map[string]float64{}
+		for j, word := range words {
+			counts[word]++
+			if j > 0 {
+				counts[words[j-1]+" "+word] += 0.5
+			}
+		}
+
+		vector := make([]float32, e.dimensions)
+		for feature, count := range counts {
+			h := fnv.New64a()
+			h.Write([]byte(feature))
+			sum := h.Sum64()
+			weight := float32(1 + math.Log(count))
+			if sum>>63 == 1 {
+				weight = -weight
+			}
+			vector[sum%uint64(e.dimensions)] += weight
+		}
+		vectors[i] = normalize(vector)
+	}
+	return vectors, nil
+}
+
+// stem strips common English suffixes so "blocks" and "blocking" match
+// "block". It is crude, but the same on both sides of a comparison.
+func stem(word string) string {
+	switch {
+	case len(word) > 5 && strings.HasSuffix(word, "ing"):
+		return word[:len(word)-3]
+	case len(word) > 4 && strings.HasSuffix(word, "ed"):
+		return word[:len(word)-2]
+	case len(word) > 3 && strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss"):
+		return word[:len(word)-1]
+	}
+	return word
+}
+
+// openAIEmbedder calls an OpenAI-compatible /embeddings endpoint. client
+// is shared by all calls and times out after embeddingTimeout.
+type openAIEmbedder struct {
+	url    string
+	model  string
+	client *resty.Client
+}
+
+func (e openAIEmbedder) Name() string { return "openai-" + e.model }
+
+func (e openAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	var result struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+
+	resp, err := e.client.R().
+		SetContext(ctx).
+		SetBody(map[string]interface{}{"model": e.model, "input": texts}).
+		Post(e.url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, errors.New("embedding failed: " + resp.Status())
+	}
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) != len(texts) {
+		return nil, fmt.Errorf("embedding returned %d vectors for %d texts", len(result.Data), len(texts))
+	}
+
+	vectors := make([][]float32, len(texts))
+	for _, item := range result.Data {
+		if item.Index < 0 || item.Index >= len(texts) {
+			return nil, fmt.Errorf("embedding returned index %d out of range", item.Index)
+		}
+		vectors[item.Index] = normalize(item.Embedding)
+	}
+	return vectors, nil
+}
+
+func normalize(vector []float32) []float32 {
+	var norm float64
+	for _, v := range vector {
+		norm += float64(v) * float64(v)
+	}
+	if norm == 0 {
+		return vector
+	}
+	scale := float32(1 / math.Sqrt(norm))
+	for i := range vector {
+		vector[i] *= scale
+	}
+	return vector
+}
+
+func encodeVector(vector []float32) []byte {
+	buf := make([]byte, 4*len(vector))
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(v))
+	}
+	return buf
+}
+
+func decodeVector(buf []byte) []float32 {
+	vector := make([]float32, len(buf)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+	}
+	return vector
+}
+
+// dot is the cosine similarity of two normalized vectors.
+func dot(a []float32, b []float32) float64 {
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
+
+// databaseVectorStore keeps chunks in the content_chunks table and searches
+// them by brute force, which is fast enough for a few thousand chunks and
+// works on every database.
+type databaseVectorStore struct{}
+
+func (databaseVectorStore) Replace(ctx context.Context, source chunkSource, chunks []Content_Chunk) error {
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("source_type = ? AND source_id = ?", source.Type, source.ID).Delete(&Content_Chunk{}).Error; err != nil {
+			return err
+		}
+		if len(chunks) == 0 {
+			return nil
+		}
+		return tx.Create(&chunks).Error
+	})
+}
+
+func (databaseVectorStore) Delete(ctx context.Context, source chunkSource) error {
+	return db.WithContext(ctx).Unscoped().Where("source_type = ? AND source_id = ?", source.Type, source.ID).Delete(&Content_Chunk{}).Error
+}
+
+func (databaseVectorStore) Indexed(ctx context.Context) (map[chunkSource]string, error) {
+	var rows []struct {
+		Source_type string
+		Source_id   uint
+		Source_hash string
+	}
+	err := db.WithContext(ctx).Model(&Content_Chunk{}).Distinct("source_type", "source_id", "source_hash").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	indexed := make(map[chunkSource]string, len(rows))
+	for _, row := range rows {
+		indexed[chunkSource{Type: row.Source_type, ID: row.Source_id}] = row.Source_hash
+	}
+	return indexed, nil
+}
+
+// matchHeap keeps the best matches seen so far with the worst on top.
+type matchHeap []chunkMatch
+
+func (h matchHeap) Len() int           { return len(h) }
+func (h matchHeap) Less(i, j int) bool { return h[i].Score < h[j].Score }
+func (h matchHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *matchHeap) Push(x any)        { *h = append(*h, x.(chunkMatch)) }
+func (h *matchHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// collect scores chunks against vector and keeps the limit best of them and
+// of what the heap held before. Chunks embedded with another number of
+// dimensions, by a previous embedder, are skipped.
+func (h *matchHeap) collect(vector []float32, chunks []Content_Chunk, limit int) {
+	for _, chunk := range chunks {
+		embedding := decodeVector(chunk.Embedding)
+		if len(embedding) != len(vector) {
+			continue
+		}
+		match := chunkMatch{Content_Chunk: chunk, Score: dot(vector, embedding)}
+		match.Embedding = nil
+		if h.Len() < limit {
+			heap.Push(h, match)
+		} else if match.Score > (*h)[0].Score {
+			(*h)[0] = match
+			heap.Fix(h, 0)
+		}
+	}
+}
+
+// sorted returns the kept matches best first.
+func (h matchHeap) sorted() []chunkMatch {
+	matches := []chunkMatch(h)
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	return matches
+}
+
+func (databaseVectorStore) Search(ctx context.Context, vector []float32, subjectIDs []uint, limit int) ([]chunkMatch, error) {
+	if len(subjectIDs) == 0 || limit <= 0 {
+		return []chunkMatch{}, nil
+	}
+
+	best := &matchHeap{}
+	var batch []Content_Chunk
+	err := db.WithContext(ctx).Where("subject_id IN ?", subjectIDs).FindInBatches(&batch, exportBatchSize, func(tx *gorm.DB, _ int) error {
+		best.collect(vector, batch, limit)
+		return nil
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	return best.sorted(), nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+)
+
+// memoryVectorStore is a vectorStore kept in memory for tests. Search ranks
+// with the same matchHeap as databaseVectorStore and records the subjects
+// it was asked for.
+type memoryVectorStore struct {
+	mu       sync.Mutex
+	chunks   map[chunkSource][]Content_Chunk
+	searched [][]uint
+}
+
+func newMemoryVectorStore() *memoryVectorStore {
+	return &memoryVectorStore{chunks: map[chunkSource][]Content_Chunk{}}
+}
+
+func (s *memoryVectorStore) Replace(ctx context.Context, source chunkSource, chunks []Content_Chunk) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(chunks) == 0 {
+		delete(s.chunks, source)
+		return nil
+	}
+	s.chunks[source] = append([]Content_Chunk(nil), chunks...)
+	return nil
+}
+
+func (s *memoryVectorStore) Delete(ctx context.Context, source chunkSource) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.chunks, source)
+	return nil
+}
+
+func (s *memoryVectorStore) Indexed(ctx context.Context) (map[chunkSource]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	indexed := make(map[chunkSource]string, len(s.chunks))
+	for source, chunks := range s.chunks {
+		indexed[source] = chunks[0].Source_hash
+	}
+	return indexed, nil
+}
+
+func (s *memoryVectorStore) Search(ctx context.Context, vector []float32, subjectIDs []uint, limit int) ([]chunkMatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.searched = append(s.searched, subjectIDs)
+
+	subjects := map[uint]bool{}
+	for _, id := range subjectIDs {
+		subjects[id] = true
+	}
+	best := &matchHeap{}
+	for _, chunks := range s.chunks {
+		for _, chunk := range chunks {
+			if subjects[chunk.SubjectID] {
+				best.collect(vector, []Content_Chunk{chunk}, limit)
+			}
+		}
+	}
+	return best.sorted(), nil
+}
+
+func embedOne(t *testing.T, e embedder, text string) []float32 {
+	t.Helper()
+	vectors, err := e.Embed(context.Background(), []string{text})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vectors[0]
+}
+
+func TestHashEmbedder(t *testing.T) {
+	e := hashEmbedder{dimensions: 256}
+
+	first := embedOne(t, e, "Channels block until the receiver is ready")
+	second := embedOne(t, e, "Channels block until the receiver is ready")
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("embedding differs at %d: %v != %v", i, first[i], second[i])
+		}
+	}
+	if length := math.Sqrt(dot(first, first)); math.Abs(length-1) > 1e-6 {
+		t.Errorf("embedding length = %v, want 1", length)
+	}
+
+	related := dot(embedOne(t, e, "blocking on a channel"), embedOne(t, e, "a channel blocks"))
+	unrelated := dot(embedOne(t, e, "blocking on a channel"), embedOne(t, e, "styling html forms"))
+	if related <= unrelated {
+		t.Errorf("related score %v is not above unrelated score %v", related, unrelated)
+	}
+
+	if empty := embedOne(t, e, "the and of"); dot(empty, empty) != 0 {
+		t.Errorf("stop words alone should embed to the zero vector, got %v", empty)
+	}
+}
+
+func TestEncodeVector(t *testing.T) {
+	vector := []float32{0, 1, -0.5, 3.25}
+	decoded := decodeVector(encodeVector(vector))
+	if len(decoded) != len(vector) {
+		t.Fatalf("decoded %d values, want %d", len(decoded), len(vector))
+	}
+	for i := range vector {
+		if decoded[i] != vector[i] {
+			t.Errorf("value %d = %v, want %v", i, decoded[i], vector[i])
+		}
+	}
+}
+
+// scoredChunk is a chunk that scores score against the vector {1, 0}.
+func scoredChunk(id uint, score float32) Content_Chunk {
+	return Content_Chunk{Source_type: chunkSourceMaterial, Source_id: id, Embedding: encodeVector([]float32{score, 1 - score})}
+}
+
+func TestMatchHeapKeepsBestAcrossBatches(t *testing.T) {
+	vector := []float32{1, 0}
+	best := &matchHeap{}
+
+	// databaseVectorStore.Search collects one batch at a time.
+	best.collect(vector, []Content_Chunk{scoredChunk(1, 0.2), scoredChunk(2, 0.9), scoredChunk(3, 0.5)}, 3)
+	best.collect(vector, []Content_Chunk{scoredChunk(4, 0.7), scoredChunk(5, 0.1), scoredChunk(6, 0.6)}, 3)
+
+	matches := best.sorted()
+	want := []uint{2, 4, 6}
+	if len(matches) != len(want) {
+		t.Fatalf("kept %d matches, want %d", len(matches), len(want))
+	}
+	for i, match := range matches {
+		if match.Source_id != want[i] {
+			t.Errorf("match %d = chunk %d with score %v, want chunk %d", i, match.Source_id, match.Score, want[i])
+		}
+		if match.Embedding != nil {
+			t.Errorf("match %d still carries its embedding", i)
+		}
+	}
+}
+
+func TestMatchHeapSkipsOtherDimensions(t *testing.T) {
+	best := &matchHeap{}
+	old := Content_Chunk{Source_id: 1, Embedding: encodeVector([]float32{1, 0, 0})}
+	best.collect([]float32{1, 0}, []Content_Chunk{old, scoredChunk(2, 0.3)}, 5)
+
+	matches := best.sorted()
+	if len(matches) != 1 || matches[0].Source_id != 2 {
+		t.Errorf("matches = %v, want only chunk 2", matches)
+	}
+}
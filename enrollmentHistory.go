@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// A student may drop the same subject this many times before rejoining it
+// needs an instructor override.
+const maxEnrollmentDrops = 3
+
+const (
+	enrollmentEventJoined    = "joined"
+	enrollmentEventRejoined  = "rejoined"
+	enrollmentEventDropped   = "dropped"
+	enrollmentEventCompleted = "completed"
+)
+
+// Subject_Joined_Event is the history of a student's enrollments. Rows are
+// only ever added.
+type Subject_Joined_Event struct {
+	gorm.Model
+	SubjectjoinedeventID uint      `gorm:"column:subject_joined_event_id;primaryKey;autoIncrement;unique" json:"subject_joined_event_id"`
+	SubjectjoinedID      uint      `json:"subject_joined_id"`
+	StudentID            uint      `gorm:"index" json:"student_id"`
+	SubjectID            uint      `json:"subject_id"`
+	Subject              Subject   `gorm:"references:SubjectID"`
+	Event                string    `json:"event"`
+	Reason               string    `json:"reason"`
+	Occurred_at          time.Time `json:"occurred_at"`
+}
+
+func isActiveEnrollment(status string) bool {
+	return status == enrollmentEnrolled || status == enrollmentInProgress
+}
+
+func recordEnrollmentEvent(tx *gorm.DB, enrollment Subject_Joined, event string, reason string) error {
+	return tx.Create(&Subject_Joined_Event{
+		SubjectjoinedID: enrollment.SubjectjoinedID,
+		StudentID:       enrollment.StudentID,
+		SubjectID:       enrollment.SubjectID,
+		Event:           event,
+		Reason:          reason,
+		Occurred_at:     time.Now(),
+	}).Error
+}
+
+// reenrollmentConflict applies the re-enrollment rules to the student's
+// earlier enrollments in a subject: there can be only one active
+// enrollment, and a completed subject cannot be joined again. It returns
+// the number of drops so far, and a status and response when joining is
+// not allowed.
+func reenrollmentConflict(previous []Subject_Joined) (int, int, gin.H) {
+	drops := 0
+	for _, enrollment := range previous {
+		switch {
+		case isActiveEnrollment(enrollment.Status):
+			return drops, http.StatusConflict, gin.H{"error": "Student is already enrolled in this subject", "subject_joined": enrollment}
+		case enrollment.Status == enrollmentCompleted:
+			return drops, http.StatusConflict, gin.H{"error": "Student has already completed this subject", "subject_joined": enrollment}
+		case enrollment.Status == enrollmentDropped:
+			drops++
+		}
+	}
+	return drops, 0, nil
+}
+
+// migrateEnrollmentHistory backfills join events for enrollments made before
+// history was kept, drops all but the latest of duplicate active enrollments
+// and then enforces one active enrollment per student and subject.
+func migrateEnrollmentHistory() {
+	joins := db.Model(&Subject_Joined_Event{}).Select("subjectjoined_id").Where("event IN ?", []string{enrollmentEventJoined, enrollmentEventRejoined})
+	var unrecorded []Subject_Joined
+	db.Where("subject_joined_id NOT IN (?)", joins).Find(&unrecorded)
+	for _, enrollment := range unrecorded {
+		db.Create(&Subject_Joined_Event{
+			SubjectjoinedID: enrollment.SubjectjoinedID,
+			StudentID:       enrollment.StudentID,
+			SubjectID:       enrollment.SubjectID,
+			Event:           enrollmentEventJoined,
+			Occurred_at:     enrollment.Date_joined,
+		})
+	}
+
+	var enrollments []Subject_Joined
+	db.Where("status IN ?", []string{enrollmentEnrolled, enrollmentInProgress}).Order("date_joined DESC").Find(&enrollments)
+
+	type key struct{ student, subject uint }
+	seen := map[key]bool{}
+	now := time.Now()
+	for _, enrollment := range enrollments {
+		k := key{enrollment.StudentID, enrollment.SubjectID}
+		if !seen[k] {
+			seen[k] = true
+			continue
+		}
+		db.Model(&enrollment).Updates(map[string]interface{}{"status": enrollmentDropped, "dropped_at": now, "drop_reason": "Duplicate enrollment"})
+		recordEnrollmentEvent(db, enrollment, enrollmentEventDropped, "Duplicate enrollment")
+	}
+
+	db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_subject_joined_active ON subject_joineds (student_id, subject_id)
+		WHERE status IN ('enrolled', 'in_progress') AND deleted_at IS NULL`)
+}
+
+// dropSubjectJoined ends an active enrollment. The row is kept with status
+// dropped so the history stays complete, and the freed seat goes to the
+// next student on the waitlist.
+func dropSubjectJoined(c *gin.Context) {
+	var enrollment Subject_Joined
+	if err := db.First(&enrollment, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subject Joined not found"})
+		return
+	}
+
+	var input struct {
+		Reason string `json:"reason"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	input.Reason = strings.TrimSpace(input.Reason)
+	if input.Reason == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A reason is required to drop a subject"})
+		return
+	}
+
+	if !isActiveEnrollment(enrollment.Status) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Enrollment is already %s", enrollment.Status)})
+		return
+	}
+
+	now := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Subject_Joined{}).
+			Where("subject_joined_id = ? AND status IN ?", enrollment.SubjectjoinedID, []string{enrollmentEnrolled, enrollmentInProgress}).
+			Updates(map[string]interface{}{"status": enrollmentDropped, "dropped_at": now, "drop_reason": input.Reason})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		if err := recordEnrollmentEvent(tx, enrollment, enrollmentEventDropped, input.Reason); err != nil {
+			return err
+		}
+		_, err := promoteWaitlist(tx, enrollment.SubjectID)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Enrollment is no longer active"})
+		return
+	}
+
+	enrollment.Status, enrollment.Dropped_at, enrollment.Drop_reason = enrollmentDropped, &now, input.Reason
+	c.JSON(http.StatusOK, enrollment)
+}
+
+func getEnrollmentHistoryByStudentID(c *gin.Context) {
+	var student Student
+	if err := db.First(&student, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Student not found"})
+		return
+	}
+
+	var events []Subject_Joined_Event
+	db.Preload("Subject").Where("student_id = ?", student.StudentID).Order("occurred_at, subject_joined_event_id").Find(&events)
+	c.JSON(http.StatusOK, events)
+}
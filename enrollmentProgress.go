@@ -0,0 +1,338 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// An enrollment starts as enrolled, becomes in_progress once the student
+// views a material or takes the quiz, and completed once every material is
+// viewed and the quiz is passed. Completed and dropped are final; progress
+// is not recalculated for them.
+const (
+	enrollmentEnrolled   = "enrolled"
+	enrollmentInProgress = "in_progress"
+	enrollmentCompleted  = "completed"
+	enrollmentDropped    = "dropped"
+)
+
+type Learning_Material_View struct {
+	gorm.Model
+	LearningmaterialviewID uint      `gorm:"column:learning_material_view_id;primaryKey;autoIncrement;unique" json:"learning_material_view_id"`
+	StudentID              uint      `gorm:"uniqueIndex:idx_learning_material_view" json:"student_id"`
+	LearningmaterialID     uint      `gorm:"uniqueIndex:idx_learning_material_view" json:"learning_material_id"`
+	Viewed_at              time.Time `json:"viewed_at"`
+}
+
+// subjectProgress is how far a student is through one subject. The quiz
+// counts as one unit next to each material, and only when the subject has
+// quiz questions.
+type subjectProgress struct {
+	SubjectjoinedID  uint       `json:"subject_joined_id"`
+	SubjectID        uint       `json:"subject_id"`
+	Subject_name     string     `json:"subject_name"`
+	InterestID       uint       `json:"interest_id"`
+	Status           string     `json:"status"`
+	Progress         int        `json:"progress"`
+	Materials_viewed int        `json:"materials_viewed"`
+	Materials_total  int        `json:"materials_total"`
+	Has_quiz         bool       `json:"has_quiz"`
+	Quiz_passed      bool       `json:"quiz_passed"`
+	Completed_at     *time.Time `json:"completed_at"`
+}
+
+func isFinalEnrollmentStatus(status string) bool {
+	return status == enrollmentCompleted || status == enrollmentDropped
+}
+
+// measureProgress counts what the student has done in a subject.
+func measureProgress(tx *gorm.DB, studentID uint, subjectID uint) subjectProgress {
+	progress := subjectProgress{SubjectID: subjectID}
+
+	// Draft lessons do not count until they are published.
+	var materials int64
+	tx.Model(&Learning_Material{}).Scopes(publishedMaterials).Where("subject_id = ?", subjectID).Count(&materials)
+	progress.Materials_total = int(materials)
+
+	var viewed int64
+	published := tx.Model(&Learning_Material{}).Scopes(publishedMaterials).Select("learning_material_id").Where("subject_id = ?", subjectID)
+	tx.Model(&Learning_Material_View{}).
+		Where("student_id = ? AND learningmaterial_id IN (?)", studentID, published).
+		Count(&viewed)
+	progress.Materials_viewed = int(viewed)
+
+	var quizzes int64
+	tx.Model(&Quiz{}).Where("subject_id = ?", subjectID).Count(&quizzes)
+	progress.Has_quiz = quizzes > 0
+
+	var best struct{ Score *int }
+	tx.Model(&Quiz_Result{}).Select("MAX(score) AS score").Where("student_id = ? AND subject_id = ?", studentID, subjectID).Scan(&best)
+	progress.Quiz_passed = best.Score != nil && *best.Score >= quizPolicyFor(subjectID).Passing_score
+
+	units, done := progress.Materials_total, progress.Materials_viewed
+	if progress.Has_quiz {
+		units++
+		if progress.Quiz_passed {
+			done++
+		}
+	}
+	if units > 0 {
+		progress.Progress = int(math.Round(100 * float64(done) / float64(units)))
+	}
+	return progress
+}
+
+// currentEnrollment returns the enrollment with the status and progress it
+// has from what the student has done so far, without saving anything.
+func currentEnrollment(tx *gorm.DB, enrollment Subject_Joined) Subject_Joined {
+	if isFinalEnrollmentStatus(enrollment.Status) {
+		return enrollment
+	}
+
+	progress := measureProgress(tx, enrollment.StudentID, enrollment.SubjectID)
+
+	var attempts int64
+	tx.Model(&Quiz_Attempt{}).Where("student_id = ? AND subject_id = ?", enrollment.StudentID, enrollment.SubjectID).Count(&attempts)
+
+	status := enrollmentEnrolled
+	switch {
+	case progress.Progress == 100:
+		status = enrollmentCompleted
+		now := time.Now()
+		enrollment.Completed_at = &now
+	case progress.Materials_viewed > 0 || progress.Quiz_passed || attempts > 0:
+		status = enrollmentInProgress
+	}
+	enrollment.Status, enrollment.Progress = status, progress.Progress
+	return enrollment
+}
+
+// refreshEnrollment moves an enrollment along the state machine from what
+// the student has done so far.
+func refreshEnrollment(tx *gorm.DB, enrollment *Subject_Joined) error {
+	current := currentEnrollment(tx, *enrollment)
+	if current.Status == enrollment.Status && current.Progress == enrollment.Progress {
+		return nil
+	}
+	*enrollment = current
+	err := tx.Model(enrollment).Updates(map[string]interface{}{
+		"status":       enrollment.Status,
+		"progress":     enrollment.Progress,
+		"completed_at": enrollment.Completed_at,
+	}).Error
+	if err != nil || enrollment.Status != enrollmentCompleted {
+		return err
+	}
+	if err := recordEnrollmentEvent(tx, *enrollment, enrollmentEventCompleted, ""); err != nil {
+		return err
+	}
+	// A completed student no longer takes up a seat.
+	_, err = promoteWaitlist(tx, enrollment.SubjectID)
+	return err
+}
+
+// refreshStudentSubject refreshes the student's open enrollments in a
+// subject after something that counts towards progress happened.
+func refreshStudentSubject(tx *gorm.DB, studentID uint, subjectID uint) error {
+	var enrollments []Subject_Joined
+	tx.Where("student_id = ? AND subject_id = ? AND status NOT IN ?", studentID, subjectID, []string{enrollmentCompleted, enrollmentDropped}).Find(&enrollments)
+	for i := range enrollments {
+		if err := refreshEnrollment(tx, &enrollments[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshSubjectEnrollments refreshes every open enrollment in a subject
+// after its published lessons changed.
+func refreshSubjectEnrollments(tx *gorm.DB, subjectID uint) error {
+	var enrollments []Subject_Joined
+	tx.Where("subject_id = ? AND status NOT IN ?", subjectID, []string{enrollmentCompleted, enrollmentDropped}).Find(&enrollments)
+	for i := range enrollments {
+		if err := refreshEnrollment(tx, &enrollments[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateEnrollments gives enrollments made before the state machine
+// existed a status and their current progress.
+func migrateEnrollments() {
+	db.Model(&Subject_Joined{}).Where("status IS NULL OR status = ''").Update("status", enrollmentEnrolled)
+
+	var enrollments []Subject_Joined
+	db.Where("status IN ? AND (progress IS NULL OR progress = 0)", []string{enrollmentEnrolled, enrollmentInProgress}).Find(&enrollments)
+	for i := range enrollments {
+		if err := db.Transaction(func(tx *gorm.DB) error { return refreshEnrollment(tx, &enrollments[i]) }); err != nil {
+			log.Printf("enrollment %d: %v", enrollments[i].SubjectjoinedID, err)
+		}
+	}
+}
+
+func viewLearningMaterial(c *gin.Context) {
+	var material Learning_Material
+	if err := db.First(&material, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Learning Material not found"})
+		return
+	}
+
+	var input struct {
+		StudentID uint `json:"student_id"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var student Student
+	if err := db.First(&student, input.StudentID).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Student with that ID not found"})
+		return
+	}
+
+	var published int64
+	db.Model(&Learning_Material{}).Scopes(publishedMaterials).Where("learning_material_id = ?", material.LearningmaterialID).Count(&published)
+	if published == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Learning Material is not published"})
+		return
+	}
+
+	// Viewing the same material again keeps the first view.
+	view := Learning_Material_View{StudentID: student.StudentID, LearningmaterialID: material.LearningmaterialID, Viewed_at: time.Now()}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		tx.Where("student_id = ? AND learningmaterial_id = ?", view.StudentID, view.LearningmaterialID).Limit(1).Find(&view)
+		if view.LearningmaterialviewID == 0 {
+			if err := tx.Create(&view).Error; err != nil {
+				return err
+			}
+		}
+		return refreshStudentSubject(tx, student.StudentID, material.SubjectID)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record view"})
+		return
+	}
+
+	c.JSON(http.StatusOK, view)
+}
+
+// getStudentProgress returns the student's progress in every subject they
+// joined and, per interest, the average progress over all of the
+// interest's subjects, counting subjects they have not joined as 0.
+func getStudentProgress(c *gin.Context) {
+	var student Student
+	if err := db.First(&student, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Student not found"})
+		return
+	}
+
+	var enrollments []Subject_Joined
+	db.Preload("Subject").Where("student_id = ?", student.StudentID).Order("date_joined").Find(&enrollments)
+
+	// Progress is measured afresh but only saved by the events that change
+	// it. A later enrollment in the same subject replaces an earlier one.
+	latest := map[uint]subjectProgress{}
+	var order []uint
+	for _, enrollment := range enrollments {
+		enrollment = currentEnrollment(db, enrollment)
+
+		progress := measureProgress(db, student.StudentID, enrollment.SubjectID)
+		progress.SubjectjoinedID = enrollment.SubjectjoinedID
+		progress.Subject_name = enrollment.Subject.Subject_name
+		progress.InterestID = enrollment.Subject.InterestID
+		progress.Status = enrollment.Status
+		progress.Progress = enrollment.Progress
+		progress.Completed_at = enrollment.Completed_at
+		if _, ok := latest[enrollment.SubjectID]; !ok {
+			order = append(order, enrollment.SubjectID)
+		}
+		latest[enrollment.SubjectID] = progress
+	}
+
+	subjects := []subjectProgress{}
+	interestIDs := map[uint]bool{}
+	for _, id := range order {
+		subjects = append(subjects, latest[id])
+		interestIDs[latest[id].InterestID] = true
+	}
+
+	interests := []gin.H{}
+	for interestID := range interestIDs {
+		var interest Interest
+		db.First(&interest, interestID)
+
+		var interestSubjects []Subject
+		db.Where("interest_id = ?", interestID).Find(&interestSubjects)
+
+		total, completed := 0, 0
+		for _, subject := range interestSubjects {
+			if progress, ok := latest[subject.SubjectID]; ok && progress.Status != enrollmentDropped {
+				total += progress.Progress
+				if progress.Status == enrollmentCompleted {
+					completed++
+				}
+			}
+		}
+
+		percent := 0
+		if len(interestSubjects) > 0 {
+			percent = int(math.Round(float64(total) / float64(len(interestSubjects))))
+		}
+		interests = append(interests, gin.H{
+			"interest_id":        interestID,
+			"interest_name":      interest.Interest_name,
+			"progress":           percent,
+			"subjects_completed": completed,
+			"subjects_total":     len(interestSubjects),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"student_id": student.StudentID, "subjects": subjects, "interests": interests})
+}
+
+// getSubjectProgress summarises all enrollments of a subject for
+// instructor dashboards.
+func getSubjectProgress(c *gin.Context) {
+	var subject Subject
+	if err := db.First(&subject, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subject not found"})
+		return
+	}
+
+	var enrollments []Subject_Joined
+	db.Where("subject_id = ?", subject.SubjectID).Find(&enrollments)
+	for i := range enrollments {
+		enrollments[i] = currentEnrollment(db, enrollments[i])
+	}
+
+	statuses := map[string]int{enrollmentEnrolled: 0, enrollmentInProgress: 0, enrollmentCompleted: 0, enrollmentDropped: 0}
+	total, active := 0, 0
+	for _, enrollment := range enrollments {
+		statuses[enrollment.Status]++
+		if enrollment.Status != enrollmentDropped {
+			total += enrollment.Progress
+			active++
+		}
+	}
+
+	average := 0
+	if active > 0 {
+		average = int(math.Round(float64(total) / float64(active)))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"subject_id":       subject.SubjectID,
+		"subject_name":     subject.Subject_name,
+		"enrollments":      len(enrollments),
+		"statuses":         statuses,
+		"average_progress": average,
+	})
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	waitlistWaiting   = "waiting"
+	waitlistPromoted  = "promoted"
+	waitlistCancelled = "cancelled"
+)
+
+// Subject_Waitlist is a student queued for a full subject. Entries are
+// promoted first come, first served; the override given when joining is
+// carried over to the enrollment.
+type Subject_Waitlist struct {
+	gorm.Model
+	SubjectwaitlistID        uint       `gorm:"column:subject_waitlist_id;primaryKey;autoIncrement;unique" json:"subject_waitlist_id"`
+	StudentID                uint       `gorm:"index" json:"student_id"`
+	Student                  Student    `gorm:"references:StudentID"`
+	SubjectID                uint       `gorm:"index" json:"subject_id"`
+	Requested_at             time.Time  `json:"requested_at"`
+	Status                   string     `json:"status"`
+	Override_reason          string     `json:"override_reason"`
+	Overridden_by            string     `json:"overridden_by"`
+	Overridden_prerequisites string     `json:"overridden_prerequisites"`
+	SubjectjoinedID          uint       `json:"subject_joined_id"`
+	Promoted_at              *time.Time `json:"promoted_at"`
+	Cancelled_at             *time.Time `json:"cancelled_at"`
+	Cancel_reason            string     `json:"cancel_reason"`
+	Position                 int        `gorm:"-" json:"position"`
+}
+
+// validateEnrollmentSettings checks the capacity and enrollment window of a
+// subject.
+func validateEnrollmentSettings(subject Subject) string {
+	if subject.Capacity < 0 {
+		return "capacity must be 0 (unlimited) or more"
+	}
+	if subject.Enrollment_opens_at != nil && subject.Enrollment_closes_at != nil && !subject.Enrollment_closes_at.After(*subject.Enrollment_opens_at) {
+		return "enrollment_closes_at must be after enrollment_opens_at"
+	}
+	return ""
+}
+
+// enrollmentWindowError says why the subject cannot be joined at now, or
+// returns "" when its enrollment window is open.
+func enrollmentWindowError(subject Subject, now time.Time) string {
+	if subject.Enrollment_opens_at != nil && now.Before(*subject.Enrollment_opens_at) {
+		return "Enrollment opens at " + subject.Enrollment_opens_at.Format(time.RFC3339)
+	}
+	if subject.Enrollment_closes_at != nil && !now.Before(*subject.Enrollment_closes_at) {
+		return "Enrollment closed at " + subject.Enrollment_closes_at.Format(time.RFC3339)
+	}
+	return ""
+}
+
+func activeEnrollmentCount(tx *gorm.DB, subjectID uint) int {
+	var count int64
+	tx.Model(&Subject_Joined{}).Where("subject_id = ? AND status IN ?", subjectID, []string{enrollmentEnrolled, enrollmentInProgress}).Count(&count)
+	return int(count)
+}
+
+func waitingCount(tx *gorm.DB, subjectID uint) int {
+	var count int64
+	tx.Model(&Subject_Waitlist{}).Where("subject_id = ? AND status = ?", subjectID, waitlistWaiting).Count(&count)
+	return int(count)
+}
+
+// lockSubject reloads the subject with its row locked so seats are counted
+// and taken by one request at a time.
+func lockSubject(tx *gorm.DB, subject *Subject) error {
+	return tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(subject, subject.SubjectID).Error
+}
+
+// waitlistPosition is the 1-based place of a waiting entry in its queue.
+func waitlistPosition(tx *gorm.DB, entry Subject_Waitlist) int {
+	var ahead int64
+	tx.Model(&Subject_Waitlist{}).
+		Where("subject_id = ? AND status = ?", entry.SubjectID, waitlistWaiting).
+		Where("requested_at < ? OR (requested_at = ? AND subject_waitlist_id < ?)", entry.Requested_at, entry.Requested_at, entry.SubjectwaitlistID).
+		Count(&ahead)
+	return int(ahead) + 1
+}
+
+// enrollStudent creates an enrollment and records it in the history.
+func enrollStudent(tx *gorm.DB, enrollment *Subject_Joined, rejoining bool) error {
+	event := enrollmentEventJoined
+	if rejoining {
+		event = enrollmentEventRejoined
+	}
+
+	enrollment.Status, enrollment.Progress, enrollment.Completed_at = enrollmentEnrolled, 0, nil
+	enrollment.Dropped_at, enrollment.Drop_reason = nil, ""
+	if err := tx.Create(enrollment).Error; err != nil {
+		return err
+	}
+	if err := recordEnrollmentEvent(tx, *enrollment, event, enrollment.Override_reason); err != nil {
+		return err
+	}
+	return refreshEnrollment(tx, enrollment)
+}
+
+// promoteWaitlist fills the free seats of a subject from its waitlist in
+// order and returns the promoted entries.
+func promoteWaitlist(tx *gorm.DB, subjectID uint) ([]Subject_Waitlist, error) {
+	subject := Subject{SubjectID: subjectID}
+	if err := lockSubject(tx, &subject); err != nil {
+		return nil, err
+	}
+
+	promoted := []Subject_Waitlist{}
+	for subject.Capacity == 0 || activeEnrollmentCount(tx, subject.SubjectID) < subject.Capacity {
+		var entry Subject_Waitlist
+		tx.Where("subject_id = ? AND status = ?", subject.SubjectID, waitlistWaiting).Order("requested_at, subject_waitlist_id").Limit(1).Find(&entry)
+		if entry.SubjectwaitlistID == 0 {
+			break
+		}
+
+		var previous int64
+		tx.Model(&Subject_Joined{}).Where("student_id = ? AND subject_id = ?", entry.StudentID, entry.SubjectID).Count(&previous)
+
+		now := time.Now()
+		enrollment := Subject_Joined{
+			StudentID:                entry.StudentID,
+			SubjectID:                entry.SubjectID,
+			Date_joined:              now,
+			Override_reason:          entry.Override_reason,
+			Overridden_by:            entry.Overridden_by,
+			Overridden_prerequisites: entry.Overridden_prerequisites,
+		}
+		if err := enrollStudent(tx, &enrollment, previous > 0); err != nil {
+			return nil, err
+		}
+
+		entry.Status, entry.Promoted_at, entry.SubjectjoinedID = waitlistPromoted, &now, enrollment.SubjectjoinedID
+		err := tx.Model(&entry).Updates(map[string]interface{}{"status": entry.Status, "promoted_at": now, "subjectjoined_id": entry.SubjectjoinedID}).Error
+		if err != nil {
+			return nil, err
+		}
+
+		message := fmt.Sprintf("A seat opened up in %s and you have been enrolled", subject.Subject_name)
+		if err := notifyStudent(tx, entry.StudentID, entry.SubjectID, notificationPromoted, message); err != nil {
+			return nil, err
+		}
+		promoted = append(promoted, entry)
+	}
+	return promoted, nil
+}
+
+// joinOrWaitlist enrolls the student if the subject has a free seat and
+// nobody is queued for it, and otherwise puts them on the waitlist. It
+// returns the waitlist entry when the student was queued.
+func joinOrWaitlist(tx *gorm.DB, subject Subject, enrollment *Subject_Joined, rejoining bool) (*Subject_Waitlist, error) {
+	if _, err := promoteWaitlist(tx, subject.SubjectID); err != nil {
+		return nil, err
+	}
+	if err := lockSubject(tx, &subject); err != nil {
+		return nil, err
+	}
+
+	if subject.Capacity == 0 || (activeEnrollmentCount(tx, subject.SubjectID) < subject.Capacity && waitingCount(tx, subject.SubjectID) == 0) {
+		return nil, enrollStudent(tx, enrollment, rejoining)
+	}
+
+	entry := &Subject_Waitlist{
+		StudentID:                enrollment.StudentID,
+		SubjectID:                enrollment.SubjectID,
+		Requested_at:             enrollment.Date_joined,
+		Status:                   waitlistWaiting,
+		Override_reason:          enrollment.Override_reason,
+		Overridden_by:            enrollment.Overridden_by,
+		Overridden_prerequisites: enrollment.Overridden_prerequisites,
+	}
+	if err := tx.Create(entry).Error; err != nil {
+		return nil, err
+	}
+
+	entry.Position = waitlistPosition(tx, *entry)
+	message := fmt.Sprintf("%s is full; you are number %d on the waitlist", subject.Subject_name, entry.Position)
+	return entry, notifyStudent(tx, entry.StudentID, entry.SubjectID, notificationWaitlisted, message)
+}
+
+// migrateWaitlist allows each student to wait for a subject only once at a
+// time.
+func migrateWaitlist() {
+	db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_subject_waitlist_waiting ON subject_waitlists (student_id, subject_id)
+		WHERE status = 'waiting' AND deleted_at IS NULL`)
+}
+
+func withPositions(tx *gorm.DB, entries []Subject_Waitlist) {
+	for i := range entries {
+		if entries[i].Status == waitlistWaiting {
+			entries[i].Position = waitlistPosition(tx, entries[i])
+		}
+	}
+}
+
+func getSubjectWaitlist(c *gin.Context) {
+	var subject Subject
+	if err := db.First(&subject, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subject not found"})
+		return
+	}
+
+	var entries []Subject_Waitlist
+	db.Preload("Student").Where("subject_id = ? AND status = ?", subject.SubjectID, waitlistWaiting).Order("requested_at, subject_waitlist_id").Find(&entries)
+	for i := range entries {
+		entries[i].Position = i + 1
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"subject_id":  subject.SubjectID,
+		"capacity":    subject.Capacity,
+		"seats_taken": activeEnrollmentCount(db, subject.SubjectID),
+		"waitlist":    entries,
+	})
+}
+
+func getWaitlistByStudentID(c *gin.Context) {
+	var student Student
+	if err := db.First(&student, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Student not found"})
+		return
+	}
+
+	var entries []Subject_Waitlist
+	db.Where("student_id = ?", student.StudentID).Order("requested_at").Find(&entries)
+	withPositions(db, entries)
+	c.JSON(http.StatusOK, entries)
+}
+
+// cancelWaitlist takes a student off a waitlist. The reason is optional.
+func cancelWaitlist(c *gin.Context) {
+	var entry Subject_Waitlist
+	if err := db.First(&entry, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Waitlist entry not found"})
+		return
+	}
+
+	var input struct {
+		Reason string `json:"reason"`
+	}
+
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	now := time.Now()
+	result := db.Model(&Subject_Waitlist{}).
+		Where("subject_waitlist_id = ? AND status = ?", entry.SubjectwaitlistID, waitlistWaiting).
+		Updates(map[string]interface{}{"status": waitlistCancelled, "cancelled_at": now, "cancel_reason": strings.TrimSpace(input.Reason)})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel waitlist entry"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Waitlist entry is already %s", entry.Status)})
+		return
+	}
+
+	entry.Status, entry.Cancelled_at, entry.Cancel_reason = waitlistCancelled, &now, strings.TrimSpace(input.Reason)
+	c.JSON(http.StatusOK, entry)
+}
+
+// promoteSubjectWaitlist fills any free seats right away, for example
+// after an instructor enrolled or dropped students by hand.
+func promoteSubjectWaitlist(c *gin.Context) {
+	var subject Subject
+	if err := db.First(&subject, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subject not found"})
+		return
+	}
+
+	var promoted []Subject_Waitlist
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		promoted, err = promoteWaitlist(tx, subject.SubjectID)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to promote waitlist"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"subject_id": subject.SubjectID, "promoted": promoted})
+}
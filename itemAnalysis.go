@@ -0,0 +1,297 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultMinResponses = 10
+
+type analysisItem struct {
+	id           uint
+	question     string
+	questionType string
+	spec         questionSpec
+}
+
+type analysisResponse struct {
+	student uint
+	item    uint
+	answer  string
+}
+
+type optionStatistics struct {
+	Option         string  `json:"option"`
+	Text           string  `json:"text"`
+	Correct        bool    `json:"correct"`
+	Selection_rate float64 `json:"selection_rate"`
+	Mean_rest      float64 `json:"mean_rest_score"`
+}
+
+type itemStatistics struct {
+	ItemID           uint               `json:"item_id"`
+	Question         string             `json:"question"`
+	Question_type    string             `json:"question_type"`
+	Responses        int                `json:"responses"`
+	P_value          float64            `json:"p_value"`
+	Point_biserial   *float64           `json:"point_biserial"`
+	Options          []optionStatistics `json:"options,omitempty"`
+	Flags            []string           `json:"flags"`
+	Suggested_answer string             `json:"suggested_answer,omitempty"`
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	total := 0.0
+	for _, value := range values {
+		total += value
+	}
+	return total / float64(len(values))
+}
+
+// pearson returns the correlation of x and y, or false when either has no
+// variance. With a 0/1 item score this is the point-biserial correlation.
+func pearson(x, y []float64) (float64, bool) {
+	mx, my := mean(x), mean(y)
+	var sxy, sxx, syy float64
+	for i := range x {
+		dx, dy := x[i]-mx, y[i]-my
+		sxy += dx * dy
+		sxx += dx * dx
+		syy += dy * dy
+	}
+	if sxx == 0 || syy == 0 {
+		return 0, false
+	}
+	return sxy / math.Sqrt(sxx*syy), true
+}
+
+// analyzeItems computes classical test theory statistics. Each student's
+// total is the sum of their item scores; discrimination correlates an item
+// with the total of the other items (the corrected item-total correlation)
+// so an item does not correlate with itself.
+func analyzeItems(items []analysisItem, responses []analysisResponse, minResponses int) []itemStatistics {
+	byID := map[uint]analysisItem{}
+	for _, item := range items {
+		byID[item.id] = item
+	}
+
+	scores := map[uint]map[uint]float64{}
+	answers := map[uint]map[uint]string{}
+	totals := map[uint]float64{}
+	for _, response := range responses {
+		item, ok := byID[response.item]
+		if !ok {
+			continue
+		}
+		if scores[response.item] == nil {
+			scores[response.item] = map[uint]float64{}
+			answers[response.item] = map[uint]string{}
+		}
+		score := gradeAnswer(item.questionType, item.spec, response.answer)
+		totals[response.student] += score - scores[response.item][response.student]
+		scores[response.item][response.student] = score
+		answers[response.item][response.student] = response.answer
+	}
+
+	statistics := []itemStatistics{}
+	for _, item := range items {
+		questionType := normalizeQuestionType(item.questionType)
+		stats := itemStatistics{ItemID: item.id, Question: item.question, Question_type: questionType, Flags: []string{}}
+
+		var itemScores, restScores []float64
+		var students []uint
+		for student, score := range scores[item.id] {
+			students = append(students, student)
+			itemScores = append(itemScores, score)
+			restScores = append(restScores, totals[student]-score)
+		}
+		stats.Responses = len(students)
+		stats.P_value = mean(itemScores)
+
+		if r, ok := pearson(itemScores, restScores); ok {
+			stats.Point_biserial = &r
+		}
+
+		if questionType == questionSingleChoice || questionType == questionMultipleSelect {
+			stats.Options = optionBreakdown(item, students, answers[item.id], totals, scores[item.id])
+		}
+
+		if stats.Responses < minResponses {
+			stats.Flags = append(stats.Flags, "insufficient_data")
+			statistics = append(statistics, stats)
+			continue
+		}
+
+		if stats.P_value > 0.9 {
+			stats.Flags = append(stats.Flags, "too_easy")
+		}
+		if stats.P_value < 0.2 {
+			stats.Flags = append(stats.Flags, "too_hard")
+		}
+		if stats.Point_biserial != nil && *stats.Point_biserial < 0.2 {
+			stats.Flags = append(stats.Flags, "low_discrimination")
+		}
+
+		// A single choice item is probably mis-keyed when discrimination is
+		// negative and some distractor is chosen by stronger students than
+		// the keyed answer.
+		if questionType == questionSingleChoice && stats.Point_biserial != nil && *stats.Point_biserial < 0 {
+			var key, best *optionStatistics
+			for i := range stats.Options {
+				option := &stats.Options[i]
+				if option.Correct {
+					key = option
+				} else if option.Selection_rate > 0 && (best == nil || option.Mean_rest > best.Mean_rest) {
+					best = option
+				}
+			}
+			if key != nil && best != nil && best.Mean_rest > key.Mean_rest {
+				stats.Flags = append(stats.Flags, "probable_wrong_key")
+				stats.Suggested_answer = best.Option
+			}
+		}
+
+		statistics = append(statistics, stats)
+	}
+
+	return statistics
+}
+
+func optionBreakdown(item analysisItem, students []uint, answers map[uint]string, totals map[uint]float64, scores map[uint]float64) []optionStatistics {
+	correct := map[string]bool{}
+	for _, letter := range item.spec.Correct {
+		correct[letter] = true
+	}
+
+	var options []optionStatistics
+	for i, text := range item.spec.Options {
+		letter := optionLetter(i)
+		var chosenRest []float64
+		for _, student := range students {
+			for _, chosen := range splitLetters(answers[student]) {
+				if chosen == letter {
+					chosenRest = append(chosenRest, totals[student]-scores[student])
+					break
+				}
+			}
+		}
+
+		rate := 0.0
+		if len(students) > 0 {
+			rate = float64(len(chosenRest)) / float64(len(students))
+		}
+		options = append(options, optionStatistics{
+			Option:         letter,
+			Text:           text,
+			Correct:        correct[letter],
+			Selection_rate: rate,
+			Mean_rest:      mean(chosenRest),
+		})
+	}
+	return options
+}
+
+func minResponsesParam(c *gin.Context) int {
+	if value, err := strconv.Atoi(c.Query("min_responses")); err == nil && value > 0 {
+		return value
+	}
+	return defaultMinResponses
+}
+
+func getQuizItemAnalysis(c *gin.Context) {
+	var subject Subject
+	if err := db.First(&subject, c.Query("subject_id")).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Subject with that ID not found"})
+		return
+	}
+
+	var quizzes []Quiz
+	db.Where("subject_id = ?", subject.SubjectID).Order("quiz_id").Find(&quizzes)
+
+	var items []analysisItem
+	var ids []uint
+	current := map[uint]int{}
+	for _, quiz := range quizzes {
+		items = append(items, analysisItem{id: quiz.QuizID, question: quiz.Question, questionType: quiz.Question_type, spec: quizSpec(quiz)})
+		ids = append(ids, quiz.QuizID)
+		current[quiz.QuizID] = quiz.Revision
+	}
+
+	// Only answers to the current revision are graded against the current
+	// key and options; earlier revisions may have asked something else.
+	var revisionIDs []uint
+	var answers []Quiz_Answer
+	if len(ids) > 0 {
+		var revisions []Quiz_Revision
+		db.Where("quiz_id IN ?", ids).Find(&revisions)
+		for _, revision := range revisions {
+			if revision.Revision == current[revision.QuizID] {
+				revisionIDs = append(revisionIDs, revision.QuizrevisionID)
+			}
+		}
+	}
+	if len(revisionIDs) > 0 {
+		db.Where("quizrevision_id IN ?", revisionIDs).Order("created_at").Find(&answers)
+	}
+
+	// Answers are ordered oldest first, so a retake overrides earlier tries.
+	var responses []analysisResponse
+	for _, answer := range answers {
+		responses = append(responses, analysisResponse{student: answer.StudentID, item: answer.QuizID, answer: answer.Student_answer})
+	}
+
+	statistics := analyzeItems(items, responses, minResponsesParam(c))
+	sort.SliceStable(statistics, func(i, j int) bool { return len(statistics[i].Flags) > len(statistics[j].Flags) })
+	c.JSON(http.StatusOK, statistics)
+}
+
+func getPlacementTestItemAnalysis(c *gin.Context) {
+	var interest Interest
+	if err := db.First(&interest, c.Query("interest_id")).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Interest with that ID not found"})
+		return
+	}
+
+	var placementTests []Placement_Test
+	db.Where("interest_id = ?", interest.InterestID).Order("placement_test_id").Find(&placementTests)
+
+	var items []analysisItem
+	var ids []uint
+	current := map[uint]int{}
+	for _, placementTest := range placementTests {
+		items = append(items, analysisItem{id: placementTest.PlacementtestID, question: placementTest.Question, questionType: placementTest.Question_type, spec: placementTestSpec(placementTest)})
+		ids = append(ids, placementTest.PlacementtestID)
+		current[placementTest.PlacementtestID] = placementTest.Revision
+	}
+
+	var revisionIDs []uint
+	var answers []Placement_Test_Answer
+	if len(ids) > 0 {
+		var revisions []Placement_Test_Revision
+		db.Where("placementtest_id IN ?", ids).Find(&revisions)
+		for _, revision := range revisions {
+			if revision.Revision == current[revision.PlacementtestID] {
+				revisionIDs = append(revisionIDs, revision.PlacementtestrevisionID)
+			}
+		}
+	}
+	if len(revisionIDs) > 0 {
+		db.Where("placementtestrevision_id IN ?", revisionIDs).Order("created_at").Find(&answers)
+	}
+
+	var responses []analysisResponse
+	for _, answer := range answers {
+		responses = append(responses, analysisResponse{student: answer.StudentID, item: answer.PlacementtestID, answer: answer.Student_answer})
+	}
+
+	statistics := analyzeItems(items, responses, minResponsesParam(c))
+	sort.SliceStable(statistics, func(i, j int) bool { return len(statistics[i].Flags) > len(statistics[j].Flags) })
+	c.JSON(http.StatusOK, statistics)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// llmProvider is a chat completion API. Providers report failures as
+// *llmError so llmClient can decide whether to retry or fall back.
+type llmProvider interface {
+	Name() string
+	Complete(ctx context.Context, req llmRequest) (string, error)
+	// Stream calls onDelta with each piece of the reply as it arrives and
+	// returns the whole reply. An error from onDelta stops the stream.
+	Stream(ctx context.Context, req llmRequest, onDelta func(string) error) (string, error)
+}
+
+type llmRequest struct {
+	Model    string
+	Messages []chatMessage
+}
+
+// Kinds of llmError. Clients see the kind as the error code.
+const (
+	llmRateLimited      = "rate_limited"
+	llmUnavailable      = "unavailable"
+	llmTimeout          = "timeout"
+	llmUnauthorized     = "unauthorized"
+	llmBadRequest       = "bad_request"
+	llmModelUnavailable = "model_unavailable"
+	llmInvalidResponse  = "invalid_response"
+	llmCancelled        = "cancelled"
+)
+
+const (
+	defaultLLMTimeout  = 60 * time.Second
+	defaultLLMRetries  = 2
+	llmBackoff         = 500 * time.Millisecond
+	maxLLMBackoff      = 8 * time.Second
+	maxLLMRetryAfter   = 30 * time.Second
+	llmStreamIdleLimit = 30 * time.Second
+)
+
+// llmError is a provider failure in the same terms for every provider. The
+// upstream message is kept for logs, not shown to students.
+type llmError struct {
+	Kind       string
+	Provider   string
+	Model      string
+	Status     int
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *llmError) Error() string {
+	message := fmt.Sprintf("%s %s: %s", e.Provider, e.Model, e.Kind)
+	if e.Status != 0 {
+		message += fmt.Sprintf(" (%d)", e.Status)
+	}
+	if e.Message != "" {
+		message += ": " + e.Message
+	}
+	return message
+}
+
+// retryable reports whether the same request may work if sent again.
+func (e *llmError) retryable() bool {
+	return e.Kind == llmRateLimited || e.Kind == llmUnavailable || e.Kind == llmTimeout
+}
+
+// fallback reports whether another model may work. Bad credentials or a
+// cancelled request fail the same way for every model.
+func (e *llmError) fallback() bool {
+	return e.Kind != llmUnauthorized && e.Kind != llmCancelled
+}
+
+// llmStatusError classifies an HTTP error response.
+func llmStatusError(provider string, model string, status int, retryAfter string, message string) *llmError {
+	err := &llmError{Provider: provider, Model: model, Status: status, Message: message}
+	switch {
+	case status == http.StatusTooManyRequests:
+		err.Kind = llmRateLimited
+	case status == http.StatusUnauthorized || status == http.StatusForbidden || status == http.StatusPaymentRequired:
+		err.Kind = llmUnauthorized
+	case status == http.StatusNotFound:
+		err.Kind = llmModelUnavailable
+	case status == http.StatusRequestTimeout || status >= 500:
+		err.Kind = llmUnavailable
+	default:
+		err.Kind = llmBadRequest
+	}
+	if seconds, parseErr := strconv.Atoi(strings.TrimSpace(retryAfter)); parseErr == nil && seconds > 0 {
+		err.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return err
+}
+
+// llmTransportError classifies a request that got no response. ctx is the
+// caller's context, to tell a cancelled request from a timed out one.
+func llmTransportError(ctx context.Context, provider string, model string, err error) *llmError {
+	kind := llmUnavailable
+	var timeout interface{ Timeout() bool }
+	switch {
+	case ctx.Err() != nil:
+		kind = llmCancelled
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &timeout) && timeout.Timeout():
+		kind = llmTimeout
+	}
+	return &llmError{Kind: kind, Provider: provider, Model: model, Message: err.Error()}
+}
+
+// asLLMError makes any error an *llmError.
+func asLLMError(err error) *llmError {
+	var llmErr *llmError
+	if errors.As(err, &llmErr) {
+		return llmErr
+	}
+	return &llmError{Kind: llmUnavailable, Message: err.Error()}
+}
+
+// llmErrorResponse is the status and message students get for err.
+func llmErrorResponse(err error) (int, string) {
+	switch asLLMError(err).Kind {
+	case llmRateLimited:
+		return http.StatusTooManyRequests, "The assistant is busy, try again shortly"
+	case llmTimeout:
+		return http.StatusGatewayTimeout, "The assistant took too long to answer"
+	case llmUnauthorized:
+		return http.StatusBadGateway, "The assistant is not configured correctly"
+	case llmBadRequest:
+		return http.StatusBadGateway, "The assistant could not answer this message"
+	}
+	return http.StatusBadGateway, "The assistant is unavailable"
+}
+
+// llmClient sends chat requests to a provider, retrying failures that may
+// pass with exponential backoff and falling back to the next model when a
+// model keeps failing.
+type llmClient struct {
+	provider llmProvider
+	models   []string
+	retries  int
+	backoff  time.Duration
+}
+
+var chatLLM *llmClient
+
+// newLLMClientFromEnv configures the chatbot's provider:
+//
+//	LLM_PROVIDER         openrouter (default), openai or mock
+//	LLM_BASE_URL         API root for openai, such as http://localhost:11434/v1
+//	LLM_API_KEY          API key, API_KEY is used when unset
+//	MODEL                model to use first, required
+//	LLM_FALLBACK_MODELS  comma separated models to try when MODEL fails
+//	LLM_TIMEOUT          time allowed for a reply, such as 60s
+//	LLM_MAX_RETRIES      retries per model on rate limits and outages
+func newLLMClientFromEnv() (*llmClient, error) {
+	apiKey := os.Getenv("LLM_API_KEY")
+	if apiKey == "" {
+		apiKey = os.Getenv("API_KEY")
+	}
+
+	timeout := defaultLLMTimeout
+	if value := os.Getenv("LLM_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid LLM_TIMEOUT %q", value)
+		}
+		timeout = parsed
+	}
+
+	retries := defaultLLMRetries
+	if value := os.Getenv("LLM_MAX_RETRIES"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid LLM_MAX_RETRIES %q", value)
+		}
+		retries = parsed
+	}
+
+	var provider llmProvider
+	switch name := os.Getenv("LLM_PROVIDER"); name {
+	case "", "openrouter":
+		provider = newOpenRouterProvider(apiKey, timeout)
+	case "openai":
+		baseURL := os.Getenv("LLM_BASE_URL")
+		if baseURL == "" {
+			baseURL = "https://api.openai.com/v1"
+		}
+		provider = newOpenAICompatibleProvider("openai", baseURL, apiKey, timeout)
+	case "mock":
+		provider = newMockProvider()
+	default:
+		return nil, fmt.Errorf("unknown LLM_PROVIDER %q", name)
+	}
+
+	model := strings.TrimSpace(os.Getenv("MODEL"))
+	if model == "" {
+		return nil, errors.New("MODEL is required")
+	}
+	models := []string{model}
+	for _, model := range strings.Split(os.Getenv("LLM_FALLBACK_MODELS"), ",") {
+		if model = strings.TrimSpace(model); model != "" {
+			models = append(models, model)
+		}
+	}
+
+	return newLLMClient(provider, models, retries), nil
+}
+
+func newLLMClient(provider llmProvider, models []string, retries int) *llmClient {
+	return &llmClient{provider: provider, models: models, retries: retries, backoff: llmBackoff}
+}
+
+// wait sleeps before retry attempt, honouring a short Retry-After.
+func (l *llmClient) wait(ctx context.Context, attempt int, err *llmError) error {
+	delay := min(l.backoff<<attempt, maxLLMBackoff)
+	delay += time.Duration(rand.Int64N(int64(delay)/2 + 1))
+	if err.RetryAfter > 0 && err.RetryAfter <= maxLLMRetryAfter {
+		delay = err.RetryAfter
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// call runs send for each model in turn until one succeeds. retry says
+// whether a failed attempt may be repeated at all.
+func (l *llmClient) call(ctx context.Context, send func(model string) (string, error), retry func() bool) (string, error) {
+	var last *llmError
+	for _, model := range l.models {
+		for attempt := 0; ; attempt++ {
+			reply, err := send(model)
+			if err == nil {
+				return reply, nil
+			}
+			last = asLLMError(err)
+			if last.Provider == "" {
+				last.Provider, last.Model = l.provider.Name(), model
+			}
+			if ctx.Err() != nil {
+				last.Kind = llmCancelled
+				return "", last
+			}
+			log.Println("Chat completion failed:", last)
+
+			if !retry() {
+				return "", last
+			}
+			if !last.retryable() || attempt >= l.retries {
+				break
+			}
+			if err := l.wait(ctx, attempt, last); err != nil {
+				last.Kind = llmCancelled
+				return "", last
+			}
+		}
+		if !last.fallback() {
+			return "", last
+		}
+	}
+	return "", last
+}
+
+// Complete returns a reply to messages.
+func (l *llmClient) Complete(ctx context.Context, messages []chatMessage) (string, error) {
+	return l.call(ctx, func(model string) (string, error) {
+		return l.provider.Complete(ctx, llmRequest{Model: model, Messages: messages})
+	}, func() bool { return true })
+}
+
+// Stream returns a reply to messages, passing it to onDelta as it arrives.
+// Once part of a reply has been passed on it is neither retried nor
+// replaced by another model's, so the student never sees two replies mixed.
+func (l *llmClient) Stream(ctx context.Context, messages []chatMessage, onDelta func(string) error) (string, error) {
+	started := false
+	return l.call(ctx, func(model string) (string, error) {
+		return l.provider.Stream(ctx, llmRequest{Model: model, Messages: messages}, func(delta string) error {
+			started = true
+			return onDelta(delta)
+		})
+	}, func() bool { return !started })
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestLLMClient is an llmClient over a scripted mockProvider that backs
+// off for a millisecond, so retries do not slow the tests down.
+func newTestLLMClient(models []string, retries int, script ...mockReply) (*llmClient, *mockProvider) {
+	provider := newMockProvider(script...)
+	client := newLLMClient(provider, models, retries)
+	client.backoff = time.Millisecond
+	return client, provider
+}
+
+func failWith(kind string) mockReply {
+	return mockReply{Err: &llmError{Kind: kind, Message: "scripted failure"}}
+}
+
+func requestedModels(provider *mockProvider) []string {
+	var models []string
+	for _, req := range provider.Requests() {
+		models = append(models, req.Model)
+	}
+	return models
+}
+
+func TestLLMClientRetriesThenSucceeds(t *testing.T) {
+	client, provider := newTestLLMClient([]string{"main"}, 2,
+		failWith(llmRateLimited), failWith(llmUnavailable), mockReply{Content: "hello"})
+
+	reply, err := client.Complete(context.Background(), []chatMessage{{Role: "user", Content: "hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "hello" {
+		t.Errorf("reply = %q, want hello", reply)
+	}
+	if models := requestedModels(provider); !reflect.DeepEqual(models, []string{"main", "main", "main"}) {
+		t.Errorf("requests went to %v, want main three times", models)
+	}
+}
+
+func TestLLMClientFallsBackAfterRetries(t *testing.T) {
+	client, provider := newTestLLMClient([]string{"main", "backup"}, 1,
+		failWith(llmUnavailable), failWith(llmTimeout), mockReply{Content: "from backup"})
+
+	reply, err := client.Complete(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "from backup" {
+		t.Errorf("reply = %q, want from backup", reply)
+	}
+	if models := requestedModels(provider); !reflect.DeepEqual(models, []string{"main", "main", "backup"}) {
+		t.Errorf("requests went to %v, want main twice then backup", models)
+	}
+}
+
+func TestLLMClientFallsBackWithoutRetryingBadRequests(t *testing.T) {
+	client, provider := newTestLLMClient([]string{"main", "backup"}, 3,
+		failWith(llmModelUnavailable), mockReply{Content: "ok"})
+
+	if _, err := client.Complete(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if models := requestedModels(provider); !reflect.DeepEqual(models, []string{"main", "backup"}) {
+		t.Errorf("requests went to %v, want main once then backup", models)
+	}
+}
+
+func TestLLMClientStopsOnUnauthorized(t *testing.T) {
+	client, provider := newTestLLMClient([]string{"main", "backup"}, 3, failWith(llmUnauthorized))
+
+	_, err := client.Complete(context.Background(), nil)
+	var llmErr *llmError
+	if !errors.As(err, &llmErr) || llmErr.Kind != llmUnauthorized {
+		t.Fatalf("error = %v, want unauthorized", err)
+	}
+	if llmErr.Provider != "mock" || llmErr.Model != "main" {
+		t.Errorf("error names %s %s, want mock main", llmErr.Provider, llmErr.Model)
+	}
+	if n := len(provider.Requests()); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+}
+
+func TestLLMClientReturnsLastErrorWhenAllModelsFail(t *testing.T) {
+	client, provider := newTestLLMClient([]string{"main", "backup"}, 0,
+		failWith(llmUnavailable), failWith(llmRateLimited))
+
+	_, err := client.Complete(context.Background(), nil)
+	if llmErr := asLLMError(err); llmErr.Kind != llmRateLimited || llmErr.Model != "backup" {
+		t.Errorf("error = %v, want backup rate limited", err)
+	}
+	if n := len(provider.Requests()); n != 2 {
+		t.Errorf("sent %d requests, want 2", n)
+	}
+}
+
+func TestLLMClientWaitBacksOff(t *testing.T) {
+	client := newLLMClient(newMockProvider(), []string{"main"}, 0)
+	client.backoff = 5 * time.Millisecond
+
+	// Attempt 2 waits backoff << 2 plus up to half again of jitter.
+	start := time.Now()
+	if err := client.wait(context.Background(), 2, &llmError{Kind: llmUnavailable}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("waited %v, want at least 20ms", elapsed)
+	}
+
+	// A short Retry-After replaces the backoff.
+	start = time.Now()
+	if err := client.wait(context.Background(), 0, &llmError{Kind: llmRateLimited, RetryAfter: 30 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("waited %v, want the 30ms Retry-After", elapsed)
+	}
+}
+
+func TestLLMClientCancelledWhileWaiting(t *testing.T) {
+	client, _ := newTestLLMClient([]string{"main"}, 3, failWith(llmUnavailable))
+	client.backoff = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err := client.Complete(ctx, nil)
+	if llmErr := asLLMError(err); llmErr.Kind != llmCancelled {
+		t.Errorf("error = %v, want cancelled", err)
+	}
+}
+
+func TestLLMClientStreamRetriesBeforeFirstDelta(t *testing.T) {
+	client, provider := newTestLLMClient([]string{"main"}, 1,
+		failWith(llmUnavailable), mockReply{Deltas: []string{"Hel", "lo"}})
+
+	var deltas []string
+	reply, err := client.Stream(context.Background(), nil, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Hello" || !reflect.DeepEqual(deltas, []string{"Hel", "lo"}) {
+		t.Errorf("reply = %q from %v, want Hello from Hel, lo", reply, deltas)
+	}
+	if n := len(provider.Requests()); n != 2 {
+		t.Errorf("sent %d requests, want 2", n)
+	}
+}
+
+func TestLLMClientStreamDoesNotRetryAfterFirstDelta(t *testing.T) {
+	client, provider := newTestLLMClient([]string{"main", "backup"}, 3,
+		mockReply{Deltas: []string{"Hel"}, Err: &llmError{Kind: llmUnavailable}}, mockReply{Content: "other reply"})
+
+	var deltas []string
+	_, err := client.Stream(context.Background(), nil, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if llmErr := asLLMError(err); llmErr.Kind != llmUnavailable {
+		t.Errorf("error = %v, want unavailable", err)
+	}
+	if !reflect.DeepEqual(deltas, []string{"Hel"}) {
+		t.Errorf("deltas = %v, want only Hel", deltas)
+	}
+	if n := len(provider.Requests()); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+}
+
+func TestOpenAICompatibleStreamTimesOutWaitingForHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(300 * time.Millisecond):
+		}
+	}))
+	defer server.Close()
+
+	provider := newOpenAICompatibleProvider("test", server.URL, "key", 50*time.Millisecond)
+	_, err := provider.Stream(context.Background(), llmRequest{Model: "main"}, func(string) error { return nil })
+	if llmErr := asLLMError(err); llmErr.Kind != llmTimeout {
+		t.Errorf("error = %v, want timeout", err)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// openAICompatibleProvider talks to any API with OpenAI's
+// /chat/completions: OpenAI itself, OpenRouter, vLLM, Ollama, LM Studio and
+// so on.
+type openAICompatibleProvider struct {
+	name    string
+	baseURL string
+	// client is for whole replies and times out after the configured
+	// timeout. streamClient only limits the wait for the response headers,
+	// since a long reply may stream for longer; stalls are caught by
+	// llmStreamIdleLimit instead.
+	client       *resty.Client
+	streamClient *resty.Client
+}
+
+func newOpenAICompatibleProvider(name string, baseURL string, apiKey string, timeout time.Duration) *openAICompatibleProvider {
+	configure := func(client *resty.Client) *resty.Client {
+		return client.
+			SetHeader("Content-Type", "application/json").
+			SetAuthToken(apiKey)
+	}
+	// Start from the default transport to keep its dial, TLS handshake and
+	// idle connection limits.
+	streamTransport := http.DefaultTransport.(*http.Transport).Clone()
+	streamTransport.ResponseHeaderTimeout = timeout
+	return &openAICompatibleProvider{
+		name:         name,
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		client:       configure(resty.New().SetTimeout(timeout)),
+		streamClient: configure(resty.New().SetTransport(streamTransport)),
+	}
+}
+
+// newOpenRouterProvider is OpenRouter, which also takes the optional
+// OPENROUTER_SITE_URL and OPENROUTER_APP_NAME to credit the app.
+func newOpenRouterProvider(apiKey string, timeout time.Duration) *openAICompatibleProvider {
+	provider := newOpenAICompatibleProvider("openrouter", "https://openrouter.ai/api/v1", apiKey, timeout)
+	for header, name := range map[string]string{"HTTP-Referer": "OPENROUTER_SITE_URL", "X-Title": "OPENROUTER_APP_NAME"} {
+		if value := os.Getenv(name); value != "" {
+			provider.client.SetHeader(header, value)
+			provider.streamClient.SetHeader(header, value)
+		}
+	}
+	return provider
+}
+
+func (p *openAICompatibleProvider) Name() string { return p.name }
+
+func (p *openAICompatibleProvider) body(req llmRequest, stream bool) map[string]interface{} {
+	body := map[string]interface{}{"model": req.Model, "messages": req.Messages}
+	if stream {
+		body["stream"] = true
+	}
+	return body
+}
+
+// upstreamMessage pulls the message out of an OpenAI style error body.
+func upstreamMessage(body []byte) string {
+	var parsed struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &parsed) == nil && parsed.Error.Message != "" {
+		return parsed.Error.Message
+	}
+	return strings.TrimSpace(string(body[:min(len(body), 300)]))
+}
+
+func (p *openAICompatibleProvider) Complete(ctx context.Context, req llmRequest) (string, error) {
+	resp, err := p.client.R().
+		SetContext(ctx).
+		SetBody(p.body(req, false)).
+		Post(p.baseURL + "/chat/completions")
+	if err != nil {
+		return "", llmTransportError(ctx, p.name, req.Model, err)
+	}
+	if resp.IsError() {
+		return "", llmStatusError(p.name, req.Model, resp.StatusCode(), resp.Header().Get("Retry-After"), upstreamMessage(resp.Body()))
+	}
+
+	var result struct {
+		Choices []struct {
+			Message chatMessage `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(resp.Body(), &result); err != nil || len(result.Choices) == 0 {
+		return "", &llmError{Kind: llmInvalidResponse, Provider: p.name, Model: req.Model, Message: "reply has no choices"}
+	}
+	return result.Choices[0].Message.Content, nil
+}
+
+func (p *openAICompatibleProvider) Stream(ctx context.Context, req llmRequest, onDelta func(string) error) (string, error) {
+	// Give up on a stream that stops sending without finishing.
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var idle atomic.Bool
+	watchdog := time.AfterFunc(llmStreamIdleLimit, func() {
+		idle.Store(true)
+		cancel()
+	})
+	defer watchdog.Stop()
+
+	streamError := func(err error) error {
+		if idle.Load() {
+			return &llmError{Kind: llmTimeout, Provider: p.name, Model: req.Model, Message: "stream stalled"}
+		}
+		return llmTransportError(ctx, p.name, req.Model, err)
+	}
+
+	resp, err := p.streamClient.R().
+		SetContext(streamCtx).
+		SetDoNotParseResponse(true).
+		SetHeader("Accept", "text/event-stream").
+		SetBody(p.body(req, true)).
+		Post(p.baseURL + "/chat/completions")
+	if err != nil {
+		return "", streamError(err)
+	}
+	body := resp.RawBody()
+	defer body.Close()
+	if resp.IsError() {
+		message := make([]byte, 4<<10)
+		n, _ := body.Read(message)
+		return "", llmStatusError(p.name, req.Model, resp.StatusCode(), resp.Header().Get("Retry-After"), upstreamMessage(message[:n]))
+	}
+
+	var reply strings.Builder
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		watchdog.Reset(llmStreamIdleLimit)
+
+		// Blank lines end events and lines starting with a colon are
+		// keep-alive comments; only data lines carry the reply.
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			return reply.String(), nil
+		}
+
+		var chunk struct {
+			Choices []struct {
+				Delta chatMessage `json:"delta"`
+			} `json:"choices"`
+			Error *struct {
+				Code    json.RawMessage `json:"code"`
+				Message string          `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return reply.String(), &llmError{Kind: llmInvalidResponse, Provider: p.name, Model: req.Model, Message: "unreadable stream event"}
+		}
+		if chunk.Error != nil {
+			// OpenRouter reports errors after the stream has started with
+			// the HTTP status they would have had as the code.
+			var status int
+			json.Unmarshal(chunk.Error.Code, &status)
+			if status == 0 {
+				status = http.StatusBadGateway
+			}
+			return reply.String(), llmStatusError(p.name, req.Model, status, "", chunk.Error.Message)
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content == "" {
+				continue
+			}
+			reply.WriteString(choice.Delta.Content)
+			if err := onDelta(choice.Delta.Content); err != nil {
+				return reply.String(), err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return reply.String(), streamError(err)
+	}
+	return reply.String(), &llmError{Kind: llmUnavailable, Provider: p.name, Model: req.Model, Message: "stream ended before it was done"}
+}
+
+// mockReply is one scripted answer of mockProvider: an error, or Content
+// streamed in Deltas, or word by word when Deltas is empty.
+type mockReply struct {
+	Content string
+	Deltas  []string
+	Err     error
+}
+
+// mockProvider answers from a script, one reply per request, and records
+// the requests it got. Once the script runs out it echoes the last
+// message, which makes it usable for local development without an API key.
+type mockProvider struct {
+	mu       sync.Mutex
+	script   []mockReply
+	requests []llmRequest
+}
+
+func newMockProvider(script ...mockReply) *mockProvider {
+	return &mockProvider{script: script}
+}
+
+func (p *mockProvider) Name() string { return "mock" }
+
+// Requests returns the requests received so far.
+func (p *mockProvider) Requests() []llmRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]llmRequest(nil), p.requests...)
+}
+
+func (p *mockProvider) next(req llmRequest) mockReply {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests = append(p.requests, req)
+	if len(p.script) > 0 {
+		reply := p.script[0]
+		p.script = p.script[1:]
+		return reply
+	}
+	var last string
+	if len(req.Messages) > 0 {
+		last = req.Messages[len(req.Messages)-1].Content
+	}
+	return mockReply{Content: fmt.Sprintf("Mock reply from %s to: %s", req.Model, last)}
+}
+
+func (p *mockProvider) Complete(ctx context.Context, req llmRequest) (string, error) {
+	reply := p.next(req)
+	if reply.Err != nil {
+		return "", reply.Err
+	}
+	return reply.Content, nil
+}
+
+func (p *mockProvider) Stream(ctx context.Context, req llmRequest, onDelta func(string) error) (string, error) {
+	reply := p.next(req)
+	deltas := reply.Deltas
+	if len(deltas) == 0 && reply.Content != "" {
+		deltas = strings.SplitAfter(reply.Content, " ")
+	}
+
+	var content strings.Builder
+	for _, delta := range deltas {
+		if ctx.Err() != nil {
+			return content.String(), llmTransportError(ctx, p.Name(), req.Model, ctx.Err())
+		}
+		content.WriteString(delta)
+		if err := onDelta(delta); err != nil {
+			return content.String(), err
+		}
+	}
+	if reply.Err != nil {
+		return content.String(), reply.Err
+	}
+	return content.String(), nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newLLMTestProvider is an openAICompatibleProvider for a server that
+// answers every request with handler.
+func newLLMTestProvider(t *testing.T, handler http.HandlerFunc) *openAICompatibleProvider {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return newOpenAICompatibleProvider("test", server.URL+"/", "key", 5*time.Second)
+}
+
+// replyWithStatus answers with status, a Retry-After when given and an
+// OpenAI style error body.
+func replyWithStatus(status int, retryAfter string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"error":{"message":"upstream says no"}}`)
+	}
+}
+
+// streamEvents answers with a server-sent event stream of lines.
+func streamEvents(lines ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+func deltaEvent(content string) string {
+	return `data: {"choices":[{"delta":{"role":"assistant","content":` + fmt.Sprintf("%q", content) + `}}]}`
+}
+
+func TestOpenAICompatibleComplete(t *testing.T) {
+	var body map[string]interface{}
+	provider := newLLMTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chat/completions" {
+			t.Errorf("path = %s, want /chat/completions", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer key" {
+			t.Errorf("Authorization = %q, want Bearer key", auth)
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"Hello"}}]}`)
+	})
+
+	reply, err := provider.Complete(context.Background(), llmRequest{Model: "main", Messages: []chatMessage{{Role: "user", Content: "hi"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Hello" {
+		t.Errorf("reply = %q, want Hello", reply)
+	}
+	if body["model"] != "main" || body["stream"] != nil {
+		t.Errorf("request body = %v, want model main without stream", body)
+	}
+}
+
+func TestOpenAICompatibleErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		kind       string
+		status     int
+		retryAfter time.Duration
+	}{
+		{"rate limited", replyWithStatus(http.StatusTooManyRequests, "3"), llmRateLimited, http.StatusTooManyRequests, 3 * time.Second},
+		{"unavailable", replyWithStatus(http.StatusServiceUnavailable, ""), llmUnavailable, http.StatusServiceUnavailable, 0},
+		{"unauthorized", replyWithStatus(http.StatusUnauthorized, ""), llmUnauthorized, http.StatusUnauthorized, 0},
+	}
+	for _, test := range tests {
+		provider := newLLMTestProvider(t, test.handler)
+		calls := map[string]func() error{
+			"Complete": func() error {
+				_, err := provider.Complete(context.Background(), llmRequest{Model: "main"})
+				return err
+			},
+			"Stream": func() error {
+				_, err := provider.Stream(context.Background(), llmRequest{Model: "main"}, func(string) error { return nil })
+				return err
+			},
+		}
+		for method, call := range calls {
+			t.Run(test.name+" "+method, func(t *testing.T) {
+				err := asLLMError(call())
+				if err.Kind != test.kind || err.Status != test.status || err.RetryAfter != test.retryAfter {
+					t.Errorf("error = %+v, want %s (%d) retrying after %v", err, test.kind, test.status, test.retryAfter)
+				}
+				if err.Message != "upstream says no" || err.Provider != "test" || err.Model != "main" {
+					t.Errorf("error = %+v, want the upstream message, provider and model", err)
+				}
+			})
+		}
+	}
+}
+
+func TestOpenAICompatibleCompleteWithoutChoices(t *testing.T) {
+	provider := newLLMTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"choices":[]}`)
+	})
+	_, err := provider.Complete(context.Background(), llmRequest{Model: "main"})
+	if kind := asLLMError(err).Kind; kind != llmInvalidResponse {
+		t.Errorf("error = %v, want invalid_response", err)
+	}
+}
+
+func TestOpenAICompatibleStream(t *testing.T) {
+	var body map[string]interface{}
+	provider := newLLMTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		streamEvents(
+			": OPENROUTER PROCESSING",
+			"",
+			deltaEvent("Hel"),
+			"",
+			deltaEvent(""),
+			deltaEvent("lo"),
+			"data: [DONE]",
+			deltaEvent("ignored"),
+		)(w, r)
+	})
+
+	var deltas []string
+	reply, err := provider.Stream(context.Background(), llmRequest{Model: "main"}, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Hello" || !reflect.DeepEqual(deltas, []string{"Hel", "lo"}) {
+		t.Errorf("reply = %q from %v, want Hello from [Hel lo]", reply, deltas)
+	}
+	if body["stream"] != true {
+		t.Errorf("request body = %v, want stream true", body)
+	}
+}
+
+func TestOpenAICompatibleStreamFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		reply   string
+		kind    string
+		status  int
+	}{
+		{
+			name:    "error event mid-stream",
+			handler: streamEvents(deltaEvent("Hel"), `data: {"error":{"code":429,"message":"Rate limit exceeded"}}`),
+			reply:   "Hel",
+			kind:    llmRateLimited,
+			status:  http.StatusTooManyRequests,
+		},
+		{
+			name:    "error event without a code",
+			handler: streamEvents(deltaEvent("Hel"), `data: {"error":{"message":"Provider returned error"}}`),
+			reply:   "Hel",
+			kind:    llmUnavailable,
+			status:  http.StatusBadGateway,
+		},
+		{
+			name:    "missing done",
+			handler: streamEvents(deltaEvent("Hel"), deltaEvent("lo")),
+			reply:   "Hello",
+			kind:    llmUnavailable,
+		},
+		{
+			name:    "unreadable event",
+			handler: streamEvents(deltaEvent("Hel"), `data: {"choices":[`),
+			reply:   "Hel",
+			kind:    llmInvalidResponse,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := newLLMTestProvider(t, test.handler)
+			reply, err := provider.Stream(context.Background(), llmRequest{Model: "main"}, func(string) error { return nil })
+			if reply != test.reply {
+				t.Errorf("reply = %q, want %q", reply, test.reply)
+			}
+			if llmErr := asLLMError(err); llmErr.Kind != test.kind || llmErr.Status != test.status {
+				t.Errorf("error = %+v, want %s (%d)", llmErr, test.kind, test.status)
+			}
+		})
+	}
+}
+
+func TestOpenAICompatibleStreamStopsOnDeltaError(t *testing.T) {
+	provider := newLLMTestProvider(t, streamEvents(deltaEvent("Hel"), deltaEvent("lo"), "data: [DONE]"))
+	stop := errors.New("client went away")
+	reply, err := provider.Stream(context.Background(), llmRequest{Model: "main"}, func(string) error { return stop })
+	if !errors.Is(err, stop) || reply != "Hel" {
+		t.Errorf("Stream = %q, %v, want Hel, %v", reply, err, stop)
+	}
+}
+
+func TestLLMStatusError(t *testing.T) {
+	tests := []struct {
+		status     int
+		retryAfter string
+		kind       string
+		wait       time.Duration
+		retryable  bool
+		fallback   bool
+	}{
+		{http.StatusTooManyRequests, "7", llmRateLimited, 7 * time.Second, true, true},
+		{http.StatusTooManyRequests, "Wed, 21 Oct 2015 07:28:00 GMT", llmRateLimited, 0, true, true},
+		{http.StatusServiceUnavailable, "", llmUnavailable, 0, true, true},
+		{http.StatusRequestTimeout, "", llmUnavailable, 0, true, true},
+		{http.StatusUnauthorized, "", llmUnauthorized, 0, false, false},
+		{http.StatusPaymentRequired, "", llmUnauthorized, 0, false, false},
+		{http.StatusNotFound, "", llmModelUnavailable, 0, false, true},
+		{http.StatusBadRequest, "", llmBadRequest, 0, false, true},
+	}
+	for _, test := range tests {
+		err := llmStatusError("test", "main", test.status, test.retryAfter, "message")
+		if err.Kind != test.kind || err.RetryAfter != test.wait || err.retryable() != test.retryable || err.fallback() != test.fallback {
+			t.Errorf("llmStatusError(%d, %q) = %+v retryable %v fallback %v, want %s after %v retryable %v fallback %v",
+				test.status, test.retryAfter, err, err.retryable(), err.fallback(), test.kind, test.wait, test.retryable, test.fallback)
+		}
+	}
+}
+
+func TestNewLLMClientFromEnv(t *testing.T) {
+	t.Setenv("LLM_PROVIDER", "mock")
+	t.Setenv("LLM_FALLBACK_MODELS", " backup, ,other ")
+
+	t.Setenv("MODEL", " ")
+	if _, err := newLLMClientFromEnv(); err == nil || !strings.Contains(err.Error(), "MODEL") {
+		t.Errorf("error without MODEL = %v, want MODEL is required", err)
+	}
+
+	t.Setenv("MODEL", "main")
+	client, err := newLLMClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"main", "backup", "other"}; !reflect.DeepEqual(client.models, want) {
+		t.Errorf("models = %v, want %v", client.models, want)
+	}
+
+	t.Setenv("LLM_TIMEOUT", "soon")
+	if _, err := newLLMClientFromEnv(); err == nil {
+		t.Error("want an error for an invalid LLM_TIMEOUT")
+	}
+}
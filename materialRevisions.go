@@ -0,0 +1,422 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// diffContext is how many unchanged lines surround each change in a diff.
+const diffContext = 3
+
+// Diffs keep a trace that grows with the square of the number of changed
+// lines and take time proportional to the lines times the changes, so both
+// are capped.
+const (
+	maxDiffLines = 50000
+	maxDiffEdits = 2000
+)
+
+var errRevisionConflict = errors.New("learning material was changed at the same time")
+
+// Learning_Material_Revision is an immutable snapshot of a lesson's text.
+// Every edit of the title, content or format adds one, and a rollback adds
+// a new revision with the old text rather than deleting later ones, so no
+// edit is ever lost. Learning_Material.Revision is the number of the
+// latest snapshot; it is 0 for lessons not edited since revisions were
+// introduced.
+type Learning_Material_Revision struct {
+	gorm.Model
+	LearningmaterialrevisionID uint   `gorm:"column:learning_material_revision_id;primaryKey;autoIncrement;unique" json:"learning_material_revision_id"`
+	LearningmaterialID         uint   `gorm:"uniqueIndex:idx_learning_material_revision" json:"learning_material_id"`
+	Revision                   int    `gorm:"uniqueIndex:idx_learning_material_revision" json:"revision"`
+	Title                      string `json:"title"`
+	Content                    string `json:"content"`
+	Content_format             string `json:"content_format"`
+	Author                     string `json:"author"`
+	Message                    string `json:"message"`
+	Rolled_back_to             int    `json:"rolled_back_to"`
+}
+
+type diffLine struct {
+	Op       string `json:"op"`
+	Text     string `json:"text"`
+	Old_line int    `json:"old_line,omitempty"`
+	New_line int    `json:"new_line,omitempty"`
+}
+
+type diffHunk struct {
+	Old_start int        `json:"old_start"`
+	Old_lines int        `json:"old_lines"`
+	New_start int        `json:"new_start"`
+	New_lines int        `json:"new_lines"`
+	Lines     []diffLine `json:"lines"`
+}
+
+// recordMaterialRevision snapshots material as its next revision. The
+// lesson's revision number is claimed first, so of two edits saved at the
+// same time the second gets errRevisionConflict instead of a duplicate
+// revision.
+func recordMaterialRevision(tx *gorm.DB, material *Learning_Material, author string, message string, rolledBackTo int) (Learning_Material_Revision, error) {
+	revision := Learning_Material_Revision{
+		LearningmaterialID: material.LearningmaterialID,
+		Revision:           material.Revision + 1,
+		Title:              material.Title,
+		Content:            material.Content,
+		Content_format:     material.Content_format,
+		Author:             author,
+		Message:            message,
+		Rolled_back_to:     rolledBackTo,
+	}
+	claim := tx.Model(&Learning_Material{}).
+		Where("learning_material_id = ? AND COALESCE(revision, 0) = ?", material.LearningmaterialID, material.Revision).
+		Update("revision", revision.Revision)
+	if claim.Error != nil {
+		return revision, claim.Error
+	}
+	if claim.RowsAffected == 0 {
+		return revision, errRevisionConflict
+	}
+	material.Revision = revision.Revision
+	return revision, tx.Create(&revision).Error
+}
+
+// baseMaterialRevision makes sure the lesson as it is now has a revision
+// before it is changed. Lessons written before revisions existed get one
+// with no author.
+func baseMaterialRevision(tx *gorm.DB, material *Learning_Material) error {
+	if material.Revision > 0 {
+		return nil
+	}
+	_, err := recordMaterialRevision(tx, material, "", "Content before revision history", 0)
+	return err
+}
+
+func findMaterialRevision(materialID uint, number string) (Learning_Material_Revision, error) {
+	var revision Learning_Material_Revision
+	err := db.Where("learningmaterial_id = ? AND revision = ?", materialID, number).First(&revision).Error
+	return revision, err
+}
+
+// splitLines splits text into lines for diffing, ignoring the final line
+// break and Windows line endings.
+func splitLines(text string) []string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.TrimSuffix(text, "\n")
+	if text == "" {
+		return []string{}
+	}
+	return strings.Split(text, "\n")
+}
+
+// diffLines computes a shortest line edit script from a to b with Myers'
+// algorithm. It reports false when the texts are longer than maxDiffLines
+// or need more than maxDiffEdits changes.
+func diffLines(a []string, b []string) ([]diffLine, bool) {
+	n, m := len(a), len(b)
+	limit := n + m
+	if limit == 0 {
+		return []diffLine{}, true
+	}
+	if limit > maxDiffLines {
+		return nil, false
+	}
+
+	// Each step of the trace only keeps the diagonals it can reach,
+	// -d..d, stored from index 0.
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	var trace [][]int
+	found := false
+	for d := 0; d <= limit && !found; d++ {
+		if d > maxDiffEdits {
+			return nil, false
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	// Walk back from the end, collecting the script in reverse.
+	var reversed []diffLine
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		var previousK int
+		if k == -d || (k != d && v[d+k-1] < v[d+k+1]) {
+			previousK = k + 1
+		} else {
+			previousK = k - 1
+		}
+		previousX := v[d+previousK]
+		previousY := previousX - previousK
+		for x > previousX && y > previousY {
+			reversed = append(reversed, diffLine{Op: " ", Text: a[x-1], Old_line: x, New_line: y})
+			x--
+			y--
+		}
+		if x == previousX {
+			reversed = append(reversed, diffLine{Op: "+", Text: b[y-1], New_line: y})
+			y--
+		} else {
+			reversed = append(reversed, diffLine{Op: "-", Text: a[x-1], Old_line: x})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		reversed = append(reversed, diffLine{Op: " ", Text: a[x-1], Old_line: x, New_line: y})
+		x--
+		y--
+	}
+
+	script := make([]diffLine, len(reversed))
+	for i, line := range reversed {
+		script[len(reversed)-1-i] = line
+	}
+	return script, true
+}
+
+// diffHunks groups an edit script into hunks of changes with diffContext
+// unchanged lines around them.
+func diffHunks(script []diffLine) []diffHunk {
+	hunks := []diffHunk{}
+	for i := 0; i < len(script); {
+		if script[i].Op == " " {
+			i++
+			continue
+		}
+
+		start := max(i-diffContext, 0)
+		end := i
+		for end < len(script) {
+			if script[end].Op != " " {
+				end++
+				continue
+			}
+			// Keep going while the next change is close enough to share
+			// context with this one.
+			next := end
+			for next < len(script) && script[next].Op == " " {
+				next++
+			}
+			if next == len(script) || next-end > 2*diffContext {
+				end = min(end+diffContext, len(script))
+				break
+			}
+			end = next
+		}
+
+		hunk := diffHunk{Lines: script[start:end]}
+		for _, line := range hunk.Lines {
+			if line.Op != "+" {
+				hunk.Old_lines++
+				if hunk.Old_start == 0 {
+					hunk.Old_start = line.Old_line
+				}
+			}
+			if line.Op != "-" {
+				hunk.New_lines++
+				if hunk.New_start == 0 {
+					hunk.New_start = line.New_line
+				}
+			}
+		}
+		hunks = append(hunks, hunk)
+		i = end
+	}
+	return hunks
+}
+
+func unifiedDiff(from int, to int, hunks []diffHunk) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- revision %d\n+++ revision %d\n", from, to)
+	for _, hunk := range hunks {
+		fmt.Fprintf(&b, "@@ -%d,%d +%d,%d @@\n", hunk.Old_start, hunk.Old_lines, hunk.New_start, hunk.New_lines)
+		for _, line := range hunk.Lines {
+			b.WriteString(line.Op + line.Text + "\n")
+		}
+	}
+	return b.String()
+}
+
+func getLearningMaterialRevisions(c *gin.Context) {
+	var material Learning_Material
+	if err := db.First(&material, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Learning Material not found"})
+		return
+	}
+
+	var revisions []Learning_Material_Revision
+	db.Where("learningmaterial_id = ?", material.LearningmaterialID).Order("revision").Find(&revisions)
+	c.JSON(http.StatusOK, revisions)
+}
+
+func getLearningMaterialRevision(c *gin.Context) {
+	var material Learning_Material
+	if err := db.First(&material, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Learning Material not found"})
+		return
+	}
+
+	revision, err := findMaterialRevision(material.LearningmaterialID, c.Param("revision"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Revision not found"})
+		return
+	}
+	c.JSON(http.StatusOK, revision)
+}
+
+// diffLearningMaterial compares the content of two revisions, ?from and
+// ?to. to defaults to the latest revision and from to the one before it.
+func diffLearningMaterial(c *gin.Context) {
+	var material Learning_Material
+	if err := db.First(&material, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Learning Material not found"})
+		return
+	}
+
+	to, err := strconv.Atoi(c.DefaultQuery("to", strconv.Itoa(material.Revision)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a revision number"})
+		return
+	}
+	from, err := strconv.Atoi(c.DefaultQuery("from", strconv.Itoa(to-1)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a revision number"})
+		return
+	}
+
+	old, err := findMaterialRevision(material.LearningmaterialID, strconv.Itoa(from))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Revision %d not found", from)})
+		return
+	}
+	current, err := findMaterialRevision(material.LearningmaterialID, strconv.Itoa(to))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Revision %d not found", to)})
+		return
+	}
+
+	script, ok := diffLines(splitLines(old.Content), splitLines(current.Content))
+	if !ok {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Revisions are too different to diff"})
+		return
+	}
+	added, removed := 0, 0
+	for _, line := range script {
+		switch line.Op {
+		case "+":
+			added++
+		case "-":
+			removed++
+		}
+	}
+	hunks := diffHunks(script)
+
+	c.JSON(http.StatusOK, gin.H{
+		"learning_material_id": material.LearningmaterialID,
+		"from":                 from,
+		"to":                   to,
+		"title_changed":        old.Title != current.Title,
+		"format_changed":       old.Content_format != current.Content_format,
+		"lines_added":          added,
+		"lines_removed":        removed,
+		"hunks":                hunks,
+		"unified":              unifiedDiff(from, to, hunks),
+	})
+}
+
+// rollbackLearningMaterial restores the text of an earlier revision. The
+// restored text becomes a new revision, so the rollback itself can be
+// undone.
+func rollbackLearningMaterial(c *gin.Context) {
+	var material Learning_Material
+	if err := db.First(&material, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Learning Material not found"})
+		return
+	}
+
+	var input struct {
+		Revision int    `json:"revision"`
+		Author   string `json:"author"`
+		Message  string `json:"message"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	target, err := findMaterialRevision(material.LearningmaterialID, strconv.Itoa(input.Revision))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Revision not found"})
+		return
+	}
+
+	if target.Revision == material.Revision {
+		c.JSON(http.StatusConflict, gin.H{"error": "Learning Material is already at that revision"})
+		return
+	}
+
+	message := strings.TrimSpace(input.Message)
+	if message == "" {
+		message = fmt.Sprintf("Rolled back to revision %d", target.Revision)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := baseMaterialRevision(tx, &material); err != nil {
+			return err
+		}
+
+		material.Title, material.Content, material.Content_format = target.Title, target.Content, target.Content_format
+		if _, err := renderMaterial(&material); err != nil {
+			return err
+		}
+		err := tx.Model(&material).Updates(map[string]interface{}{
+			"title":            material.Title,
+			"content":          material.Content,
+			"content_format":   material.Content_format,
+			"rendered_content": material.Rendered_content,
+			"rendered_hash":    material.Rendered_hash,
+			"updated_by":       strings.TrimSpace(input.Author),
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		_, err = recordMaterialRevision(tx, &material, strings.TrimSpace(input.Author), message, target.Revision)
+		return err
+	})
+	if errors.Is(err, errRevisionConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Learning Material was changed at the same time, reload it and try again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to roll back learning material"})
+		return
+	}
+
+	c.JSON(http.StatusOK, material)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	notificationWaitlisted = "waitlisted"
+	notificationPromoted   = "promoted"
+)
+
+type Notification struct {
+	gorm.Model
+	NotificationID uint       `gorm:"column:notification_id;primaryKey;autoIncrement;unique" json:"notification_id"`
+	StudentID      uint       `gorm:"index" json:"student_id"`
+	SubjectID      uint       `json:"subject_id"`
+	Kind           string     `json:"kind"`
+	Message        string     `json:"message"`
+	Read_at        *time.Time `json:"read_at"`
+}
+
+func notifyStudent(tx *gorm.DB, studentID uint, subjectID uint, kind string, message string) error {
+	return tx.Create(&Notification{StudentID: studentID, SubjectID: subjectID, Kind: kind, Message: message}).Error
+}
+
+// getNotificationsByStudentID lists the student's notifications, newest
+// first. ?unread=true leaves out the ones already read.
+func getNotificationsByStudentID(c *gin.Context) {
+	var student Student
+	if err := db.First(&student, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Student not found"})
+		return
+	}
+
+	query := db.Where("student_id = ?", student.StudentID)
+	if c.Query("unread") == "true" {
+		query = query.Where("read_at IS NULL")
+	}
+
+	var notifications []Notification
+	query.Order("created_at DESC, notification_id DESC").Find(&notifications)
+	c.JSON(http.StatusOK, notifications)
+}
+
+func readNotification(c *gin.Context) {
+	var notification Notification
+	if err := db.First(&notification, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+		return
+	}
+
+	if notification.Read_at == nil {
+		now := time.Now()
+		notification.Read_at = &now
+		db.Model(&notification).Update("read_at", now)
+	}
+
+	c.JSON(http.StatusOK, notification)
+}
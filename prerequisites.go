@@ -0,0 +1,473 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Subject_Prerequisite is one edge of the curriculum graph. A subject's
+// prerequisites are groups: every group must be satisfied and a group is
+// satisfied by completing any one subject in it, so [[1], [2, 3]] reads
+// "1 and (2 or 3)". Subject.PrerequisiteID mirrors the graph when it is a
+// single prerequisite, for clients that predate groups.
+type Subject_Prerequisite struct {
+	gorm.Model
+	SubjectprerequisiteID uint `gorm:"column:subject_prerequisite_id;primaryKey;autoIncrement;unique" json:"subject_prerequisite_id"`
+	SubjectID             uint `gorm:"index" json:"subject_id"`
+	Group_number          int  `json:"group"`
+	PrerequisiteID        uint `json:"prerequisite_id"`
+}
+
+// missingPrerequisite describes a prerequisite the student has not passed
+// yet, with their best score so far. Completing any one prerequisite of a
+// group satisfies the whole group.
+type missingPrerequisite struct {
+	Group         int    `json:"group"`
+	SubjectID     uint   `json:"subject_id"`
+	Subject_name  string `json:"subject_name"`
+	Best_score    *int   `json:"best_score"`
+	Passing_score int    `json:"passing_score"`
+}
+
+type curriculumEntry struct {
+	Position      int      `json:"position"`
+	Level         int      `json:"level"`
+	SubjectID     uint     `json:"subject_id"`
+	Subject_name  string   `json:"subject_name"`
+	InterestID    uint     `json:"interest_id"`
+	External      bool     `json:"external"`
+	Prerequisites [][]uint `json:"prerequisites"`
+	// Cyclic marks a subject that is on a prerequisite cycle, or depends on
+	// one, and so cannot be put in order.
+	Cyclic bool `json:"cyclic,omitempty"`
+}
+
+// prerequisiteGraph returns the prerequisite groups of the given subjects,
+// or of every subject when none are given.
+func prerequisiteGraph(tx *gorm.DB, subjectIDs ...uint) map[uint][][]uint {
+	query := tx.Order("subject_id, group_number, prerequisite_id")
+	if len(subjectIDs) > 0 {
+		query = query.Where("subject_id IN ?", subjectIDs)
+	}
+
+	var rows []Subject_Prerequisite
+	query.Find(&rows)
+
+	graph := map[uint][][]uint{}
+	groupIndex := map[uint]map[int]int{}
+	for _, row := range rows {
+		if groupIndex[row.SubjectID] == nil {
+			groupIndex[row.SubjectID] = map[int]int{}
+		}
+		index, ok := groupIndex[row.SubjectID][row.Group_number]
+		if !ok {
+			index = len(graph[row.SubjectID])
+			groupIndex[row.SubjectID][row.Group_number] = index
+			graph[row.SubjectID] = append(graph[row.SubjectID], nil)
+		}
+		graph[row.SubjectID][index] = append(graph[row.SubjectID][index], row.PrerequisiteID)
+	}
+	return graph
+}
+
+// subjectPrerequisites returns the prerequisite groups of one subject.
+func subjectPrerequisites(subjectID uint) [][]uint {
+	if groups, ok := prerequisiteGraph(db, subjectID)[subjectID]; ok {
+		return groups
+	}
+	return [][]uint{}
+}
+
+// withPrerequisites fills in the prerequisite groups of subjects.
+func withPrerequisites(subjects []Subject) {
+	var ids []uint
+	for _, subject := range subjects {
+		ids = append(ids, subject.SubjectID)
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	graph := prerequisiteGraph(db, ids...)
+	for i := range subjects {
+		subjects[i].Prerequisites = graph[subjects[i].SubjectID]
+		if subjects[i].Prerequisites == nil {
+			subjects[i].Prerequisites = [][]uint{}
+		}
+	}
+}
+
+// normalizePrerequisites drops empty groups and duplicate subjects.
+func normalizePrerequisites(groups [][]uint) [][]uint {
+	normalized := [][]uint{}
+	for _, group := range groups {
+		seen := map[uint]bool{}
+		var ids []uint
+		for _, id := range group {
+			if id != 0 && !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) > 0 {
+			normalized = append(normalized, ids)
+		}
+	}
+	return normalized
+}
+
+// prerequisiteCycle returns the subjects of a cycle through subjectID if it
+// had the given prerequisite groups, starting and ending with subjectID, or
+// nil if there is none. The rest of the graph is acyclic because every write
+// is checked, so any new cycle has to pass through subjectID.
+func prerequisiteCycle(tx *gorm.DB, subjectID uint, groups [][]uint) []uint {
+	graph := prerequisiteGraph(tx)
+	graph[subjectID] = groups
+
+	visited := map[uint]bool{}
+	var path []uint
+	var visit func(id uint) bool
+	visit = func(id uint) bool {
+		path = append(path, id)
+		for _, group := range graph[id] {
+			for _, prerequisite := range group {
+				if prerequisite == subjectID {
+					path = append(path, subjectID)
+					return true
+				}
+				if !visited[prerequisite] {
+					visited[prerequisite] = true
+					if visit(prerequisite) {
+						return true
+					}
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+
+	if visit(subjectID) {
+		return path
+	}
+	return nil
+}
+
+// validatePrerequisites checks that every prerequisite exists and that the
+// groups do not make the curriculum cyclic. Edits of existing subjects run
+// it in tx after lockPrerequisiteSubjects.
+func validatePrerequisites(tx *gorm.DB, subjectID uint, groups [][]uint) (string, []uint) {
+	ids := map[uint]bool{}
+	for _, group := range groups {
+		for _, id := range group {
+			if id == subjectID {
+				return "A subject cannot be its own prerequisite", nil
+			}
+			ids[id] = true
+		}
+	}
+
+	var unique []uint
+	for id := range ids {
+		unique = append(unique, id)
+	}
+	if len(unique) > 0 {
+		var count int64
+		tx.Model(&Subject{}).Where("subject_id IN ?", unique).Count(&count)
+		if int(count) != len(unique) {
+			return "Prerequisite subject not found", nil
+		}
+	}
+
+	if subjectID != 0 {
+		if cycle := prerequisiteCycle(tx, subjectID, groups); cycle != nil {
+			return "Prerequisites would create a cycle", cycle
+		}
+	}
+	return "", nil
+}
+
+// prerequisiteError rejects prerequisite groups that name a missing subject
+// or would close a cycle, as found by validatePrerequisites.
+type prerequisiteError struct {
+	msg   string
+	cycle []uint
+}
+
+func (e *prerequisiteError) Error() string { return e.msg }
+
+// lockPrerequisiteSubjects locks subjectID and every subject its new groups
+// lead to, the way lockSubject does for seats. Two edits that only close a
+// cycle together each reach the subject the other edits, so the second one
+// waits and then sees the first edge. Waiting can reveal edges committed
+// meanwhile, so it locks again until no new subject is reached.
+func lockPrerequisiteSubjects(tx *gorm.DB, subjectID uint, groups [][]uint) error {
+	locked := map[uint]bool{}
+	for {
+		graph := prerequisiteGraph(tx)
+		graph[subjectID] = groups
+
+		var reached []uint
+		seen := map[uint]bool{subjectID: true}
+		queue := []uint{subjectID}
+		for len(queue) > 0 {
+			id := queue[0]
+			queue = queue[1:]
+			if !locked[id] {
+				reached = append(reached, id)
+			}
+			for _, group := range graph[id] {
+				for _, prerequisite := range group {
+					if !seen[prerequisite] {
+						seen[prerequisite] = true
+						queue = append(queue, prerequisite)
+					}
+				}
+			}
+		}
+		if len(reached) == 0 {
+			return nil
+		}
+
+		sort.Slice(reached, func(i, j int) bool { return reached[i] < reached[j] })
+		var subjects []Subject
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("subject_id IN ?", reached).Order("subject_id").Find(&subjects).Error; err != nil {
+			return err
+		}
+		for _, id := range reached {
+			locked[id] = true
+		}
+	}
+}
+
+// savePrerequisites replaces the prerequisite groups of subject.
+func savePrerequisites(tx *gorm.DB, subject *Subject, groups [][]uint) error {
+	if err := tx.Unscoped().Where("subject_id = ?", subject.SubjectID).Delete(&Subject_Prerequisite{}).Error; err != nil {
+		return err
+	}
+
+	var rows []Subject_Prerequisite
+	for number, group := range groups {
+		for _, id := range group {
+			rows = append(rows, Subject_Prerequisite{SubjectID: subject.SubjectID, Group_number: number + 1, PrerequisiteID: id})
+		}
+	}
+	if len(rows) > 0 {
+		if err := tx.Create(&rows).Error; err != nil {
+			return err
+		}
+	}
+
+	mirror := uint(0)
+	if len(groups) == 1 && len(groups[0]) == 1 {
+		mirror = groups[0][0]
+	}
+	subject.Prerequisites, subject.PrerequisiteID = groups, mirror
+	return tx.Model(subject).Update("prerequisite_id", mirror).Error
+}
+
+// migratePrerequisites moves single prerequisites set before the graph
+// existed into Subject_Prerequisite. Those were never checked, so edges to
+// missing subjects or that would close a cycle are logged and left out.
+func migratePrerequisites() {
+	var subjects []Subject
+	db.Where("prerequisite_id <> 0 AND subject_id NOT IN (?)", db.Model(&Subject_Prerequisite{}).Select("subject_id")).Order("subject_id").Find(&subjects)
+	for _, subject := range subjects {
+		groups := [][]uint{{subject.PrerequisiteID}}
+		if msg, cycle := validatePrerequisites(db, subject.SubjectID, groups); msg != "" {
+			log.Printf("Skipped prerequisite %d of subject %d: %s %v", subject.PrerequisiteID, subject.SubjectID, msg, cycle)
+			continue
+		}
+		db.Create(&Subject_Prerequisite{SubjectID: subject.SubjectID, Group_number: 1, PrerequisiteID: subject.PrerequisiteID})
+	}
+}
+
+// bestQuizScore returns the student's highest Quiz_Result score for a
+// subject, or nil if they have none.
+func bestQuizScore(studentID uint, subjectID uint) *int {
+	var results []Quiz_Result
+	db.Where("student_id = ? AND subject_id = ?", studentID, subjectID).Find(&results)
+	if len(results) == 0 {
+		return nil
+	}
+
+	best := results[0].Score
+	for _, result := range results[1:] {
+		if result.Score > best {
+			best = result.Score
+		}
+	}
+	return &best
+}
+
+// hasCompleted reports whether the student passed the subject's quiz.
+func hasCompleted(studentID uint, subjectID uint) bool {
+	best := bestQuizScore(studentID, subjectID)
+	return best != nil && *best >= quizPolicyFor(subjectID).Passing_score
+}
+
+// missingPrerequisites lists every subject of each prerequisite group of
+// subject that the student has not satisfied yet.
+func missingPrerequisites(studentID uint, subject Subject) []missingPrerequisite {
+	missing := []missingPrerequisite{}
+	for number, group := range subjectPrerequisites(subject.SubjectID) {
+		satisfied := false
+		for _, id := range group {
+			if hasCompleted(studentID, id) {
+				satisfied = true
+				break
+			}
+		}
+		if satisfied {
+			continue
+		}
+
+		var prerequisites []Subject
+		db.Where("subject_id IN ?", group).Order("subject_id").Find(&prerequisites)
+		for _, prerequisite := range prerequisites {
+			missing = append(missing, missingPrerequisite{
+				Group:         number + 1,
+				SubjectID:     prerequisite.SubjectID,
+				Subject_name:  prerequisite.Subject_name,
+				Best_score:    bestQuizScore(studentID, prerequisite.SubjectID),
+				Passing_score: quizPolicyFor(prerequisite.SubjectID).Passing_score,
+			})
+		}
+	}
+	return missing
+}
+
+func prerequisiteIDs(missing []missingPrerequisite) string {
+	var ids []string
+	for _, prerequisite := range missing {
+		ids = append(ids, strconv.FormatUint(uint64(prerequisite.SubjectID), 10))
+	}
+	return strings.Join(ids, ",")
+}
+
+// getInterestCurriculum returns the subjects of an interest in an order a
+// student can take them: every subject comes after all its prerequisites.
+// Prerequisites from other interests are included and marked external.
+// Level is the length of the longest prerequisite chain below a subject.
+// Subjects caught in a prerequisite cycle come last, marked cyclic.
+func getInterestCurriculum(c *gin.Context) {
+	var interest Interest
+	if err := db.First(&interest, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Interest not found"})
+		return
+	}
+
+	var subjects []Subject
+	db.Where("interest_id = ?", interest.InterestID).Find(&subjects)
+
+	graph := prerequisiteGraph(db)
+	byID := map[uint]Subject{}
+	var pending []uint
+	for _, subject := range subjects {
+		byID[subject.SubjectID] = subject
+		pending = append(pending, subject.SubjectID)
+	}
+
+	// Pull in prerequisites from other interests.
+	for len(pending) > 0 {
+		var next []uint
+		for _, id := range pending {
+			for _, group := range graph[id] {
+				for _, prerequisite := range group {
+					if _, ok := byID[prerequisite]; !ok {
+						byID[prerequisite] = Subject{}
+						next = append(next, prerequisite)
+					}
+				}
+			}
+		}
+		if len(next) > 0 {
+			var external []Subject
+			db.Where("subject_id IN ?", next).Find(&external)
+			for _, subject := range external {
+				byID[subject.SubjectID] = subject
+			}
+		}
+		pending = next
+	}
+
+	// Kahn's algorithm, taking the lowest subject ID first so the order is
+	// stable.
+	remaining := map[uint]int{}
+	dependents := map[uint][]uint{}
+	var ready []uint
+	for id := range byID {
+		prerequisites := map[uint]bool{}
+		for _, group := range graph[id] {
+			for _, prerequisite := range group {
+				prerequisites[prerequisite] = true
+			}
+		}
+		remaining[id] = len(prerequisites)
+		for prerequisite := range prerequisites {
+			dependents[prerequisite] = append(dependents[prerequisite], id)
+		}
+		if len(prerequisites) == 0 {
+			ready = append(ready, id)
+		}
+	}
+
+	levels := map[uint]int{}
+	curriculum := []curriculumEntry{}
+	for len(ready) > 0 {
+		sort.Slice(ready, func(i, j int) bool { return ready[i] < ready[j] })
+		id := ready[0]
+		ready = ready[1:]
+
+		curriculum = append(curriculum, newCurriculumEntry(interest, byID[id], id, graph, levels[id], len(curriculum)+1))
+		for _, dependent := range dependents[id] {
+			if levels[id]+1 > levels[dependent] {
+				levels[dependent] = levels[id] + 1
+			}
+			remaining[dependent]--
+			if remaining[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	// Whatever is left waits on a cycle. Those come from prerequisites set
+	// before cycles were checked.
+	var cyclic []uint
+	for id, count := range remaining {
+		if count > 0 {
+			cyclic = append(cyclic, id)
+		}
+	}
+	sort.Slice(cyclic, func(i, j int) bool { return cyclic[i] < cyclic[j] })
+	for _, id := range cyclic {
+		entry := newCurriculumEntry(interest, byID[id], id, graph, levels[id], len(curriculum)+1)
+		entry.Cyclic = true
+		curriculum = append(curriculum, entry)
+	}
+
+	c.JSON(http.StatusOK, curriculum)
+}
+
+func newCurriculumEntry(interest Interest, subject Subject, id uint, graph map[uint][][]uint, level int, position int) curriculumEntry {
+	prerequisites := graph[id]
+	if prerequisites == nil {
+		prerequisites = [][]uint{}
+	}
+	return curriculumEntry{
+		Position:      position,
+		Level:         level,
+		SubjectID:     id,
+		Subject_name:  subject.Subject_name,
+		InterestID:    subject.InterestID,
+		External:      subject.InterestID != interest.InterestID,
+		Prerequisites: prerequisites,
+	}
+}
@@ -0,0 +1,961 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	formatGIFT  = "gift"
+	formatAiken = "aiken"
+	formatQTI   = "qti"
+)
+
+// bankQuestion is the format-neutral shape every importer produces and every
+// exporter consumes.
+type bankQuestion struct {
+	Number int          `json:"number"`
+	Title  string       `json:"title,omitempty"`
+	Text   string       `json:"question"`
+	Type   string       `json:"question_type"`
+	Spec   questionSpec `json:"spec"`
+}
+
+func optionLetter(index int) string {
+	return string(rune('a' + index))
+}
+
+func optionIndex(letter string) int {
+	letter = strings.ToLower(strings.TrimSpace(letter))
+	if len(letter) != 1 || letter[0] < 'a' || letter[0] > 'z' {
+		return -1
+	}
+	return int(letter[0] - 'a')
+}
+
+func quizToBankQuestion(quiz Quiz, number int) bankQuestion {
+	return bankQuestion{Number: number, Text: quiz.Question, Type: normalizeQuestionType(quiz.Question_type), Spec: quizSpec(quiz)}
+}
+
+func placementTestToBankQuestion(placementTest Placement_Test, number int) bankQuestion {
+	return bankQuestion{Number: number, Text: placementTest.Question, Type: normalizeQuestionType(placementTest.Question_type), Spec: placementTestSpec(placementTest)}
+}
+
+// bankQuestionToQuiz keeps four-option single choice questions in the option
+// columns and stores everything else in Spec.
+func bankQuestionToQuiz(q bankQuestion, subjectID uint) Quiz {
+	quiz := Quiz{SubjectID: subjectID, Question: q.Text, Question_type: q.Type}
+	if q.Type == questionSingleChoice && len(q.Spec.Options) == 4 && len(q.Spec.Correct) == 1 {
+		quiz.Option_a, quiz.Option_b, quiz.Option_c, quiz.Option_d = q.Spec.Options[0], q.Spec.Options[1], q.Spec.Options[2], q.Spec.Options[3]
+		quiz.Correct_answer = q.Spec.Correct[0]
+		return quiz
+	}
+	spec := q.Spec
+	quiz.Spec = &spec
+	quiz.Correct_answer = correctAnswerSummary(q.Type, spec)
+	return quiz
+}
+
+func bankQuestionToPlacementTest(q bankQuestion, interestID uint) Placement_Test {
+	placementTest := Placement_Test{InterestID: interestID, Question: q.Text, Question_type: q.Type}
+	if q.Type == questionSingleChoice && len(q.Spec.Options) == 4 && len(q.Spec.Correct) == 1 {
+		placementTest.Option_a, placementTest.Option_b, placementTest.Option_c, placementTest.Option_d = q.Spec.Options[0], q.Spec.Options[1], q.Spec.Options[2], q.Spec.Options[3]
+		placementTest.Correct_answer = q.Spec.Correct[0]
+		return placementTest
+	}
+	spec := q.Spec
+	placementTest.Spec = &spec
+	placementTest.Correct_answer = correctAnswerSummary(q.Type, spec)
+	return placementTest
+}
+
+// exportableTypes lists which question types each format can express.
+var exportableTypes = map[string]map[string]bool{
+	formatAiken: {questionSingleChoice: true},
+	formatGIFT: {
+		questionSingleChoice: true, questionMultipleSelect: true, questionTrueFalse: true,
+		questionNumeric: true, questionShortText: true, questionMatching: true,
+	},
+	formatQTI: {
+		questionSingleChoice: true, questionMultipleSelect: true, questionTrueFalse: true, questionOrdering: true,
+	},
+}
+
+// ===== Aiken =====
+
+var (
+	aikenOptionRe = regexp.MustCompile(`^([A-Za-z])[.)]\s+(.*)$`)
+	aikenAnswerRe = regexp.MustCompile(`^ANSWER:\s*([A-Za-z])\s*$`)
+)
+
+func parseAiken(text string) ([]bankQuestion, []string) {
+	var questions []bankQuestion
+	var warnings []string
+
+	current := bankQuestion{Type: questionSingleChoice}
+	var questionLines []string
+
+	flush := func(withAnswer bool) {
+		if len(questionLines) == 0 && len(current.Spec.Options) == 0 {
+			return
+		}
+		current.Number = len(questions) + len(warnings) + 1
+		current.Text = strings.Join(questionLines, " ")
+		if !withAnswer {
+			warnings = append(warnings, fmt.Sprintf("question %d: missing ANSWER line", current.Number))
+		} else {
+			questions = append(questions, current)
+		}
+		current = bankQuestion{Type: questionSingleChoice}
+		questionLines = nil
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if m := aikenAnswerRe.FindStringSubmatch(line); m != nil {
+			current.Spec.Correct = []string{strings.ToLower(m[1])}
+			flush(true)
+			continue
+		}
+
+		if m := aikenOptionRe.FindStringSubmatch(line); m != nil && len(questionLines) > 0 {
+			current.Spec.Options = append(current.Spec.Options, m[2])
+			continue
+		}
+
+		if len(current.Spec.Options) > 0 {
+			// A new question started before the previous one got its answer.
+			flush(false)
+		}
+		questionLines = append(questionLines, line)
+	}
+	flush(false)
+
+	return questions, warnings
+}
+
+// stickyWriter keeps the first write error so the text writers can check it
+// once at the end instead of after every Fprintf.
+type stickyWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (s *stickyWriter) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	n, err := s.w.Write(p)
+	s.err = err
+	return n, err
+}
+
+func writeAiken(out io.Writer, questions []bankQuestion) error {
+	w := &stickyWriter{w: out}
+	for _, q := range questions {
+		fmt.Fprintln(w, singleLine(q.Text))
+		for i, option := range q.Spec.Options {
+			fmt.Fprintf(w, "%s. %s\n", strings.ToUpper(optionLetter(i)), singleLine(option))
+		}
+		fmt.Fprintf(w, "ANSWER: %s\n\n", strings.ToUpper(strings.Join(q.Spec.Correct, "")))
+	}
+	return w.err
+}
+
+func singleLine(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// ===== GIFT =====
+
+const giftSpecial = `~=#{}:`
+
+// giftSplit splits text on any unescaped rune in seps, keeping the separator
+// at the start of each piece after the first.
+func giftSplit(text string, seps string) []string {
+	var parts []string
+	var current strings.Builder
+	escaped := false
+	for _, r := range text {
+		if escaped {
+			current.WriteRune('\\')
+			current.WriteRune(r)
+			escaped = false
+			continue
+		}
+		if r == '\\' {
+			escaped = true
+			continue
+		}
+		if strings.ContainsRune(seps, r) {
+			parts = append(parts, current.String())
+			current.Reset()
+		}
+		current.WriteRune(r)
+	}
+	parts = append(parts, current.String())
+	return parts
+}
+
+// giftIndex is strings.Index that skips backslash-escaped characters.
+func giftIndex(text string, substr string) int {
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' {
+			i++
+			continue
+		}
+		if strings.HasPrefix(text[i:], substr) {
+			return i
+		}
+	}
+	return -1
+}
+
+func giftUnescape(text string) string {
+	var out strings.Builder
+	escaped := false
+	for _, r := range text {
+		if escaped {
+			if r == 'n' {
+				out.WriteRune('\n')
+			} else {
+				out.WriteRune(r)
+			}
+			escaped = false
+			continue
+		}
+		if r == '\\' {
+			escaped = true
+			continue
+		}
+		out.WriteRune(r)
+	}
+	return strings.TrimSpace(out.String())
+}
+
+func giftEscape(text string) string {
+	var out strings.Builder
+	for _, r := range text {
+		if r == '\\' || strings.ContainsRune(giftSpecial, r) {
+			out.WriteRune('\\')
+		}
+		out.WriteRune(r)
+	}
+	return strings.ReplaceAll(out.String(), "\n", `\n`)
+}
+
+var giftFormatRe = regexp.MustCompile(`^\[(html|moodle|plain|markdown)\]`)
+
+func parseGIFT(text string) ([]bankQuestion, []string) {
+	var questions []bankQuestion
+	var warnings []string
+
+	var blocks []string
+	var block []string
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(line), "//") {
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			if len(block) > 0 {
+				blocks = append(blocks, strings.Join(block, "\n"))
+				block = nil
+			}
+			continue
+		}
+		block = append(block, line)
+	}
+	if len(block) > 0 {
+		blocks = append(blocks, strings.Join(block, "\n"))
+	}
+
+	number := 0
+	for _, b := range blocks {
+		if strings.HasPrefix(b, "$CATEGORY:") {
+			continue
+		}
+		number++
+
+		parts := giftSplit(b, "{}")
+		if len(parts) < 3 || !strings.HasPrefix(parts[1], "{") || !strings.HasPrefix(parts[2], "}") {
+			warnings = append(warnings, fmt.Sprintf("question %d: no answer block found", number))
+			continue
+		}
+
+		q := bankQuestion{Number: number}
+
+		stem := parts[0] + strings.TrimPrefix(strings.Join(parts[2:], ""), "}")
+		stem = strings.TrimSpace(stem)
+		if strings.HasPrefix(stem, "::") {
+			if end := giftIndex(stem[2:], "::"); end >= 0 {
+				q.Title = giftUnescape(stem[2 : 2+end])
+				stem = stem[2+end+2:]
+			}
+		}
+		stem = giftFormatRe.ReplaceAllString(strings.TrimSpace(stem), "")
+		q.Text = giftUnescape(stem)
+
+		var warning string
+		q.Type, q.Spec, warning = parseGIFTAnswers(strings.TrimSpace(strings.TrimPrefix(parts[1], "{")))
+		if warning != "" {
+			warnings = append(warnings, fmt.Sprintf("question %d: %s", number, warning))
+		}
+		if q.Type == "" {
+			continue
+		}
+		questions = append(questions, q)
+	}
+
+	return questions, warnings
+}
+
+type giftAnswer struct {
+	correct bool
+	weight  float64
+	text    string
+}
+
+// parseGIFTAnswers works out the question type from the contents of a GIFT
+// answer block. It returns an empty type when the question has to be
+// skipped, and a warning for anything that was dropped or not understood.
+func parseGIFTAnswers(block string) (string, questionSpec, string) {
+	var spec questionSpec
+
+	switch strings.ToUpper(block) {
+	case "T", "TRUE":
+		spec.Correct = []string{"true"}
+		return questionTrueFalse, spec, ""
+	case "F", "FALSE":
+		spec.Correct = []string{"false"}
+		return questionTrueFalse, spec, ""
+	case "":
+		return "", spec, "essay questions are not supported"
+	}
+
+	if strings.HasPrefix(block, "#") {
+		body := strings.TrimSpace(giftSplit(block[1:], "#")[0])
+		if giftIndex(body, "=") >= 0 {
+			return "", spec, "numeric questions with several answers are not supported"
+		}
+		var answer, tolerance float64
+		var err error
+		if low, high, found := strings.Cut(body, ".."); found {
+			var lo, hi float64
+			if lo, err = strconv.ParseFloat(strings.TrimSpace(low), 64); err == nil {
+				hi, err = strconv.ParseFloat(strings.TrimSpace(high), 64)
+			}
+			answer, tolerance = (lo+hi)/2, math.Abs(hi-lo)/2
+		} else {
+			value, margin, _ := strings.Cut(body, ":")
+			if answer, err = strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && margin != "" {
+				tolerance, err = strconv.ParseFloat(strings.TrimSpace(margin), 64)
+			}
+		}
+		if err != nil {
+			return "", spec, "could not read numeric answer " + body
+		}
+		spec.Answer = &answer
+		spec.Tolerance = tolerance
+		return questionNumeric, spec, ""
+	}
+
+	var answers []giftAnswer
+	matching := false
+	hasWrong := false
+	var warning string
+	for _, piece := range giftSplit(block, "=~") {
+		piece = strings.TrimSpace(piece)
+		if piece == "" {
+			continue
+		}
+		if piece[0] != '=' && piece[0] != '~' {
+			return "", spec, "unrecognised answer " + piece
+		}
+
+		answer := giftAnswer{correct: piece[0] == '='}
+		body := strings.TrimSpace(giftSplit(piece[1:], "#")[0])
+		if strings.HasPrefix(body, "%") {
+			if end := strings.Index(body[1:], "%"); end >= 0 {
+				answer.weight, _ = strconv.ParseFloat(body[1:end+1], 64)
+				body = body[end+2:]
+			}
+		} else if answer.correct {
+			answer.weight = 100
+		}
+		if giftIndex(body, "->") >= 0 {
+			matching = true
+		}
+		if !answer.correct {
+			hasWrong = true
+		}
+		answer.text = body
+		answers = append(answers, answer)
+	}
+
+	if matching {
+		seen := map[string]int{}
+		for _, answer := range answers {
+			arrow := giftIndex(answer.text, "->")
+			if !answer.correct || arrow < 0 {
+				return "", spec, "matching questions must only contain =prompt -> answer pairs"
+			}
+			prompt := giftUnescape(answer.text[:arrow])
+			option := giftUnescape(answer.text[arrow+2:])
+			index, ok := seen[option]
+			if !ok {
+				index = len(spec.Options)
+				seen[option] = index
+				spec.Options = append(spec.Options, option)
+			}
+			spec.Correct = append(spec.Correct, optionLetter(len(spec.Prompts))+"="+optionLetter(index))
+			spec.Prompts = append(spec.Prompts, prompt)
+		}
+		return questionMatching, spec, ""
+	}
+
+	if !hasWrong {
+		for _, answer := range answers {
+			if answer.weight != 100 {
+				warning = "partial credit for accepted answers is ignored"
+			}
+			spec.Correct = append(spec.Correct, giftUnescape(answer.text))
+		}
+		return questionShortText, spec, warning
+	}
+
+	for i, answer := range answers {
+		if answer.weight > 0 {
+			spec.Correct = append(spec.Correct, optionLetter(i))
+		}
+		spec.Options = append(spec.Options, giftUnescape(answer.text))
+	}
+	switch len(spec.Correct) {
+	case 0:
+		return "", spec, "no correct answer found"
+	case 1:
+		return questionSingleChoice, spec, ""
+	}
+	return questionMultipleSelect, spec, "answer weights were replaced by multiple select partial credit"
+}
+
+func writeGIFT(out io.Writer, questions []bankQuestion) error {
+	w := &stickyWriter{w: out}
+	for _, q := range questions {
+		title := q.Title
+		if title == "" {
+			title = "Q" + strconv.Itoa(q.Number)
+		}
+		fmt.Fprintf(w, "::%s:: %s {", giftEscape(title), giftEscape(q.Text))
+
+		switch q.Type {
+		case questionTrueFalse:
+			if len(q.Spec.Correct) == 1 && q.Spec.Correct[0] == "true" {
+				fmt.Fprint(w, "T")
+			} else {
+				fmt.Fprint(w, "F")
+			}
+		case questionNumeric:
+			answer := 0.0
+			if q.Spec.Answer != nil {
+				answer = *q.Spec.Answer
+			}
+			fmt.Fprintf(w, "#%g:%g", answer, q.Spec.Tolerance)
+		case questionShortText:
+			for _, accepted := range q.Spec.Correct {
+				fmt.Fprintf(w, "\n\t=%s", giftEscape(accepted))
+			}
+			fmt.Fprint(w, "\n")
+		case questionMatching:
+			pairs, _ := parseMatchingPairs(strings.Join(q.Spec.Correct, ","))
+			for i, prompt := range q.Spec.Prompts {
+				option := optionIndex(pairs[optionLetter(i)])
+				if option >= 0 && option < len(q.Spec.Options) {
+					fmt.Fprintf(w, "\n\t=%s -> %s", giftEscape(prompt), giftEscape(q.Spec.Options[option]))
+				}
+			}
+			fmt.Fprint(w, "\n")
+		case questionMultipleSelect:
+			weight := strconv.FormatFloat(math.Round(1e7/float64(len(q.Spec.Correct)))/1e5, 'f', -1, 64)
+			for i, option := range q.Spec.Options {
+				if slices.Contains(q.Spec.Correct, optionLetter(i)) {
+					fmt.Fprintf(w, "\n\t~%%%s%%%s", weight, giftEscape(option))
+				} else {
+					fmt.Fprintf(w, "\n\t~%%-100%%%s", giftEscape(option))
+				}
+			}
+			fmt.Fprint(w, "\n")
+		default:
+			for i, option := range q.Spec.Options {
+				marker := "~"
+				if slices.Contains(q.Spec.Correct, optionLetter(i)) {
+					marker = "="
+				}
+				fmt.Fprintf(w, "\n\t%s%s", marker, giftEscape(option))
+			}
+			fmt.Fprint(w, "\n")
+		}
+		fmt.Fprint(w, "}\n\n")
+	}
+	return w.err
+}
+
+// ===== IMS QTI 2.1 =====
+
+const qtiNamespace = "http://www.imsglobal.org/xsd/imsqti_v2p1"
+
+type qtiInner struct {
+	Inner string `xml:",innerxml"`
+}
+
+type qtiSimpleChoice struct {
+	Identifier string `xml:"identifier,attr"`
+	Inner      string `xml:",innerxml"`
+}
+
+type qtiAssessmentItem struct {
+	Identifier          string `xml:"identifier,attr"`
+	Title               string `xml:"title,attr"`
+	ResponseDeclaration []struct {
+		Identifier      string   `xml:"identifier,attr"`
+		Cardinality     string   `xml:"cardinality,attr"`
+		CorrectResponse []string `xml:"correctResponse>value"`
+	} `xml:"responseDeclaration"`
+	ItemBody struct {
+		Inner             string           `xml:",innerxml"`
+		ChoiceInteraction []qtiInteraction `xml:"choiceInteraction"`
+		OrderInteraction  []qtiInteraction `xml:"orderInteraction"`
+	} `xml:"itemBody"`
+}
+
+type qtiInteraction struct {
+	ResponseIdentifier string            `xml:"responseIdentifier,attr"`
+	Prompt             qtiInner          `xml:"prompt"`
+	SimpleChoices      []qtiSimpleChoice `xml:"simpleChoice"`
+}
+
+var xmlTagRe = regexp.MustCompile(`(?s)<[^>]*>`)
+var interactionRe = regexp.MustCompile(`(?s)<(\w+:)?(choice|order)Interaction\b.*?</(\w+:)?(choice|order)Interaction>`)
+
+func xmlText(inner string) string {
+	return singleLine(html.UnescapeString(xmlTagRe.ReplaceAllString(inner, " ")))
+}
+
+func qtiItemToBankQuestion(item qtiAssessmentItem, number int) (bankQuestion, string) {
+	q := bankQuestion{Number: number, Title: item.Title, Type: questionSingleChoice}
+
+	interactions := append(item.ItemBody.ChoiceInteraction, item.ItemBody.OrderInteraction...)
+	if len(interactions) != 1 {
+		return q, fmt.Sprintf("question %d (%s): expected exactly one choiceInteraction or orderInteraction", number, item.Identifier)
+	}
+	interaction := interactions[0]
+	if len(item.ItemBody.OrderInteraction) == 1 {
+		q.Type = questionOrdering
+	}
+
+	q.Text = xmlText(interaction.Prompt.Inner)
+	if q.Text == "" {
+		q.Text = xmlText(interactionRe.ReplaceAllString(item.ItemBody.Inner, ""))
+	}
+
+	var correct []string
+	for _, declaration := range item.ResponseDeclaration {
+		if declaration.Identifier != interaction.ResponseIdentifier {
+			continue
+		}
+		correct = declaration.CorrectResponse
+		if declaration.Cardinality == "multiple" && q.Type == questionSingleChoice {
+			q.Type = questionMultipleSelect
+		}
+	}
+
+	letters := map[string]string{}
+	for i, choice := range interaction.SimpleChoices {
+		letters[choice.Identifier] = optionLetter(i)
+		q.Spec.Options = append(q.Spec.Options, xmlText(choice.Inner))
+	}
+	for _, identifier := range correct {
+		letter, ok := letters[strings.TrimSpace(identifier)]
+		if !ok {
+			return q, fmt.Sprintf("question %d (%s): correct response %s is not a choice", number, item.Identifier, identifier)
+		}
+		q.Spec.Correct = append(q.Spec.Correct, letter)
+	}
+
+	// writeQTI exports true/false questions as a True/False choice.
+	if q.Type == questionSingleChoice && len(q.Spec.Options) == 2 && len(q.Spec.Correct) == 1 &&
+		strings.EqualFold(q.Spec.Options[0], "true") && strings.EqualFold(q.Spec.Options[1], "false") {
+		q.Type = questionTrueFalse
+		q.Spec = questionSpec{Correct: []string{strconv.FormatBool(q.Spec.Correct[0] == "a")}}
+	}
+
+	return q, ""
+}
+
+// parseQTI accepts a single assessmentItem document, several concatenated
+// items, or a zipped content package containing item files.
+func parseQTI(data []byte) ([]bankQuestion, []string) {
+	if bytes.HasPrefix(data, []byte("PK")) {
+		reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, []string{"invalid zip package: " + err.Error()}
+		}
+
+		var questions []bankQuestion
+		var warnings []string
+		// Entries are read with a shared budget so a small archive cannot
+		// unpack into more than an upload may hold.
+		remaining := int64(maxBulkBodySize)
+		for _, file := range reader.File {
+			if !strings.HasSuffix(strings.ToLower(file.Name), ".xml") || strings.HasSuffix(file.Name, "imsmanifest.xml") {
+				continue
+			}
+			rc, err := file.Open()
+			if err != nil {
+				warnings = append(warnings, file.Name+": "+err.Error())
+				continue
+			}
+			content, err := io.ReadAll(io.LimitReader(rc, remaining+1))
+			rc.Close()
+			if err != nil {
+				warnings = append(warnings, file.Name+": "+err.Error())
+				continue
+			}
+			if int64(len(content)) > remaining {
+				warnings = append(warnings, fmt.Sprintf("package is larger than %d MB unpacked, the rest was skipped", maxBulkBodySize>>20))
+				break
+			}
+			remaining -= int64(len(content))
+			qs, ws := parseQTIItems(content, len(questions)+len(warnings))
+			questions = append(questions, qs...)
+			warnings = append(warnings, ws...)
+		}
+		return questions, warnings
+	}
+
+	return parseQTIItems(data, 0)
+}
+
+func parseQTIItems(data []byte, offset int) ([]bankQuestion, []string) {
+	var questions []bankQuestion
+	var warnings []string
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	number := offset
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			warnings = append(warnings, "invalid XML: "+err.Error())
+			break
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "assessmentItem" {
+			continue
+		}
+
+		number++
+		var item qtiAssessmentItem
+		if err := decoder.DecodeElement(&item, &start); err != nil {
+			warnings = append(warnings, fmt.Sprintf("question %d: %v", number, err))
+			continue
+		}
+
+		q, warning := qtiItemToBankQuestion(item, number)
+		if warning != "" {
+			warnings = append(warnings, warning)
+			continue
+		}
+		questions = append(questions, q)
+	}
+
+	return questions, warnings
+}
+
+func qtiItemXML(q bankQuestion) []byte {
+	var b bytes.Buffer
+	esc := func(s string) string {
+		var out bytes.Buffer
+		xml.EscapeText(&out, []byte(s))
+		return out.String()
+	}
+
+	title := q.Title
+	if title == "" {
+		title = "Q" + strconv.Itoa(q.Number)
+	}
+
+	options, correct := q.Spec.Options, q.Spec.Correct
+	if q.Type == questionTrueFalse {
+		options = []string{"True", "False"}
+		correct = []string{"a"}
+		if len(q.Spec.Correct) == 1 && q.Spec.Correct[0] == "false" {
+			correct = []string{"b"}
+		}
+	}
+
+	cardinality, interaction, maxChoices := "single", "choiceInteraction", ` maxChoices="1"`
+	switch q.Type {
+	case questionMultipleSelect:
+		cardinality, maxChoices = "multiple", ` maxChoices="0"`
+	case questionOrdering:
+		cardinality, interaction, maxChoices = "ordered", "orderInteraction", ""
+	}
+
+	fmt.Fprintf(&b, `<?xml version="1.0" encoding="UTF-8"?>
+<assessmentItem xmlns="%s" identifier="item%d" title="%s" adaptive="false" timeDependent="false">
+  <responseDeclaration identifier="RESPONSE" cardinality="%s" baseType="identifier">
+    <correctResponse>
+`, qtiNamespace, q.Number, esc(title), cardinality)
+	for _, letter := range correct {
+		fmt.Fprintf(&b, "      <value>%s</value>\n", strings.ToUpper(letter))
+	}
+	fmt.Fprintf(&b, `    </correctResponse>
+  </responseDeclaration>
+  <outcomeDeclaration identifier="SCORE" cardinality="single" baseType="float"/>
+  <itemBody>
+    <%s responseIdentifier="RESPONSE" shuffle="false"%s>
+      <prompt>%s</prompt>
+`, interaction, maxChoices, esc(q.Text))
+	for i, option := range options {
+		fmt.Fprintf(&b, "      <simpleChoice identifier=\"%s\">%s</simpleChoice>\n", strings.ToUpper(optionLetter(i)), esc(option))
+	}
+	fmt.Fprintf(&b, `    </%s>
+  </itemBody>
+  <responseProcessing template="http://www.imsglobal.org/question/qti_v2p1/rptemplates/match_correct"/>
+</assessmentItem>
+`, interaction)
+	return b.Bytes()
+}
+
+// writeQTI writes an IMS content package: one item file per question plus
+// the imsmanifest.xml that lists them.
+func writeQTI(w io.Writer, questions []bankQuestion) error {
+	archive := zip.NewWriter(w)
+
+	var manifest bytes.Buffer
+	manifest.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<manifest xmlns="http://www.imsglobal.org/xsd/imscp_v1p1" identifier="manifest">
+  <organizations/>
+  <resources>
+`)
+	for _, q := range questions {
+		name := fmt.Sprintf("item%d.xml", q.Number)
+		file, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(qtiItemXML(q)); err != nil {
+			return err
+		}
+		fmt.Fprintf(&manifest, "    <resource identifier=\"item%d\" type=\"imsqti_item_xmlv2p1\" href=\"%s\">\n      <file href=\"%s\"/>\n    </resource>\n", q.Number, name, name)
+	}
+	manifest.WriteString("  </resources>\n</manifest>\n")
+
+	file, err := archive.Create("imsmanifest.xml")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(manifest.Bytes()); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// ===== Handlers =====
+
+func parseQuestionBank(format string, data []byte) ([]bankQuestion, []string, bool) {
+	switch format {
+	case formatGIFT:
+		questions, warnings := parseGIFT(string(data))
+		return questions, warnings, true
+	case formatAiken:
+		questions, warnings := parseAiken(string(data))
+		return questions, warnings, true
+	case formatQTI:
+		questions, warnings := parseQTI(data)
+		return questions, warnings, true
+	}
+	return nil, nil, false
+}
+
+// writeQuestionBank skips questions the format cannot express and reports
+// how many were left out in the X-Skipped-Questions header. The file is
+// built before anything is sent so a failure can still be reported.
+func writeQuestionBank(c *gin.Context, format string, name string, all []bankQuestion) {
+	var write func(io.Writer, []bankQuestion) error
+	var filename, contentType string
+	switch format {
+	case formatGIFT:
+		write, filename, contentType = writeGIFT, name+".gift.txt", "text/plain; charset=utf-8"
+	case formatAiken:
+		write, filename, contentType = writeAiken, name+".aiken.txt", "text/plain; charset=utf-8"
+	case formatQTI:
+		write, filename, contentType = writeQTI, name+".qti.zip", "application/zip"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be gift, aiken or qti"})
+		return
+	}
+
+	var questions []bankQuestion
+	for _, q := range all {
+		if exportableTypes[format][q.Type] {
+			questions = append(questions, q)
+		}
+	}
+
+	var file bytes.Buffer
+	if err := write(&file, questions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export questions"})
+		return
+	}
+
+	c.Header("X-Skipped-Questions", strconv.Itoa(len(all)-len(questions)))
+	c.Header("Content-Disposition", "attachment; filename="+filename)
+	c.Data(http.StatusOK, contentType, file.Bytes())
+}
+
+// readQuestionBank parses the request body and drops questions that would
+// not pass validation, turning them into warnings instead.
+func readQuestionBank(c *gin.Context) ([]bankQuestion, []string, bool) {
+	data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBulkBodySize))
+	if err != nil {
+		rejectBulkBody(c, err)
+		return nil, nil, false
+	}
+
+	parsed, warnings, ok := parseQuestionBank(c.Query("format"), data)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be gift, aiken or qti"})
+		return nil, nil, false
+	}
+
+	questions := []bankQuestion{}
+	for _, q := range parsed {
+		if msg := validateQuestion(q.Type, q.Text, q.Spec); msg != "" {
+			warnings = append(warnings, fmt.Sprintf("question %d: %s", q.Number, msg))
+			continue
+		}
+		questions = append(questions, q)
+	}
+	if warnings == nil {
+		warnings = []string{}
+	}
+
+	return questions, warnings, true
+}
+
+func importQuizzes(c *gin.Context) {
+	var subject Subject
+	if err := db.First(&subject, c.Query("subject_id")).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Subject with that ID not found"})
+		return
+	}
+
+	questions, warnings, ok := readQuestionBank(c)
+	if !ok {
+		return
+	}
+
+	if c.Query("preview") == "true" {
+		c.JSON(http.StatusOK, gin.H{"questions": questions, "warnings": warnings})
+		return
+	}
+
+	var quizzes []Quiz
+	rowErrors := []bulkRowError{}
+	for _, q := range questions {
+		quiz := bankQuestionToQuiz(q, subject.SubjectID)
+		if msg := validateQuiz(quiz); msg != "" {
+			rowErrors = append(rowErrors, bulkRowError{Row: q.Number, Error: msg})
+		}
+		quizzes = append(quizzes, quiz)
+	}
+
+	insertBulk(c, bulkModeAtomic, quizzes, rowErrors, gin.H{"warnings": warnings})
+}
+
+func importPlacementTests(c *gin.Context) {
+	var interest Interest
+	if err := db.First(&interest, c.Query("interest_id")).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Interest with that ID not found"})
+		return
+	}
+
+	questions, warnings, ok := readQuestionBank(c)
+	if !ok {
+		return
+	}
+
+	if c.Query("preview") == "true" {
+		c.JSON(http.StatusOK, gin.H{"questions": questions, "warnings": warnings})
+		return
+	}
+
+	var placementTests []Placement_Test
+	rowErrors := []bulkRowError{}
+	for _, q := range questions {
+		placementTest := bankQuestionToPlacementTest(q, interest.InterestID)
+		if msg := validatePlacementTest(placementTest); msg != "" {
+			rowErrors = append(rowErrors, bulkRowError{Row: q.Number, Error: msg})
+		}
+		placementTests = append(placementTests, placementTest)
+	}
+
+	insertBulk(c, bulkModeAtomic, placementTests, rowErrors, gin.H{"warnings": warnings})
+}
+
+func exportQuizzes(c *gin.Context) {
+	var quizzes []Quiz
+	query := db.Order("quiz_id")
+	if subjectID := c.Query("subject_id"); subjectID != "" {
+		query = query.Where("subject_id = ?", subjectID)
+	}
+	query.Find(&quizzes)
+
+	var questions []bankQuestion
+	for i, quiz := range quizzes {
+		questions = append(questions, quizToBankQuestion(quiz, i+1))
+	}
+
+	writeQuestionBank(c, c.Query("format"), "quizzes", questions)
+}
+
+func exportPlacementTests(c *gin.Context) {
+	var placementTests []Placement_Test
+	query := db.Order("placement_test_id")
+	if interestID := c.Query("interest_id"); interestID != "" {
+		query = query.Where("interest_id = ?", interestID)
+	}
+	query.Find(&placementTests)
+
+	var questions []bankQuestion
+	for i, placementTest := range placementTests {
+		questions = append(questions, placementTestToBankQuestion(placementTest, i+1))
+	}
+
+	writeQuestionBank(c, c.Query("format"), "placement-tests", questions)
+}
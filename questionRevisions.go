@@ -0,0 +1,479 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Quiz_Revision is an immutable snapshot of a quiz as students saw it.
+// Every edit of a quiz adds a revision and answers point at the revision
+// they were given, so editing a question never changes how past answers
+// read or were graded. Quiz.Revision is the number of the latest snapshot,
+// which is 1 from the moment a quiz is created.
+type Quiz_Revision struct {
+	gorm.Model
+	QuizrevisionID uint          `gorm:"column:quiz_revision_id;primaryKey;autoIncrement;unique" json:"quiz_revision_id"`
+	QuizID         uint          `gorm:"uniqueIndex:idx_quiz_revision" json:"quiz_id"`
+	Revision       int           `gorm:"uniqueIndex:idx_quiz_revision" json:"revision"`
+	Question       string        `json:"question"`
+	Correct_answer string        `json:"correct_answer"`
+	Option_a       string        `json:"option_a"`
+	Option_b       string        `json:"option_b"`
+	Option_c       string        `json:"option_c"`
+	Option_d       string        `json:"option_d"`
+	Question_type  string        `json:"question_type"`
+	Spec           *questionSpec `json:"spec,omitempty"`
+}
+
+type Placement_Test_Revision struct {
+	gorm.Model
+	PlacementtestrevisionID uint          `gorm:"column:placement_test_revision_id;primaryKey;autoIncrement;unique" json:"placement_test_revision_id"`
+	PlacementtestID         uint          `gorm:"uniqueIndex:idx_placement_test_revision" json:"placement_test_id"`
+	Revision                int           `gorm:"uniqueIndex:idx_placement_test_revision" json:"revision"`
+	Question                string        `json:"question"`
+	Correct_answer          string        `json:"correct_answer"`
+	Option_a                string        `json:"option_a"`
+	Option_b                string        `json:"option_b"`
+	Option_c                string        `json:"option_c"`
+	Option_d                string        `json:"option_d"`
+	Question_type           string        `json:"question_type"`
+	Spec                    *questionSpec `json:"spec,omitempty"`
+}
+
+// Quiz_Regrade records an instructor applying a quiz's current answer key to
+// answers given against earlier revisions.
+type Quiz_Regrade struct {
+	gorm.Model
+	QuizregradeID     uint   `gorm:"column:quiz_regrade_id;primaryKey;autoIncrement;unique" json:"quiz_regrade_id"`
+	QuizID            uint   `json:"quiz_id"`
+	Revision          int    `json:"revision"`
+	Answers_changed   int    `json:"answers_changed"`
+	Attempts_rescored int    `json:"attempts_rescored"`
+	Reason            string `json:"reason"`
+}
+
+type Placement_Test_Regrade struct {
+	gorm.Model
+	PlacementtestregradeID uint   `gorm:"column:placement_test_regrade_id;primaryKey;autoIncrement;unique" json:"placement_test_regrade_id"`
+	PlacementtestID        uint   `json:"placement_test_id"`
+	Revision               int    `json:"revision"`
+	Answers_changed        int    `json:"answers_changed"`
+	Sessions_rescored      int    `json:"sessions_rescored"`
+	Reason                 string `json:"reason"`
+}
+
+type regradeChange struct {
+	AnswerID  uint    `json:"answer_id"`
+	StudentID uint    `json:"student_id"`
+	Revision  int     `json:"revision"`
+	Old_score float64 `json:"old_score"`
+	New_score float64 `json:"new_score"`
+}
+
+// recordQuizRevision snapshots quiz as its next revision.
+func recordQuizRevision(tx *gorm.DB, quiz *Quiz) (Quiz_Revision, error) {
+	revision := Quiz_Revision{
+		QuizID:         quiz.QuizID,
+		Revision:       quiz.Revision + 1,
+		Question:       quiz.Question,
+		Correct_answer: quiz.Correct_answer,
+		Option_a:       quiz.Option_a,
+		Option_b:       quiz.Option_b,
+		Option_c:       quiz.Option_c,
+		Option_d:       quiz.Option_d,
+		Question_type:  quiz.Question_type,
+		Spec:           quiz.Spec,
+	}
+	if err := tx.Create(&revision).Error; err != nil {
+		return revision, err
+	}
+	quiz.Revision = revision.Revision
+	return revision, tx.Model(quiz).Update("revision", revision.Revision).Error
+}
+
+// AfterCreate takes the first revision of a new quiz, however it was
+// created, so answering it never has to.
+func (quiz *Quiz) AfterCreate(tx *gorm.DB) error {
+	quiz.Revision = 0
+	_, err := recordQuizRevision(tx, quiz)
+	return err
+}
+
+// currentQuizRevision returns the snapshot matching the quiz as it is now,
+// taking one first if the quiz has none yet. When a concurrent request took
+// the same snapshot first, that one is returned.
+func currentQuizRevision(tx *gorm.DB, quiz *Quiz) (Quiz_Revision, error) {
+	var revision Quiz_Revision
+	if quiz.Revision > 0 {
+		tx.Where("quiz_id = ? AND revision = ?", quiz.QuizID, quiz.Revision).Limit(1).Find(&revision)
+		if revision.QuizrevisionID != 0 {
+			return revision, nil
+		}
+	}
+
+	// The savepoint keeps the caller's transaction usable after a unique
+	// violation on idx_quiz_revision.
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		var err error
+		revision, err = recordQuizRevision(tx, quiz)
+		return err
+	})
+	if err != nil {
+		revision = Quiz_Revision{}
+		tx.Where("quiz_id = ? AND revision = ?", quiz.QuizID, quiz.Revision+1).Limit(1).Find(&revision)
+		if revision.QuizrevisionID == 0 {
+			return revision, err
+		}
+		quiz.Revision = revision.Revision
+	}
+	return revision, nil
+}
+
+// applyQuizRevision replaces the question fields of quiz with those of an
+// earlier revision.
+func applyQuizRevision(quiz *Quiz, revision Quiz_Revision) {
+	quiz.Revision = revision.Revision
+	quiz.Question = revision.Question
+	quiz.Correct_answer = revision.Correct_answer
+	quiz.Option_a = revision.Option_a
+	quiz.Option_b = revision.Option_b
+	quiz.Option_c = revision.Option_c
+	quiz.Option_d = revision.Option_d
+	quiz.Question_type = revision.Question_type
+	quiz.Spec = revision.Spec
+}
+
+func recordPlacementTestRevision(tx *gorm.DB, placementTest *Placement_Test) (Placement_Test_Revision, error) {
+	revision := Placement_Test_Revision{
+		PlacementtestID: placementTest.PlacementtestID,
+		Revision:        placementTest.Revision + 1,
+		Question:        placementTest.Question,
+		Correct_answer:  placementTest.Correct_answer,
+		Option_a:        placementTest.Option_a,
+		Option_b:        placementTest.Option_b,
+		Option_c:        placementTest.Option_c,
+		Option_d:        placementTest.Option_d,
+		Question_type:   placementTest.Question_type,
+		Spec:            placementTest.Spec,
+	}
+	if err := tx.Create(&revision).Error; err != nil {
+		return revision, err
+	}
+	placementTest.Revision = revision.Revision
+	return revision, tx.Model(placementTest).Update("revision", revision.Revision).Error
+}
+
+func (placementTest *Placement_Test) AfterCreate(tx *gorm.DB) error {
+	placementTest.Revision = 0
+	_, err := recordPlacementTestRevision(tx, placementTest)
+	return err
+}
+
+func currentPlacementTestRevision(tx *gorm.DB, placementTest *Placement_Test) (Placement_Test_Revision, error) {
+	var revision Placement_Test_Revision
+	if placementTest.Revision > 0 {
+		tx.Where("placementtest_id = ? AND revision = ?", placementTest.PlacementtestID, placementTest.Revision).Limit(1).Find(&revision)
+		if revision.PlacementtestrevisionID != 0 {
+			return revision, nil
+		}
+	}
+
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		var err error
+		revision, err = recordPlacementTestRevision(tx, placementTest)
+		return err
+	})
+	if err != nil {
+		revision = Placement_Test_Revision{}
+		tx.Where("placementtest_id = ? AND revision = ?", placementTest.PlacementtestID, placementTest.Revision+1).Limit(1).Find(&revision)
+		if revision.PlacementtestrevisionID == 0 {
+			return revision, err
+		}
+		placementTest.Revision = revision.Revision
+	}
+	return revision, nil
+}
+
+// migrateQuestionRevisions takes the first revision of questions created
+// before revisions existed, and sets the revision of their answers to 0
+// where AutoMigrate left it NULL so include_unversioned regrades find them.
+func migrateQuestionRevisions() {
+	db.Model(&Quiz_Answer{}).Where("quizrevision_id IS NULL").Update("quizrevision_id", 0)
+	db.Model(&Placement_Test_Answer{}).Where("placementtestrevision_id IS NULL").Update("placementtestrevision_id", 0)
+
+	var quizzes []Quiz
+	db.Where("revision IS NULL OR revision = 0").Find(&quizzes)
+	for i := range quizzes {
+		if _, err := recordQuizRevision(db, &quizzes[i]); err != nil {
+			log.Println("Failed to record quiz revision:", err)
+		}
+	}
+
+	var placementTests []Placement_Test
+	db.Where("revision IS NULL OR revision = 0").Find(&placementTests)
+	for i := range placementTests {
+		if _, err := recordPlacementTestRevision(db, &placementTests[i]); err != nil {
+			log.Println("Failed to record placement test revision:", err)
+		}
+	}
+}
+
+func getQuizRevisions(c *gin.Context) {
+	var quiz Quiz
+	if err := db.First(&quiz, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quiz not found"})
+		return
+	}
+
+	var revisions []Quiz_Revision
+	db.Where("quiz_id = ?", quiz.QuizID).Order("revision").Find(&revisions)
+	c.JSON(http.StatusOK, revisions)
+}
+
+func getPlacementTestRevisions(c *gin.Context) {
+	var placementTest Placement_Test
+	if err := db.First(&placementTest, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Placement Test not found"})
+		return
+	}
+
+	var revisions []Placement_Test_Revision
+	db.Where("placementtest_id = ?", placementTest.PlacementtestID).Order("revision").Find(&revisions)
+	c.JSON(http.StatusOK, revisions)
+}
+
+// regradeInput selects which past answers a regrade applies the current
+// answer key to. Without revisions every earlier revision is included;
+// answers saved before revisions existed are only included on request.
+type regradeInput struct {
+	Revisions           []int  `json:"revisions"`
+	Include_unversioned bool   `json:"include_unversioned"`
+	Dry_run             bool   `json:"dry_run"`
+	Reason              string `json:"reason"`
+}
+
+// regradeRevisionIDs returns the IDs of the revisions input selects, given
+// every revision of the question keyed by ID. The current revision is never
+// selected because its answers were graded with the current key already.
+func regradeRevisionIDs(revisions map[uint]int, input regradeInput, current int) []uint {
+	selected := map[int]bool{}
+	for _, revision := range input.Revisions {
+		selected[revision] = true
+	}
+
+	ids := []uint{}
+	for id, revision := range revisions {
+		if revision == current {
+			continue
+		}
+		if len(input.Revisions) == 0 || selected[revision] {
+			ids = append(ids, id)
+		}
+	}
+	if input.Include_unversioned {
+		ids = append(ids, 0)
+	}
+	return ids
+}
+
+// regradeQuiz applies the quiz's current answer key to answers given
+// against earlier revisions. Nothing is regraded implicitly when a quiz is
+// edited; an instructor has to call this, and can preview the changes with
+// dry_run first. Finished attempts that contain a changed answer are
+// rescored and the student's Quiz_Result follows the score policy again.
+func regradeQuiz(c *gin.Context) {
+	var quiz Quiz
+	if err := db.First(&quiz, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quiz not found"})
+		return
+	}
+
+	var input regradeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	current, err := currentQuizRevision(db, &quiz)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record quiz revision"})
+		return
+	}
+
+	var revisions []Quiz_Revision
+	db.Where("quiz_id = ?", quiz.QuizID).Find(&revisions)
+	numbers := map[uint]int{}
+	for _, revision := range revisions {
+		numbers[revision.QuizrevisionID] = revision.Revision
+	}
+
+	var answers []Quiz_Answer
+	db.Where("quiz_id = ? AND quizrevision_id IN ?", quiz.QuizID, regradeRevisionIDs(numbers, input, current.Revision)).Find(&answers)
+
+	spec := quizSpec(quiz)
+	changes := []regradeChange{}
+	changed := map[uint]float64{}
+	attemptIDs := map[uint]bool{}
+	for _, answer := range answers {
+		score := gradeAnswer(quiz.Question_type, spec, answer.Student_answer)
+		if score == answer.Score {
+			continue
+		}
+		changes = append(changes, regradeChange{
+			AnswerID:  answer.QuizanswerID,
+			StudentID: answer.StudentID,
+			Revision:  numbers[answer.QuizrevisionID],
+			Old_score: answer.Score,
+			New_score: score,
+		})
+		changed[answer.QuizanswerID] = score
+		if answer.QuizattemptID != 0 {
+			attemptIDs[answer.QuizattemptID] = true
+		}
+	}
+
+	if input.Dry_run {
+		c.JSON(http.StatusOK, gin.H{"dry_run": true, "revision": current.Revision, "changes": changes})
+		return
+	}
+
+	regrade := Quiz_Regrade{QuizID: quiz.QuizID, Revision: current.Revision, Answers_changed: len(changes), Reason: input.Reason}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for id, score := range changed {
+			if err := tx.Model(&Quiz_Answer{}).Where("quiz_answer_id = ?", id).Update("score", score).Error; err != nil {
+				return err
+			}
+		}
+
+		for id := range attemptIDs {
+			var attempt Quiz_Attempt
+			tx.Where("quiz_attempt_id = ?", id).Limit(1).Find(&attempt)
+			if attempt.QuizattemptID == 0 || attempt.Status == attemptInProgress {
+				continue
+			}
+			score := attemptScore(tx, attempt)
+			if err := tx.Model(&attempt).Update("score", score).Error; err != nil {
+				return err
+			}
+			if err := saveCountedScore(tx, attempt.StudentID, attempt.SubjectID, time.Time{}); err != nil {
+				return err
+			}
+			regrade.Attempts_rescored++
+		}
+
+		return tx.Create(&regrade).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to regrade quiz"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"regrade": regrade, "changes": changes})
+}
+
+// regradePlacementTest applies the current answer key of a placement test
+// question to earlier answers. Finished adaptive sessions with a changed
+// answer get their ability estimate and Placement_Test_Result recomputed.
+func regradePlacementTest(c *gin.Context) {
+	var placementTest Placement_Test
+	if err := db.First(&placementTest, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Placement Test not found"})
+		return
+	}
+
+	var input regradeInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	current, err := currentPlacementTestRevision(db, &placementTest)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record placement test revision"})
+		return
+	}
+
+	var revisions []Placement_Test_Revision
+	db.Where("placementtest_id = ?", placementTest.PlacementtestID).Find(&revisions)
+	numbers := map[uint]int{}
+	for _, revision := range revisions {
+		numbers[revision.PlacementtestrevisionID] = revision.Revision
+	}
+
+	var answers []Placement_Test_Answer
+	db.Where("placementtest_id = ? AND placementtestrevision_id IN ?", placementTest.PlacementtestID, regradeRevisionIDs(numbers, input, current.Revision)).Find(&answers)
+
+	spec := placementTestSpec(placementTest)
+	changes := []regradeChange{}
+	changed := map[uint]float64{}
+	sessionIDs := map[uint]bool{}
+	for _, answer := range answers {
+		score := gradeAnswer(placementTest.Question_type, spec, answer.Student_answer)
+		if score == answer.Score {
+			continue
+		}
+		changes = append(changes, regradeChange{
+			AnswerID:  answer.PlacementtestanswerID,
+			StudentID: answer.StudentID,
+			Revision:  numbers[answer.PlacementtestrevisionID],
+			Old_score: answer.Score,
+			New_score: score,
+		})
+		changed[answer.PlacementtestanswerID] = score
+		if answer.PlacementsessionID != 0 {
+			sessionIDs[answer.PlacementsessionID] = true
+		}
+	}
+
+	if input.Dry_run {
+		c.JSON(http.StatusOK, gin.H{"dry_run": true, "revision": current.Revision, "changes": changes})
+		return
+	}
+
+	regrade := Placement_Test_Regrade{PlacementtestID: placementTest.PlacementtestID, Revision: current.Revision, Answers_changed: len(changes), Reason: input.Reason}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for id, score := range changed {
+			if err := tx.Model(&Placement_Test_Answer{}).Where("placement_test_answer_id = ?", id).Update("score", score).Error; err != nil {
+				return err
+			}
+		}
+
+		for id := range sessionIDs {
+			var session Placement_Session
+			tx.Where("placement_session_id = ?", id).Limit(1).Find(&session)
+			if session.PlacementsessionID == 0 || session.Status != sessionFinished {
+				continue
+			}
+
+			responses, _ := sessionResponses(tx, session)
+			ability, standardError := estimateAbility(responses)
+			correct := 0
+			for _, response := range responses {
+				if response.correct {
+					correct++
+				}
+			}
+
+			if err := tx.Model(&session).Updates(map[string]interface{}{"ability": ability, "standard_error": standardError}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&Placement_Test_Result{}).Where("placement_test_result_id = ?", session.PlacementtestresultID).
+				Updates(map[string]interface{}{"score": correct, "ability": ability, "standard_error": standardError}).Error; err != nil {
+				return err
+			}
+			regrade.Sessions_rescored++
+		}
+
+		return tx.Create(&regrade).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to regrade placement test"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"regrade": regrade, "changes": changes})
+}
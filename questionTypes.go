@@ -0,0 +1,400 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	questionSingleChoice   = "single_choice"
+	questionMultipleSelect = "multiple_select"
+	questionTrueFalse      = "true_false"
+	questionNumeric        = "numeric"
+	questionShortText      = "short_text"
+	questionOrdering       = "ordering"
+	questionMatching       = "matching"
+)
+
+// questionSpec holds everything needed to display and grade a question that
+// does not fit the four option columns. Four-option single choice questions
+// have no spec and keep using Option_a..Option_d and Correct_answer, so rows
+// created before question types existed need no conversion.
+//
+// Student answers are plain strings:
+//   - multiple_select: option letters, comma separated ("a,c")
+//   - true_false: "true" or "false"
+//   - numeric: a number
+//   - short_text: free text
+//   - ordering: option letters in the chosen order ("c,a,b")
+//   - matching: prompt=option letter pairs ("a=c,b=a")
+type questionSpec struct {
+	Options       []string `json:"options,omitempty"`
+	Prompts       []string `json:"prompts,omitempty"`
+	Correct       []string `json:"correct,omitempty"`
+	Answer        *float64 `json:"answer,omitempty"`
+	Tolerance     float64  `json:"tolerance,omitempty"`
+	CaseSensitive bool     `json:"case_sensitive,omitempty"`
+}
+
+// Value and Scan store the spec as a JSON text column.
+func (spec questionSpec) Value() (driver.Value, error) {
+	data, err := json.Marshal(spec)
+	return string(data), err
+}
+
+func (spec *questionSpec) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), spec)
+	case []byte:
+		return json.Unmarshal(v, spec)
+	case nil:
+		return nil
+	}
+	return errors.New("unsupported question spec value")
+}
+
+func (questionSpec) GormDataType() string {
+	return "text"
+}
+
+func isQuestionType(questionType string) bool {
+	switch questionType {
+	case questionSingleChoice, questionMultipleSelect, questionTrueFalse, questionNumeric,
+		questionShortText, questionOrdering, questionMatching:
+		return true
+	}
+	return false
+}
+
+func normalizeQuestionType(questionType string) string {
+	if questionType == "" {
+		return questionSingleChoice
+	}
+	return questionType
+}
+
+func fourOptionSpec(correctAnswer string, options ...string) questionSpec {
+	return questionSpec{
+		Options: options,
+		Correct: []string{strings.ToLower(strings.TrimSpace(correctAnswer))},
+	}
+}
+
+func quizSpec(quiz Quiz) questionSpec {
+	if quiz.Spec != nil {
+		return *quiz.Spec
+	}
+	return fourOptionSpec(quiz.Correct_answer, quiz.Option_a, quiz.Option_b, quiz.Option_c, quiz.Option_d)
+}
+
+func placementTestSpec(placementTest Placement_Test) questionSpec {
+	if placementTest.Spec != nil {
+		return *placementTest.Spec
+	}
+	return fourOptionSpec(placementTest.Correct_answer, placementTest.Option_a, placementTest.Option_b, placementTest.Option_c, placementTest.Option_d)
+}
+
+func validateQuiz(quiz Quiz) string {
+	questionType := normalizeQuestionType(quiz.Question_type)
+	if quiz.Spec != nil {
+		return validateQuestion(questionType, quiz.Question, *quiz.Spec)
+	}
+	if questionType != questionSingleChoice {
+		return "Spec is required for " + questionType + " questions"
+	}
+	return validateQuestionFields(quiz.Question, quiz.Correct_answer, quiz.Option_a, quiz.Option_b, quiz.Option_c, quiz.Option_d)
+}
+
+func validatePlacementTest(placementTest Placement_Test) string {
+	questionType := normalizeQuestionType(placementTest.Question_type)
+	if placementTest.Spec != nil {
+		return validateQuestion(questionType, placementTest.Question, *placementTest.Spec)
+	}
+	if questionType != questionSingleChoice {
+		return "Spec is required for " + questionType + " questions"
+	}
+	return validateQuestionFields(placementTest.Question, placementTest.Correct_answer, placementTest.Option_a, placementTest.Option_b, placementTest.Option_c, placementTest.Option_d)
+}
+
+// validateQuestion checks that spec is complete for questionType and that
+// every answer key it contains can actually be produced by a student.
+func validateQuestion(questionType string, question string, spec questionSpec) string {
+	if !isQuestionType(questionType) {
+		return "Unknown question type " + questionType
+	}
+	if strings.TrimSpace(question) == "" {
+		return "Question must not be empty"
+	}
+
+	letterInRange := func(letter string, count int) bool {
+		index := optionIndex(letter)
+		return index >= 0 && index < count
+	}
+
+	switch questionType {
+	case questionSingleChoice, questionMultipleSelect, questionOrdering:
+		if len(spec.Options) < 2 {
+			return "At least two options are required"
+		}
+		for i, option := range spec.Options {
+			if strings.TrimSpace(option) == "" {
+				return fmt.Sprintf("Option %s must not be empty", optionLetter(i))
+			}
+		}
+		if len(spec.Correct) == 0 {
+			return "At least one correct answer is required"
+		}
+		for _, letter := range spec.Correct {
+			if !letterInRange(letter, len(spec.Options)) {
+				return "Correct answer " + letter + " does not match an option"
+			}
+		}
+		if questionType == questionSingleChoice && len(spec.Correct) != 1 {
+			return "Single choice questions must have exactly one correct answer"
+		}
+		if questionType == questionOrdering && len(spec.Correct) != len(spec.Options) {
+			return "Ordering questions must list every option in the correct order"
+		}
+	case questionTrueFalse:
+		if len(spec.Correct) != 1 || !isTrueOrFalse(spec.Correct[0]) {
+			return "True/false questions must have correct set to [\"true\"] or [\"false\"]"
+		}
+	case questionNumeric:
+		if spec.Answer == nil {
+			return "Numeric questions must have an answer"
+		}
+		if spec.Tolerance < 0 {
+			return "Tolerance must not be negative"
+		}
+	case questionShortText:
+		if len(spec.Correct) == 0 {
+			return "Short text questions must have at least one accepted answer"
+		}
+	case questionMatching:
+		if len(spec.Prompts) == 0 || len(spec.Options) == 0 {
+			return "Matching questions need prompts and options"
+		}
+		pairs, ok := parseMatchingPairs(strings.Join(spec.Correct, ","))
+		if !ok || len(pairs) != len(spec.Prompts) {
+			return "Matching questions must pair every prompt with an option"
+		}
+		for prompt, option := range pairs {
+			if !letterInRange(prompt, len(spec.Prompts)) || !letterInRange(option, len(spec.Options)) {
+				return "Matching pair " + prompt + "=" + option + " is out of range"
+			}
+		}
+	}
+
+	return ""
+}
+
+// isTrueOrFalse reports whether key is "true" or "false" in any case.
+func isTrueOrFalse(key string) bool {
+	key = strings.TrimSpace(key)
+	return strings.EqualFold(key, "true") || strings.EqualFold(key, "false")
+}
+
+// normalizeAnswerKey lowercases and trims the option letters and true/false
+// values in spec.Correct. Validation accepts them in any case and grading
+// compares them lowercase. Short text answers keep their case.
+func normalizeAnswerKey(questionType string, spec *questionSpec) {
+	if normalizeQuestionType(questionType) == questionShortText {
+		return
+	}
+	for i, key := range spec.Correct {
+		spec.Correct[i] = strings.ToLower(strings.TrimSpace(key))
+	}
+}
+
+func splitLetters(answer string) []string {
+	var letters []string
+	for _, part := range strings.Split(answer, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part != "" {
+			letters = append(letters, part)
+		}
+	}
+	return letters
+}
+
+func parseMatchingPairs(answer string) (map[string]string, bool) {
+	pairs := map[string]string{}
+	for _, part := range splitLetters(answer) {
+		prompt, option, found := strings.Cut(part, "=")
+		if !found {
+			return nil, false
+		}
+		pairs[strings.TrimSpace(prompt)] = strings.TrimSpace(option)
+	}
+	return pairs, true
+}
+
+// gradeAnswer scores a student answer between 0 and 1. Multiple select,
+// ordering and matching give partial credit; the other types are all or
+// nothing.
+func gradeAnswer(questionType string, spec questionSpec, answer string) float64 {
+	switch normalizeQuestionType(questionType) {
+	case questionSingleChoice:
+		return gradeSingleChoice(spec, answer)
+	case questionMultipleSelect:
+		return gradeMultipleSelect(spec, answer)
+	case questionTrueFalse:
+		return gradeTrueFalse(spec, answer)
+	case questionNumeric:
+		return gradeNumeric(spec, answer)
+	case questionShortText:
+		return gradeShortText(spec, answer)
+	case questionOrdering:
+		return gradeOrdering(spec, answer)
+	case questionMatching:
+		return gradeMatching(spec, answer)
+	}
+	return 0
+}
+
+func gradeSingleChoice(spec questionSpec, answer string) float64 {
+	if len(spec.Correct) == 1 && strings.ToLower(strings.TrimSpace(answer)) == strings.ToLower(strings.TrimSpace(spec.Correct[0])) {
+		return 1
+	}
+	return 0
+}
+
+// gradeMultipleSelect gives credit for each correct letter chosen and takes
+// it away for each wrong one, so selecting everything scores zero.
+func gradeMultipleSelect(spec questionSpec, answer string) float64 {
+	if len(spec.Correct) == 0 {
+		return 0
+	}
+
+	correct := map[string]bool{}
+	for _, letter := range spec.Correct {
+		correct[strings.ToLower(letter)] = true
+	}
+
+	chosen := map[string]bool{}
+	for _, letter := range splitLetters(answer) {
+		chosen[letter] = true
+	}
+
+	hits, misses := 0, 0
+	for letter := range chosen {
+		if correct[letter] {
+			hits++
+		} else {
+			misses++
+		}
+	}
+
+	return math.Max(0, float64(hits-misses)/float64(len(correct)))
+}
+
+func gradeTrueFalse(spec questionSpec, answer string) float64 {
+	value, err := strconv.ParseBool(strings.TrimSpace(answer))
+	if err != nil || len(spec.Correct) != 1 {
+		return 0
+	}
+	if strconv.FormatBool(value) == strings.ToLower(strings.TrimSpace(spec.Correct[0])) {
+		return 1
+	}
+	return 0
+}
+
+func gradeNumeric(spec questionSpec, answer string) float64 {
+	value, err := strconv.ParseFloat(strings.TrimSpace(answer), 64)
+	if err != nil || spec.Answer == nil {
+		return 0
+	}
+	if math.Abs(value-*spec.Answer) <= spec.Tolerance {
+		return 1
+	}
+	return 0
+}
+
+func gradeShortText(spec questionSpec, answer string) float64 {
+	normalize := func(text string) string {
+		text = strings.Join(strings.Fields(text), " ")
+		if !spec.CaseSensitive {
+			text = strings.ToLower(text)
+		}
+		return text
+	}
+
+	given := normalize(answer)
+	for _, accepted := range spec.Correct {
+		if given == normalize(accepted) {
+			return 1
+		}
+	}
+	return 0
+}
+
+func gradeOrdering(spec questionSpec, answer string) float64 {
+	if len(spec.Correct) == 0 {
+		return 0
+	}
+
+	given := splitLetters(answer)
+	matched := 0
+	for i, letter := range spec.Correct {
+		if i < len(given) && given[i] == strings.ToLower(letter) {
+			matched++
+		}
+	}
+	return float64(matched) / float64(len(spec.Correct))
+}
+
+func gradeMatching(spec questionSpec, answer string) float64 {
+	correct, ok := parseMatchingPairs(strings.Join(spec.Correct, ","))
+	if !ok || len(correct) == 0 {
+		return 0
+	}
+
+	given, ok := parseMatchingPairs(answer)
+	if !ok {
+		return 0
+	}
+
+	matched := 0
+	for prompt, option := range correct {
+		if given[prompt] == option {
+			matched++
+		}
+	}
+	return float64(matched) / float64(len(correct))
+}
+
+// correctAnswerSummary renders the answer key of any question type as the
+// string a student would have to submit for full marks.
+func correctAnswerSummary(questionType string, spec questionSpec) string {
+	switch normalizeQuestionType(questionType) {
+	case questionNumeric:
+		if spec.Answer == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*spec.Answer, 'f', -1, 64)
+	case questionShortText:
+		if len(spec.Correct) == 0 {
+			return ""
+		}
+		return spec.Correct[0]
+	case questionMultipleSelect, questionMatching:
+		letters := append([]string(nil), spec.Correct...)
+		sort.Strings(letters)
+		return strings.Join(letters, ",")
+	}
+	return strings.Join(spec.Correct, ",")
+}
+
+// migrateQuestionTypes marks rows created before question types existed as
+// single choice. Their options and answer key stay in the original columns.
+func migrateQuestionTypes() {
+	db.Model(&Quiz{}).Where("question_type IS NULL OR question_type = ''").Update("question_type", questionSingleChoice)
+	db.Model(&Placement_Test{}).Where("question_type IS NULL OR question_type = ''").Update("question_type", questionSingleChoice)
+}
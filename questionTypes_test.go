@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestValidateTrueFalseAcceptsAnyCase(t *testing.T) {
+	for _, key := range []string{"true", "False", "TRUE", " false "} {
+		spec := questionSpec{Correct: []string{key}}
+		if msg := validateQuestion(questionTrueFalse, "Go has generics", spec); msg != "" {
+			t.Errorf("correct %q: %s", key, msg)
+		}
+		normalizeAnswerKey(questionTrueFalse, &spec)
+		if spec.Correct[0] != "true" && spec.Correct[0] != "false" {
+			t.Errorf("correct %q normalized to %q", key, spec.Correct[0])
+		}
+	}
+	for _, key := range []string{"yes", "", "truthy"} {
+		if msg := validateQuestion(questionTrueFalse, "Go has generics", questionSpec{Correct: []string{key}}); msg == "" {
+			t.Errorf("correct %q was accepted", key)
+		}
+	}
+}
@@ -0,0 +1,662 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	attemptInProgress    = "in_progress"
+	attemptSubmitted     = "submitted"
+	attemptAutoSubmitted = "auto_submitted"
+
+	scorePolicyHighest = "highest"
+	scorePolicyLatest  = "latest"
+	scorePolicyFirst   = "first"
+	scorePolicyAverage = "average"
+
+	defaultPassingScore = 60
+)
+
+type Quiz_Policy struct {
+	gorm.Model
+	QuizpolicyID       uint    `gorm:"column:quiz_policy_id;primaryKey;autoIncrement;unique" json:"quiz_policy_id"`
+	SubjectID          uint    `gorm:"uniqueIndex" json:"subject_id"`
+	Subject            Subject `gorm:"references:SubjectID"`
+	Time_limit_minutes int     `json:"time_limit_minutes"`
+	Max_attempts       int     `json:"max_attempts"`
+	Cooldown_minutes   int     `json:"cooldown_minutes"`
+	Score_policy       string  `json:"score_policy"`
+	Question_count     int     `json:"question_count"`
+	Shuffle_questions  bool    `json:"shuffle_questions"`
+	Shuffle_options    bool    `json:"shuffle_options"`
+	Passing_score      int     `json:"passing_score"`
+}
+
+type Quiz_Attempt struct {
+	gorm.Model
+	QuizattemptID  uint          `gorm:"column:quiz_attempt_id;primaryKey;autoIncrement;unique" json:"quiz_attempt_id"`
+	StudentID      uint          `json:"student_id"`
+	Student        Student       `gorm:"references:StudentID"`
+	SubjectID      uint          `json:"subject_id"`
+	Subject        Subject       `gorm:"references:SubjectID"`
+	Attempt_number int           `json:"attempt_number"`
+	Status         string        `json:"status"`
+	Started_at     time.Time     `json:"started_at"`
+	Deadline       *time.Time    `json:"deadline"`
+	Submitted_at   *time.Time    `json:"submitted_at"`
+	Score          int           `json:"score"`
+	Seed           int64         `json:"-"`
+	Answers        []Quiz_Answer `gorm:"-" json:"answers,omitempty"`
+}
+
+// quizPolicyFor returns the subject's policy, or the defaults (no time
+// limit, unlimited attempts, highest score counts, 60 passes) when none is
+// set.
+func quizPolicyFor(subjectID uint) Quiz_Policy {
+	policy := Quiz_Policy{SubjectID: subjectID, Score_policy: scorePolicyHighest}
+	db.Where("subject_id = ?", subjectID).Limit(1).Find(&policy)
+	if policy.Passing_score == 0 {
+		policy.Passing_score = defaultPassingScore
+	}
+	return policy
+}
+
+func isScorePolicy(policy string) bool {
+	switch policy {
+	case scorePolicyHighest, scorePolicyLatest, scorePolicyFirst, scorePolicyAverage:
+		return true
+	}
+	return false
+}
+
+func getQuizPolicy(c *gin.Context) {
+	var subject Subject
+	if err := db.First(&subject, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subject not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, quizPolicyFor(subject.SubjectID))
+}
+
+func updateQuizPolicy(c *gin.Context) {
+	var subject Subject
+	if err := db.First(&subject, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subject not found"})
+		return
+	}
+
+	var input struct {
+		Time_limit_minutes *int    `json:"time_limit_minutes"`
+		Max_attempts       *int    `json:"max_attempts"`
+		Cooldown_minutes   *int    `json:"cooldown_minutes"`
+		Score_policy       *string `json:"score_policy"`
+		Question_count     *int    `json:"question_count"`
+		Shuffle_questions  *bool   `json:"shuffle_questions"`
+		Shuffle_options    *bool   `json:"shuffle_options"`
+		Passing_score      *int    `json:"passing_score"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	policy := quizPolicyFor(subject.SubjectID)
+
+	if input.Time_limit_minutes != nil {
+		policy.Time_limit_minutes = *input.Time_limit_minutes
+	}
+	if input.Max_attempts != nil {
+		policy.Max_attempts = *input.Max_attempts
+	}
+	if input.Cooldown_minutes != nil {
+		policy.Cooldown_minutes = *input.Cooldown_minutes
+	}
+	if input.Score_policy != nil {
+		policy.Score_policy = *input.Score_policy
+	}
+	if input.Question_count != nil {
+		policy.Question_count = *input.Question_count
+	}
+	if input.Shuffle_questions != nil {
+		policy.Shuffle_questions = *input.Shuffle_questions
+	}
+	if input.Shuffle_options != nil {
+		policy.Shuffle_options = *input.Shuffle_options
+	}
+	if input.Passing_score != nil {
+		policy.Passing_score = *input.Passing_score
+	}
+
+	if policy.Time_limit_minutes < 0 || policy.Max_attempts < 0 || policy.Cooldown_minutes < 0 || policy.Question_count < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Time limit, max attempts, cooldown and question count must not be negative"})
+		return
+	}
+	if policy.Passing_score < 1 || policy.Passing_score > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Passing score must be between 1 and 100"})
+		return
+	}
+	if !isScorePolicy(policy.Score_policy) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Score policy must be highest, latest, first or average"})
+		return
+	}
+
+	db.Save(&policy)
+	c.JSON(http.StatusOK, policy)
+}
+
+// attemptQuizzes returns the questions an attempt is graded against, as
+// they read in the revision drawn for the attempt.
+func attemptQuizzes(attempt Quiz_Attempt) []Quiz {
+	var quizIDs, revisionIDs []uint
+	for _, question := range attemptQuestions(attempt) {
+		quizIDs = append(quizIDs, question.QuizID)
+		if question.QuizrevisionID != 0 {
+			revisionIDs = append(revisionIDs, question.QuizrevisionID)
+		}
+	}
+
+	var quizzes []Quiz
+	if len(quizIDs) > 0 {
+		db.Where("quiz_id IN ?", quizIDs).Find(&quizzes)
+	}
+
+	var revisions []Quiz_Revision
+	if len(revisionIDs) > 0 {
+		db.Where("quiz_revision_id IN ?", revisionIDs).Find(&revisions)
+	}
+	byQuiz := map[uint]Quiz_Revision{}
+	for _, revision := range revisions {
+		byQuiz[revision.QuizID] = revision
+	}
+	for i := range quizzes {
+		if revision, ok := byQuiz[quizzes[i].QuizID]; ok {
+			applyQuizRevision(&quizzes[i], revision)
+		}
+	}
+	return quizzes
+}
+
+func isExpired(attempt Quiz_Attempt, now time.Time) bool {
+	return attempt.Status == attemptInProgress && attempt.Deadline != nil && now.After(*attempt.Deadline)
+}
+
+// countedScore applies the subject's score policy to every finished attempt.
+func countedScore(attempts []Quiz_Attempt, scorePolicy string) int {
+	if len(attempts) == 0 {
+		return 0
+	}
+
+	switch scorePolicy {
+	case scorePolicyLatest:
+		return attempts[len(attempts)-1].Score
+	case scorePolicyFirst:
+		return attempts[0].Score
+	case scorePolicyAverage:
+		total := 0
+		for _, attempt := range attempts {
+			total += attempt.Score
+		}
+		return int(math.Round(float64(total) / float64(len(attempts))))
+	}
+
+	best := attempts[0].Score
+	for _, attempt := range attempts[1:] {
+		if attempt.Score > best {
+			best = attempt.Score
+		}
+	}
+	return best
+}
+
+// attemptScore turns the stored answer scores of an attempt into a
+// percentage. Each answer was graded against the revision the student saw.
+func attemptScore(tx *gorm.DB, attempt Quiz_Attempt) int {
+	var answers []Quiz_Answer
+	tx.Where("quizattempt_id = ?", attempt.QuizattemptID).Find(&answers)
+
+	byQuiz := map[uint]Quiz_Answer{}
+	for _, answer := range answers {
+		byQuiz[answer.QuizID] = answer
+	}
+
+	quizzes := attemptQuizzes(attempt)
+	total := 0.0
+	for _, quiz := range quizzes {
+		if answer, ok := byQuiz[quiz.QuizID]; ok {
+			total += answer.Score
+		}
+	}
+	if len(quizzes) == 0 {
+		return 0
+	}
+	return int(math.Round(100 * total / float64(len(quizzes))))
+}
+
+// saveCountedScore updates the student's single Quiz_Result for a subject
+// from all finished attempts. A zero quizDate keeps the recorded date.
+func saveCountedScore(tx *gorm.DB, studentID uint, subjectID uint, quizDate time.Time) error {
+	var finished []Quiz_Attempt
+	tx.Where("student_id = ? AND subject_id = ? AND status <> ?", studentID, subjectID, attemptInProgress).
+		Order("attempt_number").Find(&finished)
+	counted := countedScore(finished, quizPolicyFor(subjectID).Score_policy)
+
+	var quizResult Quiz_Result
+	tx.Where("student_id = ? AND subject_id = ?", studentID, subjectID).Limit(1).Find(&quizResult)
+	quizResult.StudentID, quizResult.SubjectID, quizResult.Score = studentID, subjectID, counted
+	if !quizDate.IsZero() {
+		quizResult.Quiz_date = quizDate
+	}
+	if err := tx.Save(&quizResult).Error; err != nil {
+		return err
+	}
+	return refreshStudentSubject(tx, studentID, subjectID)
+}
+
+// errAttemptSubmitted is returned by finishAttempt for an attempt that was
+// closed already, possibly by another request.
+var errAttemptSubmitted = errors.New("attempt is already submitted")
+
+// finishAttempt grades an in-progress attempt, closes it with status and
+// updates the student's Quiz_Result for the subject according to the score
+// policy. It fails with errAttemptSubmitted if the attempt was already
+// closed.
+func finishAttempt(attempt *Quiz_Attempt, status string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		score := attemptScore(tx, *attempt)
+
+		now := time.Now()
+		result := tx.Model(&Quiz_Attempt{}).
+			Where("quiz_attempt_id = ? AND status = ?", attempt.QuizattemptID, attemptInProgress).
+			Updates(map[string]interface{}{"status": status, "submitted_at": now, "score": score})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errAttemptSubmitted
+		}
+		attempt.Status, attempt.Submitted_at, attempt.Score = status, &now, score
+
+		return saveCountedScore(tx, attempt.StudentID, attempt.SubjectID, now)
+	})
+}
+
+// closeIfExpired auto-submits attempt if its deadline has passed. If
+// another request closed it first, attempt is reloaded to show that.
+func closeIfExpired(attempt *Quiz_Attempt, now time.Time) error {
+	if !isExpired(*attempt, now) {
+		return nil
+	}
+	err := finishAttempt(attempt, attemptAutoSubmitted)
+	if errors.Is(err, errAttemptSubmitted) {
+		return db.First(attempt, attempt.QuizattemptID).Error
+	}
+	return err
+}
+
+// loadAttempt fetches an attempt and auto-submits it first if its deadline
+// has passed, so callers always see the enforced state.
+func loadAttempt(c *gin.Context) (Quiz_Attempt, bool) {
+	var attempt Quiz_Attempt
+	if err := db.First(&attempt, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quiz Attempt not found"})
+		return attempt, false
+	}
+
+	if err := closeIfExpired(&attempt, time.Now()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit expired attempt"})
+		return attempt, false
+	}
+
+	return attempt, true
+}
+
+func startQuizAttempt(c *gin.Context) {
+	var input struct {
+		StudentID uint `json:"student_id"`
+		SubjectID uint `json:"subject_id"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var student Student
+	if err := db.First(&student, input.StudentID).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Student with that ID not found"})
+		return
+	}
+
+	var subject Subject
+	if err := db.First(&subject, input.SubjectID).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Subject with that ID not found"})
+		return
+	}
+
+	now := time.Now()
+
+	var open Quiz_Attempt
+	db.Where("student_id = ? AND subject_id = ? AND status = ?", input.StudentID, input.SubjectID, attemptInProgress).Limit(1).Find(&open)
+	if open.QuizattemptID != 0 {
+		if err := closeIfExpired(&open, now); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit expired attempt"})
+			return
+		}
+		if open.Status == attemptInProgress {
+			c.JSON(http.StatusConflict, gin.H{"error": "An attempt is already in progress", "attempt": open})
+			return
+		}
+	}
+
+	attempt, status, failure := openQuizAttempt(input.StudentID, input.SubjectID, now)
+	if failure != nil {
+		c.JSON(status, failure)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"attempt": attempt, "quizzes": presentAttempt(attempt)})
+}
+
+// openQuizAttempt starts the student's next attempt at the subject's quiz
+// if the retake policy allows one now. Otherwise it returns the status and
+// body to answer with.
+func openQuizAttempt(studentID uint, subjectID uint, now time.Time) (Quiz_Attempt, int, gin.H) {
+	policy := quizPolicyFor(subjectID)
+
+	var previous []Quiz_Attempt
+	db.Where("student_id = ? AND subject_id = ?", studentID, subjectID).Order("attempt_number").Find(&previous)
+
+	if policy.Max_attempts > 0 && len(previous) >= policy.Max_attempts {
+		return Quiz_Attempt{}, http.StatusForbidden, gin.H{"error": "Maximum number of attempts reached"}
+	}
+
+	if policy.Cooldown_minutes > 0 && len(previous) > 0 {
+		last := previous[len(previous)-1]
+		if last.Submitted_at != nil {
+			available := last.Submitted_at.Add(time.Duration(policy.Cooldown_minutes) * time.Minute)
+			if now.Before(available) {
+				return Quiz_Attempt{}, http.StatusTooManyRequests, gin.H{"error": "Retake is on cooldown", "available_at": available}
+			}
+		}
+	}
+
+	attempt := Quiz_Attempt{
+		StudentID:      studentID,
+		SubjectID:      subjectID,
+		Attempt_number: len(previous) + 1,
+		Status:         attemptInProgress,
+		Started_at:     now,
+		Seed:           now.UnixNano(),
+	}
+	if policy.Time_limit_minutes > 0 {
+		deadline := now.Add(time.Duration(policy.Time_limit_minutes) * time.Minute)
+		attempt.Deadline = &deadline
+	}
+
+	var pool []Quiz
+	db.Where("subject_id = ?", subjectID).Order("quiz_id").Find(&pool)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&attempt).Error; err != nil {
+			return err
+		}
+		questions := drawAttemptQuestions(attempt, policy, pool)
+		if len(questions) == 0 {
+			return nil
+		}
+		byID := map[uint]*Quiz{}
+		for i := range pool {
+			byID[pool[i].QuizID] = &pool[i]
+		}
+		for i := range questions {
+			revision, err := currentQuizRevision(tx, byID[questions[i].QuizID])
+			if err != nil {
+				return err
+			}
+			questions[i].QuizrevisionID = revision.QuizrevisionID
+		}
+		if err := tx.Create(&questions).Error; err != nil {
+			return err
+		}
+		return refreshStudentSubject(tx, attempt.StudentID, attempt.SubjectID)
+	})
+	if err != nil {
+		// idx_quiz_attempt_in_progress stops a concurrent start from opening
+		// a second attempt.
+		var concurrent Quiz_Attempt
+		db.Where("student_id = ? AND subject_id = ? AND status = ?", studentID, subjectID, attemptInProgress).Limit(1).Find(&concurrent)
+		if concurrent.QuizattemptID != 0 {
+			return Quiz_Attempt{}, http.StatusConflict, gin.H{"error": "An attempt is already in progress", "attempt": concurrent}
+		}
+		return Quiz_Attempt{}, http.StatusInternalServerError, gin.H{"error": "Failed to start attempt"}
+	}
+
+	return attempt, http.StatusCreated, nil
+}
+
+func getQuizAttemptByID(c *gin.Context) {
+	attempt, ok := loadAttempt(c)
+	if !ok {
+		return
+	}
+
+	db.Where("quizattempt_id = ?", attempt.QuizattemptID).Find(&attempt.Answers)
+	c.JSON(http.StatusOK, attempt)
+}
+
+func getQuizAttemptByStudentID(c *gin.Context) {
+	id := c.Param("id")
+	var attempts []Quiz_Attempt
+	if err := db.Preload("Subject").Order("started_at").Find(&attempts, "student_id = ?", id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quiz Attempt not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, attempts)
+}
+
+type attemptAnswer struct {
+	QuizID         uint   `json:"quiz_id"`
+	Student_answer string `json:"student_answer"`
+}
+
+// recordAttemptAnswers grades and stores answers for an in-progress attempt,
+// replacing earlier answers to the same quizzes. If a quiz is not part of
+// the attempt nothing is stored and its ID is returned.
+func recordAttemptAnswers(attempt Quiz_Attempt, answers []attemptAnswer) (uint, error) {
+	quizzes := map[uint]Quiz{}
+	for _, quiz := range attemptQuizzes(attempt) {
+		quizzes[quiz.QuizID] = quiz
+	}
+
+	optionOrders := map[uint]string{}
+	revisionIDs := map[uint]uint{}
+	for _, question := range attemptQuestions(attempt) {
+		optionOrders[question.QuizID] = question.Option_order
+		revisionIDs[question.QuizID] = question.QuizrevisionID
+	}
+
+	for _, answer := range answers {
+		if _, ok := quizzes[answer.QuizID]; !ok {
+			return answer.QuizID, nil
+		}
+	}
+
+	return 0, db.Transaction(func(tx *gorm.DB) error {
+		for _, answer := range answers {
+			quiz := quizzes[answer.QuizID]
+			saved := Quiz_Answer{QuizattemptID: attempt.QuizattemptID, QuizID: answer.QuizID, StudentID: attempt.StudentID}
+			tx.Where("quizattempt_id = ? AND quiz_id = ?", attempt.QuizattemptID, answer.QuizID).Limit(1).Find(&saved)
+			// Answers arrive in the shuffled letters the student saw and are
+			// stored in canonical letters.
+			saved.Student_answer = canonicalAnswer(quiz.Question_type, optionOrders[quiz.QuizID], answer.Student_answer)
+			saved.Score = gradeAnswer(quiz.Question_type, quizSpec(quiz), saved.Student_answer)
+			saved.QuizrevisionID = revisionIDs[quiz.QuizID]
+			if err := tx.Save(&saved).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// answerAttempt returns the in-progress or closed attempt a POST
+// /quiz-answer is for, or answers with an error and returns false. Clients
+// from before attempts existed send no quiz_attempt_id; their answers go to
+// the student's open attempt for the quiz's subject, which is started for
+// them when there is none.
+func answerAttempt(c *gin.Context, answer Quiz_Answer) (Quiz_Attempt, bool) {
+	now := time.Now()
+	var attempt Quiz_Attempt
+
+	if answer.QuizattemptID == 0 {
+		var quiz Quiz
+		if err := db.First(&quiz, answer.QuizID).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Quiz with that ID not found"})
+			return attempt, false
+		}
+		var student Student
+		if err := db.First(&student, answer.StudentID).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Student with that ID not found"})
+			return attempt, false
+		}
+
+		db.Where("student_id = ? AND subject_id = ? AND status = ?", student.StudentID, quiz.SubjectID, attemptInProgress).Limit(1).Find(&attempt)
+		if attempt.QuizattemptID != 0 {
+			if err := closeIfExpired(&attempt, now); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit expired attempt"})
+				return attempt, false
+			}
+			if attempt.Status == attemptInProgress {
+				return attempt, true
+			}
+		}
+
+		opened, status, failure := openQuizAttempt(student.StudentID, quiz.SubjectID, now)
+		if failure != nil {
+			c.JSON(status, failure)
+			return opened, false
+		}
+		return opened, true
+	}
+
+	if err := db.First(&attempt, answer.QuizattemptID).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Quiz Attempt with that ID not found"})
+		return attempt, false
+	}
+	if attempt.StudentID != answer.StudentID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Quiz Attempt belongs to another student"})
+		return attempt, false
+	}
+	if err := closeIfExpired(&attempt, now); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit expired attempt"})
+		return attempt, false
+	}
+	return attempt, true
+}
+
+// saveQuizAttemptAnswers autosaves answers for an in-progress attempt. It
+// can be called any number of times before submitting; the latest answer for
+// each quiz wins.
+func saveQuizAttemptAnswers(c *gin.Context) {
+	attempt, ok := loadAttempt(c)
+	if !ok {
+		return
+	}
+
+	if attempt.Status != attemptInProgress {
+		c.JSON(http.StatusConflict, gin.H{"error": "Attempt is already submitted", "attempt": attempt})
+		return
+	}
+
+	var input struct {
+		Answers []attemptAnswer `json:"answers"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	notInAttempt, err := recordAttemptAnswers(attempt, input.Answers)
+	if notInAttempt != 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Quiz is not part of this attempt", "quiz_id": notInAttempt})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save answers"})
+		return
+	}
+
+	db.Where("quizattempt_id = ?", attempt.QuizattemptID).Find(&attempt.Answers)
+	c.JSON(http.StatusOK, attempt)
+}
+
+func submitQuizAttempt(c *gin.Context) {
+	attempt, ok := loadAttempt(c)
+	if !ok {
+		return
+	}
+
+	if attempt.Status != attemptInProgress {
+		c.JSON(http.StatusConflict, gin.H{"error": "Attempt is already submitted", "attempt": attempt})
+		return
+	}
+
+	if err := finishAttempt(&attempt, attemptSubmitted); err != nil {
+		if errors.Is(err, errAttemptSubmitted) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit attempt"})
+		return
+	}
+
+	c.JSON(http.StatusOK, attempt)
+}
+
+// migrateQuizAttempts closes all but the latest in-progress attempt of a
+// student for a subject, then adds the index that keeps it that way.
+func migrateQuizAttempts() {
+	var open []Quiz_Attempt
+	db.Where("status = ?", attemptInProgress).Order("started_at DESC").Find(&open)
+
+	type key struct{ student, subject uint }
+	seen := map[key]bool{}
+	for i := range open {
+		k := key{open[i].StudentID, open[i].SubjectID}
+		if !seen[k] {
+			seen[k] = true
+			continue
+		}
+		if err := finishAttempt(&open[i], attemptAutoSubmitted); err != nil {
+			log.Println("Failed to close duplicate quiz attempt:", err)
+		}
+	}
+
+	db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_quiz_attempt_in_progress ON quiz_attempts (student_id, subject_id)
+		WHERE status = 'in_progress' AND deleted_at IS NULL`)
+}
+
+// expireQuizAttempts auto-submits overdue attempts in the background so a
+// student who closes the tab still gets a result once time is up.
+func expireQuizAttempts(interval time.Duration) {
+	for range time.Tick(interval) {
+		var overdue []Quiz_Attempt
+		db.Where("status = ? AND deadline < ?", attemptInProgress, time.Now()).Find(&overdue)
+		for i := range overdue {
+			if err := finishAttempt(&overdue[i], attemptAutoSubmitted); err != nil {
+				log.Println("Failed to auto-submit quiz attempt:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultRecommendationLimit = 5
+
+// studentProfile is everything a recommendation strategy may look at. It is
+// loaded once per request so strategies never touch the database and give
+// the same answer for the same profile.
+type studentProfile struct {
+	studentID     uint
+	interestID    uint
+	subjects      []Subject
+	names         map[uint]string
+	prerequisites map[uint][][]uint
+	bestScores    map[uint]int
+	passingScores map[uint]int
+	enrolled      map[uint]time.Time
+	abilities     map[uint]float64
+	materials     map[uint][]Learning_Material
+}
+
+type recommendation struct {
+	SubjectID    uint     `json:"subject_id"`
+	Subject_name string   `json:"subject_name"`
+	Score        int      `json:"score"`
+	Reasons      []string `json:"reasons"`
+}
+
+type materialRecommendation struct {
+	LearningmaterialID uint     `json:"learning_material_id"`
+	SubjectID          uint     `json:"subject_id"`
+	Preview            string   `json:"preview"`
+	Score              int      `json:"score"`
+	Reasons            []string `json:"reasons"`
+}
+
+// recommendationStrategy ranks what a student should take next.
+type recommendationStrategy interface {
+	rankSubjects(profile studentProfile) []recommendation
+	rankMaterials(profile studentProfile, subjects []recommendation) []materialRecommendation
+}
+
+var recommendationStrategies = map[string]recommendationStrategy{
+	"rules": ruleBasedStrategy{},
+}
+
+func (profile studentProfile) passed(subjectID uint) bool {
+	score, ok := profile.bestScores[subjectID]
+	return ok && score >= profile.passingScores[subjectID]
+}
+
+// unlocked reports whether every prerequisite group of the subject has a
+// passed subject in it.
+func (profile studentProfile) unlocked(subjectID uint) bool {
+	for _, group := range profile.prerequisites[subjectID] {
+		satisfied := false
+		for _, id := range group {
+			if profile.passed(id) {
+				satisfied = true
+				break
+			}
+		}
+		if !satisfied {
+			return false
+		}
+	}
+	return true
+}
+
+// level is the length of the longest prerequisite chain below a subject.
+// A subject still being measured counts as level 0 when a chain leads back
+// to it, so a prerequisite cycle left from before cycles were checked
+// cannot recurse forever.
+func (profile studentProfile) level(subjectID uint, memo map[uint]int) int {
+	if level, ok := memo[subjectID]; ok {
+		return level
+	}
+	memo[subjectID] = 0
+	level := 0
+	for _, group := range profile.prerequisites[subjectID] {
+		for _, id := range group {
+			if below := profile.level(id, memo) + 1; below > level {
+				level = below
+			}
+		}
+	}
+	memo[subjectID] = level
+	return level
+}
+
+// loadStudentProfile gathers the student's placement results, quiz results,
+// enrollments and the subjects of every interest they are involved in.
+func loadStudentProfile(student Student) studentProfile {
+	profile := studentProfile{
+		studentID:     student.StudentID,
+		interestID:    student.InterestID,
+		names:         map[uint]string{},
+		bestScores:    map[uint]int{},
+		passingScores: map[uint]int{},
+		enrolled:      map[uint]time.Time{},
+		abilities:     map[uint]float64{},
+		materials:     map[uint][]Learning_Material{},
+	}
+
+	interests := map[uint]bool{}
+	if student.InterestID != 0 {
+		interests[student.InterestID] = true
+	}
+
+	var joined []Subject_Joined
+	db.Preload("Subject").Where("student_id = ?", student.StudentID).Find(&joined)
+	for _, enrollment := range joined {
+		if enrollment.Status != enrollmentDropped {
+			profile.enrolled[enrollment.SubjectID] = enrollment.Date_joined
+		}
+		interests[enrollment.Subject.InterestID] = true
+	}
+
+	var placementResults []Placement_Test_Result
+	db.Where("student_id = ?", student.StudentID).Order("test_date").Find(&placementResults)
+	for _, result := range placementResults {
+		// Only adaptive sessions record an ability; the latest one counts.
+		if result.Ability != nil {
+			profile.abilities[result.InterestID] = *result.Ability
+		}
+		interests[result.InterestID] = true
+	}
+
+	var quizResults []Quiz_Result
+	db.Where("student_id = ?", student.StudentID).Find(&quizResults)
+	for _, result := range quizResults {
+		if best, ok := profile.bestScores[result.SubjectID]; !ok || result.Score > best {
+			profile.bestScores[result.SubjectID] = result.Score
+		}
+	}
+
+	var interestIDs []uint
+	for id := range interests {
+		interestIDs = append(interestIDs, id)
+	}
+	if len(interestIDs) > 0 {
+		db.Where("interest_id IN ?", interestIDs).Order("subject_id").Find(&profile.subjects)
+	}
+
+	profile.prerequisites = prerequisiteGraph(db)
+	var subjectIDs []uint
+	for _, subject := range profile.subjects {
+		subjectIDs = append(subjectIDs, subject.SubjectID)
+	}
+	for _, groups := range profile.prerequisites {
+		for _, group := range groups {
+			subjectIDs = append(subjectIDs, group...)
+		}
+	}
+	for id := range profile.bestScores {
+		subjectIDs = append(subjectIDs, id)
+	}
+
+	if len(subjectIDs) > 0 {
+		var named []Subject
+		db.Where("subject_id IN ?", subjectIDs).Find(&named)
+		for _, subject := range named {
+			profile.names[subject.SubjectID] = subject.Subject_name
+		}
+
+		var policies []Quiz_Policy
+		db.Where("subject_id IN ?", subjectIDs).Find(&policies)
+		for _, policy := range policies {
+			profile.passingScores[policy.SubjectID] = policy.Passing_score
+		}
+		for _, id := range subjectIDs {
+			if profile.passingScores[id] == 0 {
+				profile.passingScores[id] = defaultPassingScore
+			}
+		}
+
+		var materials []Learning_Material
+		db.Scopes(publishedMaterials, orderedMaterials).Where("learning_materials.subject_id IN ?", subjectIDs).Find(&materials)
+		for _, material := range materials {
+			profile.materials[material.SubjectID] = append(profile.materials[material.SubjectID], material)
+		}
+	}
+
+	return profile
+}
+
+// ruleBasedStrategy ranks subjects with fixed rules: unfinished enrollments
+// first, then subjects whose prerequisites are done, favouring the
+// student's own interest, subjects that unlock others, and the level the
+// placement test suggests. Ties go to the lower level and then the lower
+// subject ID, so the ranking is fully deterministic.
+type ruleBasedStrategy struct{}
+
+func (ruleBasedStrategy) rankSubjects(profile studentProfile) []recommendation {
+	dependents := map[uint]int{}
+	for _, subject := range profile.subjects {
+		for _, group := range profile.prerequisites[subject.SubjectID] {
+			for _, id := range group {
+				dependents[id]++
+			}
+		}
+	}
+
+	levels := map[uint]int{}
+	recommendations := []recommendation{}
+	for _, subject := range profile.subjects {
+		id := subject.SubjectID
+		if profile.passed(id) {
+			continue
+		}
+
+		var score int
+		var reasons []string
+		joinedAt, enrolled := profile.enrolled[id]
+		best, attempted := profile.bestScores[id]
+		switch {
+		case enrolled && attempted:
+			score = 100
+			reasons = append(reasons, fmt.Sprintf("Your best quiz score is %d, below the pass mark of %d", best, profile.passingScores[id]))
+		case enrolled:
+			score = 90
+			reasons = append(reasons, fmt.Sprintf("You joined this subject on %s and have not passed its quiz yet", joinedAt.Format("2006-01-02")))
+		case profile.unlocked(id):
+			score = 60
+			if len(profile.prerequisites[id]) == 0 {
+				reasons = append(reasons, "It has no prerequisites")
+			} else {
+				var done []string
+				for _, group := range profile.prerequisites[id] {
+					for _, prerequisite := range group {
+						if profile.passed(prerequisite) {
+							done = append(done, profile.names[prerequisite])
+						}
+					}
+				}
+				reasons = append(reasons, "You have completed its prerequisites: "+strings.Join(done, ", "))
+			}
+		default:
+			continue
+		}
+
+		if subject.InterestID == profile.interestID {
+			score += 10
+			reasons = append(reasons, "It belongs to your interest")
+		}
+
+		if count := dependents[id]; count > 0 {
+			score += 5 * min(count, 4)
+			reasons = append(reasons, fmt.Sprintf("Completing it unlocks %d more subject(s)", count))
+		}
+
+		level := profile.level(id, levels)
+		if ability, ok := profile.abilities[subject.InterestID]; ok {
+			switch {
+			case ability < 0 && level == 0:
+				score += 10
+				reasons = append(reasons, "Your placement result suggests starting with foundational subjects")
+			case ability >= 1 && level > 0:
+				score += 10
+				reasons = append(reasons, "Your placement result suggests you are ready for advanced subjects")
+			case ability >= 1 && level == 0:
+				score -= 10
+				reasons = append(reasons, "Your placement result suggests this subject may be too basic for you")
+			}
+		}
+
+		recommendations = append(recommendations, recommendation{
+			SubjectID:    id,
+			Subject_name: subject.Subject_name,
+			Score:        score,
+			Reasons:      reasons,
+		})
+	}
+
+	sort.SliceStable(recommendations, func(i, j int) bool {
+		a, b := recommendations[i], recommendations[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if levelA, levelB := profile.level(a.SubjectID, levels), profile.level(b.SubjectID, levels); levelA != levelB {
+			return levelA < levelB
+		}
+		return a.SubjectID < b.SubjectID
+	})
+	return recommendations
+}
+
+// rankMaterials suggests the materials of the recommended subjects in the
+// same order, pointing students who failed a quiz at review material.
+func (ruleBasedStrategy) rankMaterials(profile studentProfile, subjects []recommendation) []materialRecommendation {
+	materials := []materialRecommendation{}
+	for _, subject := range subjects {
+		reason := "Study material for " + subject.Subject_name + ", recommended above"
+		if _, attempted := profile.bestScores[subject.SubjectID]; attempted {
+			reason = "Review this before retaking the quiz for " + subject.Subject_name
+		}
+
+		for _, material := range profile.materials[subject.SubjectID] {
+			materials = append(materials, materialRecommendation{
+				LearningmaterialID: material.LearningmaterialID,
+				SubjectID:          material.SubjectID,
+				Preview:            materialPreview(plainText(material.Rendered_content)),
+				Score:              subject.Score,
+				Reasons:            []string{reason},
+			})
+		}
+	}
+	return materials
+}
+
+func materialPreview(content string) string {
+	content = strings.Join(strings.Fields(content), " ")
+	if runes := []rune(content); len(runes) > 120 {
+		return string(runes[:120]) + "…"
+	}
+	return content
+}
+
+func getStudentRecommendations(c *gin.Context) {
+	var student Student
+	if err := db.First(&student, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Student not found"})
+		return
+	}
+
+	name := c.DefaultQuery("strategy", "rules")
+	strategy, ok := recommendationStrategies[name]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown recommendation strategy " + name})
+		return
+	}
+
+	limit := defaultRecommendationLimit
+	if value, err := strconv.Atoi(c.Query("limit")); err == nil && value > 0 {
+		limit = value
+	}
+
+	profile := loadStudentProfile(student)
+	subjects := strategy.rankSubjects(profile)
+	if len(subjects) > limit {
+		subjects = subjects[:limit]
+	}
+	materials := strategy.rankMaterials(profile, subjects)
+	if len(materials) > limit {
+		materials = materials[:limit]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"student_id":         student.StudentID,
+		"strategy":           name,
+		"subjects":           subjects,
+		"learning_materials": materials,
+	})
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testProfile is a studentProfile in interest 1 over the given subjects,
+// with nothing passed, joined or placed yet.
+func testProfile(subjects ...Subject) studentProfile {
+	profile := studentProfile{
+		studentID:     1,
+		interestID:    1,
+		subjects:      subjects,
+		names:         map[uint]string{},
+		prerequisites: map[uint][][]uint{},
+		bestScores:    map[uint]int{},
+		passingScores: map[uint]int{},
+		enrolled:      map[uint]time.Time{},
+		abilities:     map[uint]float64{},
+		materials:     map[uint][]Learning_Material{},
+	}
+	for _, subject := range subjects {
+		profile.names[subject.SubjectID] = subject.Subject_name
+		profile.passingScores[subject.SubjectID] = defaultPassingScore
+	}
+	return profile
+}
+
+// testSubjects are subjects 1 to n, outside the student's interest unless
+// listed in own.
+func testSubjects(n int, own ...uint) []Subject {
+	subjects := make([]Subject, n)
+	for i := range subjects {
+		id := uint(i + 1)
+		subjects[i] = Subject{SubjectID: id, Subject_name: fmt.Sprint("Subject ", id), InterestID: 2}
+		for _, ownID := range own {
+			if ownID == id {
+				subjects[i].InterestID = 1
+			}
+		}
+	}
+	return subjects
+}
+
+func TestRuleBasedRankSubjects(t *testing.T) {
+	joined := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		profile    func() studentProfile
+		wantIDs    []uint
+		wantScores []int
+	}{
+		{
+			name: "enrolled and attempted above enrolled above unlocked",
+			profile: func() studentProfile {
+				profile := testProfile(testSubjects(3)...)
+				profile.enrolled[2] = joined
+				profile.enrolled[3] = joined
+				profile.bestScores[3] = 40
+				return profile
+			},
+			wantIDs:    []uint{3, 2, 1},
+			wantScores: []int{100, 90, 60},
+		},
+		{
+			name: "passed and locked subjects are left out",
+			profile: func() studentProfile {
+				profile := testProfile(testSubjects(3)...)
+				profile.bestScores[1] = 80
+				profile.prerequisites[2] = [][]uint{{3}}
+				return profile
+			},
+			wantIDs:    []uint{3},
+			wantScores: []int{65},
+		},
+		{
+			name: "every AND group needs a passed subject",
+			profile: func() studentProfile {
+				profile := testProfile(testSubjects(3)...)
+				profile.bestScores[1] = 80
+				profile.prerequisites[3] = [][]uint{{1}, {2}}
+				return profile
+			},
+			wantIDs:    []uint{2},
+			wantScores: []int{65},
+		},
+		{
+			name: "any subject of an OR group satisfies it",
+			profile: func() studentProfile {
+				profile := testProfile(testSubjects(4)...)
+				profile.bestScores[1] = 80
+				profile.bestScores[3] = 70
+				profile.prerequisites[4] = [][]uint{{1}, {2, 3}}
+				return profile
+			},
+			wantIDs:    []uint{2, 4},
+			wantScores: []int{65, 60},
+		},
+		{
+			name: "subjects of the student's interest get a bonus",
+			profile: func() studentProfile {
+				return testProfile(testSubjects(2, 2)...)
+			},
+			wantIDs:    []uint{2, 1},
+			wantScores: []int{70, 60},
+		},
+		{
+			name: "the dependents bonus is capped at four subjects",
+			profile: func() studentProfile {
+				profile := testProfile(testSubjects(7)...)
+				for id := uint(2); id <= 7; id++ {
+					profile.prerequisites[id] = [][]uint{{1}}
+				}
+				return profile
+			},
+			wantIDs:    []uint{1},
+			wantScores: []int{80},
+		},
+		{
+			name: "a low placement ability favours foundational subjects",
+			profile: func() studentProfile {
+				profile := placementProfile()
+				profile.abilities[2] = -0.5
+				return profile
+			},
+			wantIDs:    []uint{2, 3},
+			wantScores: []int{70, 60},
+		},
+		{
+			name: "a high placement ability favours advanced subjects",
+			profile: func() studentProfile {
+				profile := placementProfile()
+				profile.abilities[2] = 1.5
+				return profile
+			},
+			wantIDs:    []uint{3, 2},
+			wantScores: []int{70, 50},
+		},
+		{
+			name: "a middling placement ability changes nothing",
+			profile: func() studentProfile {
+				profile := placementProfile()
+				profile.abilities[2] = 0.5
+				return profile
+			},
+			wantIDs:    []uint{2, 3},
+			wantScores: []int{60, 60},
+		},
+		{
+			name: "ties go to the lower level, then the lower ID",
+			profile: func() studentProfile {
+				profile := testProfile(testSubjects(4)...)
+				profile.bestScores[1] = 80
+				profile.prerequisites[2] = [][]uint{{1}}
+				return profile
+			},
+			wantIDs:    []uint{3, 4, 2},
+			wantScores: []int{60, 60, 60},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ranked := ruleBasedStrategy{}.rankSubjects(test.profile())
+			var ids []uint
+			var scores []int
+			for _, recommendation := range ranked {
+				ids = append(ids, recommendation.SubjectID)
+				scores = append(scores, recommendation.Score)
+				if len(recommendation.Reasons) == 0 {
+					t.Errorf("subject %d has no reasons", recommendation.SubjectID)
+				}
+			}
+			if !reflect.DeepEqual(ids, test.wantIDs) || !reflect.DeepEqual(scores, test.wantScores) {
+				t.Errorf("ranked %v with scores %v, want %v with %v", ids, scores, test.wantIDs, test.wantScores)
+			}
+		})
+	}
+}
+
+// placementProfile has a passed subject 1, an unlocked level 0 subject 2
+// and an unlocked level 1 subject 3 that needs subject 1.
+func placementProfile() studentProfile {
+	profile := testProfile(testSubjects(3)...)
+	profile.bestScores[1] = 80
+	profile.prerequisites[3] = [][]uint{{1}}
+	return profile
+}
+
+func TestStudentProfileLevel(t *testing.T) {
+	profile := testProfile()
+	profile.prerequisites = map[uint][][]uint{
+		2: {{1}},
+		3: {{1}, {2, 4}},
+		4: {{2}},
+	}
+	for id, want := range map[uint]int{1: 0, 2: 1, 3: 3, 4: 2} {
+		if level := profile.level(id, map[uint]int{}); level != want {
+			t.Errorf("level(%d) = %d, want %d", id, level, want)
+		}
+	}
+
+	// A cycle left from before cycles were checked ends at the subject
+	// being measured instead of recursing forever.
+	profile = testProfile(testSubjects(3)...)
+	profile.prerequisites = map[uint][][]uint{
+		1: {{2}},
+		2: {{1}},
+		3: {{1}},
+	}
+	if level := profile.level(3, map[uint]int{}); level != 3 {
+		t.Errorf("level(3) on a cycle = %d, want 3", level)
+	}
+	if ranked := (ruleBasedStrategy{}).rankSubjects(profile); len(ranked) != 0 {
+		t.Errorf("ranked %v, want nothing unlocked on a cycle", ranked)
+	}
+}
+
+func TestRuleBasedRankMaterials(t *testing.T) {
+	profile := testProfile(testSubjects(2)...)
+	profile.bestScores[2] = 40
+	long := strings.Repeat("word ", 40)
+	profile.materials[1] = []Learning_Material{
+		{LearningmaterialID: 10, SubjectID: 1, Rendered_content: "<p>Fish &amp; <b>chips</b></p>"},
+		{LearningmaterialID: 11, SubjectID: 1, Rendered_content: "<p>" + long + "</p>"},
+	}
+	profile.materials[2] = []Learning_Material{
+		{LearningmaterialID: 20, SubjectID: 2, Rendered_content: "<h1>Retake</h1>"},
+	}
+	subjects := []recommendation{
+		{SubjectID: 2, Subject_name: "Subject 2", Score: 100},
+		{SubjectID: 1, Subject_name: "Subject 1", Score: 60},
+	}
+
+	materials := ruleBasedStrategy{}.rankMaterials(profile, subjects)
+	want := []materialRecommendation{
+		{LearningmaterialID: 20, SubjectID: 2, Preview: "Retake", Score: 100, Reasons: []string{"Review this before retaking the quiz for Subject 2"}},
+		{LearningmaterialID: 10, SubjectID: 1, Preview: "Fish & chips", Score: 60, Reasons: []string{"Study material for Subject 1, recommended above"}},
+		{LearningmaterialID: 11, SubjectID: 1, Preview: long[:120] + "…", Score: 60, Reasons: []string{"Study material for Subject 1, recommended above"}},
+	}
+	if !reflect.DeepEqual(materials, want) {
+		t.Errorf("materials = %+v\nwant %+v", materials, want)
+	}
+}
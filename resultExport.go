@@ -0,0 +1,305 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const exportBatchSize = 500
+
+// tableWriter receives one row at a time so exports never hold the whole
+// result set in memory.
+type tableWriter interface {
+	WriteRow(values []interface{}) error
+	Close() error
+}
+
+func formatCell(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		// Spreadsheets run cells starting with these as formulas, so text
+		// such as a student's name must not start with one.
+		if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+			return "'" + v
+		}
+		return v
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.Format(time.RFC3339)
+	case *time.Time:
+		if v == nil {
+			return ""
+		}
+		return formatCell(*v)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+type csvTableWriter struct {
+	w *csv.Writer
+}
+
+func (t *csvTableWriter) WriteRow(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, value := range values {
+		record[i] = formatCell(value)
+	}
+	return t.w.Write(record)
+}
+
+func (t *csvTableWriter) Close() error {
+	t.w.Flush()
+	return t.w.Error()
+}
+
+// xlsxTableWriter writes a single-sheet workbook. The sheet XML is written
+// straight into the zip stream, using inline strings so no shared string
+// table has to be collected first.
+type xlsxTableWriter struct {
+	archive *zip.Writer
+	sheet   *bufio.Writer
+	row     int
+}
+
+func newXLSXTableWriter(w io.Writer, sheetName string) (*xlsxTableWriter, error) {
+	archive := zip.NewWriter(w)
+
+	static := []struct{ name, content string }{
+		{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+		{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="` + xmlEscape(sheetName) + `" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+	}
+	for _, file := range static {
+		f, err := archive.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, file.content); err != nil {
+			return nil, err
+		}
+	}
+
+	// The sheet must be the last entry since zip entries are written
+	// sequentially and this one stays open until Close.
+	f, err := archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	sheet := bufio.NewWriter(f)
+	sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+
+	return &xlsxTableWriter{archive: archive, sheet: sheet}, nil
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func (t *xlsxTableWriter) WriteRow(values []interface{}) error {
+	t.row++
+	fmt.Fprintf(t.sheet, `<row r="%d">`, t.row)
+	for _, value := range values {
+		switch v := value.(type) {
+		case int, int64, uint, uint64, float64:
+			fmt.Fprintf(t.sheet, `<c t="n"><v>%v</v></c>`, v)
+		default:
+			fmt.Fprintf(t.sheet, `<c t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, xmlEscape(formatCell(v)))
+		}
+	}
+	_, err := t.sheet.WriteString("</row>")
+	return err
+}
+
+func (t *xlsxTableWriter) Close() error {
+	t.sheet.WriteString("</sheetData></worksheet>")
+	if err := t.sheet.Flush(); err != nil {
+		return err
+	}
+	return t.archive.Close()
+}
+
+// startExport sets the download headers and returns the writer for the
+// requested format, or responds with an error and returns nil.
+func startExport(c *gin.Context, name string) tableWriter {
+	switch c.DefaultQuery("format", "csv") {
+	case "csv":
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", "attachment; filename="+name+".csv")
+		c.Status(http.StatusOK)
+		return &csvTableWriter{w: csv.NewWriter(c.Writer)}
+	case "xlsx":
+		c.Header("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		c.Header("Content-Disposition", "attachment; filename="+name+".xlsx")
+		c.Status(http.StatusOK)
+		writer, err := newXLSXTableWriter(c.Writer, name)
+		if err != nil {
+			c.Error(err)
+			return nil
+		}
+		return writer
+	}
+
+	c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or xlsx"})
+	return nil
+}
+
+// finishExport closes writer once the rows are written. The headers are
+// sent by then, so a failed export can only be logged and marked with a
+// last row saying the file is incomplete.
+func finishExport(c *gin.Context, writer tableWriter, err error) {
+	if err != nil {
+		c.Error(err)
+		log.Println("Export failed:", err)
+		writer.WriteRow([]interface{}{"ERROR: the export failed and this file is incomplete"})
+	}
+	if err := writer.Close(); err != nil {
+		c.Error(err)
+		log.Println("Failed to finish export:", err)
+	}
+}
+
+// exportFilters applies the subject, interest and date range query
+// parameters. Result tables without a subject_id column only accept the
+// interest filter directly.
+func exportFilters(c *gin.Context, query *gorm.DB, dateColumn string, hasSubject bool) (*gorm.DB, string) {
+	if subjectID := c.Query("subject_id"); subjectID != "" {
+		if !hasSubject {
+			return nil, "subject_id filter is not supported for this export"
+		}
+		query = query.Where("subject_id = ?", subjectID)
+	}
+
+	if interestID := c.Query("interest_id"); interestID != "" {
+		if hasSubject {
+			query = query.Where("subject_id IN (?)", db.Model(&Subject{}).Select("subject_id").Where("interest_id = ?", interestID))
+		} else {
+			query = query.Where("interest_id = ?", interestID)
+		}
+	}
+
+	if from := c.Query("from"); from != "" {
+		date, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			return nil, "from must be a date in YYYY-MM-DD format"
+		}
+		query = query.Where(dateColumn+" >= ?", date)
+	}
+
+	if to := c.Query("to"); to != "" {
+		date, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			return nil, "to must be a date in YYYY-MM-DD format"
+		}
+		query = query.Where(dateColumn+" < ?", date.AddDate(0, 0, 1))
+	}
+
+	return query, ""
+}
+
+func exportQuizResults(c *gin.Context) {
+	query, msg := exportFilters(c, db.Preload("Student").Preload("Subject"), "quiz_date", true)
+	if msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	writer := startExport(c, "quiz-results")
+	if writer == nil {
+		return
+	}
+	err := writer.WriteRow([]interface{}{"quiz_result_id", "student_id", "student_name", "subject_id", "subject_name", "score", "quiz_date"})
+
+	var batch []Quiz_Result
+	if err == nil {
+		err = query.FindInBatches(&batch, exportBatchSize, func(tx *gorm.DB, _ int) error {
+			for _, result := range batch {
+				row := []interface{}{result.QuizresultID, result.StudentID, result.Student.Name, result.SubjectID, result.Subject.Subject_name, result.Score, result.Quiz_date}
+				if err := writer.WriteRow(row); err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+	}
+	finishExport(c, writer, err)
+}
+
+func exportPlacementTestResults(c *gin.Context) {
+	query, msg := exportFilters(c, db.Preload("Student").Preload("Interest"), "test_date", false)
+	if msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	writer := startExport(c, "placement-test-results")
+	if writer == nil {
+		return
+	}
+	err := writer.WriteRow([]interface{}{"placement_test_result_id", "student_id", "student_name", "interest_id", "interest_name", "score", "test_date"})
+
+	var batch []Placement_Test_Result
+	if err == nil {
+		err = query.FindInBatches(&batch, exportBatchSize, func(tx *gorm.DB, _ int) error {
+			for _, result := range batch {
+				row := []interface{}{result.PlacementtestresultID, result.StudentID, result.Student.Name, result.InterestID, result.Interest.Interest_name, result.Score, result.Test_date}
+				if err := writer.WriteRow(row); err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+	}
+	finishExport(c, writer, err)
+}
+
+func exportSubjectJoineds(c *gin.Context) {
+	query, msg := exportFilters(c, db.Preload("Student").Preload("Subject"), "date_joined", true)
+	if msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	writer := startExport(c, "subject-joined")
+	if writer == nil {
+		return
+	}
+	err := writer.WriteRow([]interface{}{"subject_joined_id", "student_id", "student_name", "subject_id", "subject_name", "date_joined", "status", "progress", "completed_at", "dropped_at", "drop_reason"})
+
+	var batch []Subject_Joined
+	if err == nil {
+		err = query.FindInBatches(&batch, exportBatchSize, func(tx *gorm.DB, _ int) error {
+			for _, joined := range batch {
+				row := []interface{}{joined.SubjectjoinedID, joined.StudentID, joined.Student.Name, joined.SubjectID, joined.Subject.Subject_name, joined.Date_joined, joined.Status, joined.Progress, joined.Completed_at, joined.Dropped_at, joined.Drop_reason}
+				if err := writer.WriteRow(row); err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+	}
+	finishExport(c, writer, err)
+}
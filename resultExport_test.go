@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFormatCell(t *testing.T) {
+	date := time.Date(2024, 3, 5, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{"Ada", "Ada"},
+		{"", ""},
+		{"=HYPERLINK(\"http://evil\")", "'=HYPERLINK(\"http://evil\")"},
+		{"+1", "'+1"},
+		{"-1", "'-1"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\tcmd", "'\tcmd"},
+		{-1, "-1"},
+		{2.5, "2.5"},
+		{date, "2024-03-05T10:30:00Z"},
+		{&date, "2024-03-05T10:30:00Z"},
+		{(*time.Time)(nil), ""},
+		{time.Time{}, ""},
+		{nil, ""},
+	}
+	for _, test := range tests {
+		if got := formatCell(test.value); got != test.want {
+			t.Errorf("formatCell(%#v) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestFinishExportMarksFailedCSV(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	var out bytes.Buffer
+	writer := &csvTableWriter{w: csv.NewWriter(&out)}
+	writer.WriteRow([]interface{}{"id", "name"})
+
+	finishExport(c, writer, errors.New("connection lost"))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "ERROR:") {
+		t.Errorf("export = %q, want the header and an ERROR row", out.String())
+	}
+	if len(c.Errors) != 1 {
+		t.Errorf("recorded %d errors on the context, want 1", len(c.Errors))
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// searchLanguage is the Postgres text search configuration used for both
+// the indexes and the queries. They must match for the indexes to be used.
+const searchLanguage = "english"
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	snippetLength      = 200
+)
+
+// Snippets are highlighted by Postgres with these private use characters,
+// which are swapped for <mark> tags after the rest is escaped.
+const (
+	markStart = "\uE000"
+	markStop  = "\uE001"
+)
+
+var snippetOptions = fmt.Sprintf(`StartSel=%s, StopSel=%s, MaxWords=35, MinWords=15, MaxFragments=2, FragmentDelimiter=" … "`, markStart, markStop)
+
+// searchSource is one kind of thing /search finds. Its document is the
+// title column weighted above the body column; display is what is shown as
+// the title of a result.
+type searchSource struct {
+	kind     string
+	table    string
+	title    string
+	body     string
+	id       string
+	material string
+	display  string
+	query    func() *gorm.DB
+}
+
+var searchSources = []searchSource{
+	{
+		kind:     "subject",
+		table:    "subjects",
+		title:    "subject_name",
+		body:     "description",
+		id:       "subjects.subject_id",
+		material: "0",
+		display:  "subjects.subject_name",
+		query: func() *gorm.DB {
+			return db.Table("subjects").Where("subjects.deleted_at IS NULL")
+		},
+	},
+	{
+		kind:     "material",
+		table:    "learning_materials",
+		title:    "title",
+		body:     "content",
+		id:       "learning_materials.learning_material_id",
+		material: "learning_materials.learning_material_id",
+		display:  "learning_materials.title",
+		query: func() *gorm.DB {
+			return db.Table("learning_materials").
+				Joins("JOIN subjects ON subjects.subject_id = learning_materials.subject_id AND subjects.deleted_at IS NULL").
+				Where("learning_materials.deleted_at IS NULL").
+				Scopes(publishedMaterials)
+		},
+	},
+	{
+		kind:     "attachment",
+		table:    "attachments",
+		body:     "description",
+		id:       "attachments.attachment_id",
+		material: "learning_materials.learning_material_id",
+		display:  "CASE WHEN attachments.file_name <> '' THEN attachments.file_name ELSE attachments.source END",
+		query: func() *gorm.DB {
+			return db.Table("attachments").
+				Joins("JOIN learning_materials ON learning_materials.learning_material_id = attachments.learningmaterial_id AND learning_materials.deleted_at IS NULL").
+				Joins("JOIN subjects ON subjects.subject_id = learning_materials.subject_id AND subjects.deleted_at IS NULL").
+				Where("attachments.deleted_at IS NULL").
+				Scopes(publishedMaterials)
+		},
+	},
+}
+
+type searchResult struct {
+	Type               string  `json:"type"`
+	ID                 uint    `json:"id"`
+	Title              string  `json:"title"`
+	Snippet            string  `json:"snippet"`
+	Rank               float64 `json:"rank"`
+	SubjectID          uint    `json:"subject_id"`
+	InterestID         uint    `json:"interest_id"`
+	LearningmaterialID uint    `json:"learning_material_id,omitempty"`
+}
+
+type searchRow struct {
+	Kind               string
+	ID                 uint
+	SubjectID          uint
+	InterestID         uint
+	LearningmaterialID uint
+	Title              string
+	Rank               float64
+	Snippet            string
+	DocTitle           string
+	DocBody            string
+}
+
+// column qualifies a column of the source's table, or leaves it bare for
+// index definitions when prefix is empty.
+func (s searchSource) column(prefix string, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// document is the weighted tsvector the source is searched by.
+func (s searchSource) document(prefix string) string {
+	body := fmt.Sprintf("setweight(to_tsvector('%s', coalesce(%s, '')), 'B')", searchLanguage, s.column(prefix, s.body))
+	if s.title == "" {
+		return body
+	}
+	return fmt.Sprintf("setweight(to_tsvector('%s', coalesce(%s, '')), 'A') || %s", searchLanguage, s.column(prefix, s.title), body)
+}
+
+func (s searchSource) selectColumns() string {
+	return fmt.Sprintf("'%s' AS kind, %s AS id, subjects.subject_id AS subject_id, subjects.interest_id AS interest_id, %s AS learningmaterial_id, coalesce(%s, '') AS title",
+		s.kind, s.id, s.material, s.display)
+}
+
+// migrateSearch adds the full-text indexes on Postgres. Other databases use
+// searchFallback, which needs none. Search still works without the indexes,
+// only slower, so a failure is logged rather than stopping the server.
+func migrateSearch() {
+	if db.Dialector.Name() != "postgres" {
+		return
+	}
+	for _, source := range searchSources {
+		err := db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_search ON %s USING GIN ((%s))", source.table, source.table, source.document(""))).Error
+		if err != nil {
+			log.Printf("Failed to create the search index on %s: %v", source.table, err)
+		}
+	}
+}
+
+// markSnippet escapes a snippet highlighted with markStart and markStop and
+// turns the marks into <mark> tags.
+func markSnippet(snippet string) string {
+	snippet = html.EscapeString(strings.Join(strings.Fields(snippet), " "))
+	return strings.NewReplacer(markStart, "<mark>", markStop, "</mark>").Replace(snippet)
+}
+
+// postgresQuery selects the source's matches for q, ranked with ts_rank_cd
+// and highlighted with ts_headline.
+func (s searchSource) postgresQuery(q string, interestID string) *gorm.DB {
+	document := s.document(s.table)
+	tsquery := fmt.Sprintf("websearch_to_tsquery('%s', ?)", searchLanguage)
+	query := s.query().
+		Select(s.selectColumns()+
+			fmt.Sprintf(", ts_rank_cd(%s, %s) AS rank, ts_headline('%s', coalesce(%s, ''), %s, ?) AS snippet", document, tsquery, searchLanguage, s.column(s.table, s.body), tsquery),
+			q, q, snippetOptions).
+		Where("("+document+") @@ "+tsquery, q)
+	if interestID != "" {
+		query = query.Where("subjects.interest_id = ?", interestID)
+	}
+	return query
+}
+
+// searchPostgres ranks matches with ts_rank_cd, weighting titles above
+// bodies, and highlights them with ts_headline. q takes the web search
+// syntax: "quoted phrases", OR and -excluded words.
+func searchPostgres(q string, sources []searchSource, interestID string, limit int, offset int) ([]searchRow, int64, error) {
+	parts := make([]string, len(sources))
+	args := make([]interface{}, 0, len(sources)+2)
+	for i, source := range sources {
+		parts[i] = "?"
+		args = append(args, source.postgresQuery(q, interestID))
+	}
+	union := strings.Join(parts, " UNION ALL ")
+
+	// The total is counted on its own so pages past the last result still
+	// report it.
+	var total int64
+	if err := db.Raw("SELECT COUNT(*) FROM ("+union+") AS results", args...).Scan(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var rows []searchRow
+	err := db.Raw("SELECT * FROM ("+union+") AS results ORDER BY rank DESC, kind, id LIMIT ? OFFSET ?", append(args, limit, offset)...).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range rows {
+		rows[i].Snippet = markSnippet(rows[i].Snippet)
+	}
+	return rows, total, nil
+}
+
+// searchTerms splits q into lowercase words.
+func searchTerms(q string) []string {
+	return strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// highlight cuts a window of text around the first match of terms and marks
+// every match in it.
+func highlight(text string, terms *regexp.Regexp) string {
+	text = strings.Join(strings.Fields(text), " ")
+
+	start, end := 0, len(text)
+	if first := terms.FindStringIndex(text); first != nil && first[0] > snippetLength/3 {
+		start = first[0] - snippetLength/3
+		if space := strings.IndexByte(text[start:], ' '); space >= 0 && start+space < first[0] {
+			start += space + 1
+		}
+		for !utf8.RuneStart(text[start]) {
+			start++
+		}
+	}
+	if end-start > snippetLength {
+		end = start + snippetLength
+		if space := strings.LastIndexByte(text[start:end], ' '); space > 0 {
+			end = start + space
+		}
+		for end > start && !utf8.RuneStart(text[end]) {
+			end--
+		}
+	}
+	window := text[start:end]
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("… ")
+	}
+	last := 0
+	for _, match := range terms.FindAllStringIndex(window, -1) {
+		b.WriteString(html.EscapeString(window[last:match[0]]))
+		b.WriteString("<mark>" + html.EscapeString(window[match[0]:match[1]]) + "</mark>")
+		last = match[1]
+	}
+	b.WriteString(html.EscapeString(window[last:]))
+	if end < len(text) {
+		b.WriteString(" …")
+	}
+	return b.String()
+}
+
+// termPattern matches any of terms, ignoring case.
+func termPattern(terms []string) *regexp.Regexp {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	return regexp.MustCompile(`(?i)` + strings.Join(quoted, "|"))
+}
+
+// fallbackRank counts the matches of terms, with title matches counting
+// more, like the A and B weights on Postgres.
+func fallbackRank(title string, body string, terms *regexp.Regexp) float64 {
+	return float64(len(terms.FindAllStringIndex(title, -1))) + 0.4*float64(len(terms.FindAllStringIndex(body, -1)))
+}
+
+// sortSearchRows orders rows best first, then by kind and ID so pages are
+// stable.
+func sortSearchRows(rows []searchRow) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].Rank != rows[j].Rank {
+			return rows[i].Rank > rows[j].Rank
+		}
+		if rows[i].Kind != rows[j].Kind {
+			return rows[i].Kind < rows[j].Kind
+		}
+		return rows[i].ID < rows[j].ID
+	})
+}
+
+// fallbackQuery selects the source's rows whose title or body contains
+// every one of terms, along with the title and body to rank them by.
+func (s searchSource) fallbackQuery(terms []string, interestID string) *gorm.DB {
+	docTitle := "''"
+	if s.title != "" {
+		docTitle = fmt.Sprintf("coalesce(%s, '')", s.column(s.table, s.title))
+	}
+	docBody := fmt.Sprintf("coalesce(%s, '')", s.column(s.table, s.body))
+
+	query := s.query().Select(fmt.Sprintf("%s, %s AS doc_title, %s AS doc_body", s.selectColumns(), docTitle, docBody))
+	for _, term := range terms {
+		query = query.Where(fmt.Sprintf("lower(%s || ' ' || %s) LIKE ?", docTitle, docBody), "%"+term+"%")
+	}
+	if interestID != "" {
+		query = query.Where("subjects.interest_id = ?", interestID)
+	}
+	return query
+}
+
+// searchFallback is a simple search for databases without full-text
+// search, such as SQLite in tests. Every word of q must appear in the
+// title or body, and results are ranked by how often the words appear.
+func searchFallback(q string, sources []searchSource, interestID string, limit int, offset int) ([]searchRow, int64, error) {
+	terms := searchTerms(q)
+	pattern := termPattern(terms)
+
+	var matches []searchRow
+	for _, source := range sources {
+		var rows []searchRow
+		if err := source.fallbackQuery(terms, interestID).Scan(&rows).Error; err != nil {
+			return nil, 0, err
+		}
+		for _, row := range rows {
+			row.Rank = fallbackRank(row.DocTitle, row.DocBody, pattern)
+			row.Snippet = highlight(row.DocBody, pattern)
+			matches = append(matches, row)
+		}
+	}
+	sortSearchRows(matches)
+
+	total := int64(len(matches))
+	if offset >= len(matches) {
+		return []searchRow{}, total, nil
+	}
+	return matches[offset:min(offset+limit, len(matches))], total, nil
+}
+
+// searchSourcesOf picks the sources named in types, a comma separated list
+// of kinds, or all of them when types is empty.
+func searchSourcesOf(types string) ([]searchSource, bool) {
+	if types == "" {
+		return searchSources, true
+	}
+	var sources []searchSource
+	for _, kind := range strings.Split(types, ",") {
+		found := false
+		for _, source := range searchSources {
+			if source.kind == strings.TrimSpace(kind) {
+				sources = append(sources, source)
+				found = true
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return sources, true
+}
+
+// searchContent searches subjects, published learning materials and their
+// attachments. ?q is required; ?interest_id and ?type (subject, material or
+// attachment, comma separated) narrow it down, and ?limit and ?offset page
+// through the results. Snippets are HTML with matches in <mark> tags.
+func searchContent(c *gin.Context) {
+	q := strings.TrimSpace(c.Query("q"))
+	if len(searchTerms(q)) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q must contain at least one word"})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultSearchLimit)))
+	if err != nil || limit < 1 || limit > maxSearchLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit)})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be 0 or more"})
+		return
+	}
+
+	interestID := c.Query("interest_id")
+	if interestID != "" {
+		var interest Interest
+		if err := db.First(&interest, interestID).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Interest not found"})
+			return
+		}
+	}
+
+	sources, ok := searchSourcesOf(c.Query("type"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type must be subject, material or attachment"})
+		return
+	}
+
+	search := searchFallback
+	if db.Dialector.Name() == "postgres" {
+		search = searchPostgres
+	}
+	rows, total, err := search(q, sources, interestID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Search failed"})
+		return
+	}
+
+	results := make([]searchResult, len(rows))
+	for i, row := range rows {
+		results[i] = searchResult{
+			Type:               row.Kind,
+			ID:                 row.ID,
+			Title:              row.Title,
+			Snippet:            row.Snippet,
+			Rank:               row.Rank,
+			SubjectID:          row.SubjectID,
+			InterestID:         row.InterestID,
+			LearningmaterialID: row.LearningmaterialID,
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"query": q, "total": total, "limit": limit, "offset": offset, "results": results})
+}
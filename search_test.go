@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// useDryRunDB points db at a Postgres dialect that only builds SQL, so the
+// search queries can be inspected without a database.
+func useDryRunDB(t *testing.T) {
+	t.Helper()
+	dryRun, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{DryRun: true, DisableAutomaticPing: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := db
+	db = dryRun
+	t.Cleanup(func() { db = previous })
+}
+
+func searchSQL(query *gorm.DB) string {
+	return query.ToSQL(func(tx *gorm.DB) *gorm.DB {
+		return tx.Scan(&[]searchRow{})
+	})
+}
+
+func TestSearchQueriesFilterDraftsAndInterests(t *testing.T) {
+	useDryRunDB(t)
+
+	for _, source := range searchSources {
+		queries := map[string]*gorm.DB{
+			"postgres": source.postgresQuery("goroutines", "3"),
+			"fallback": source.fallbackQuery([]string{"goroutines"}, "3"),
+		}
+		for name, query := range queries {
+			sql := searchSQL(query)
+			if !strings.Contains(sql, "subjects.interest_id = '3'") {
+				t.Errorf("%s %s query does not filter by interest:\n%s", name, source.kind, sql)
+			}
+			if !strings.Contains(sql, "subjects.deleted_at IS NULL") {
+				t.Errorf("%s %s query includes deleted subjects:\n%s", name, source.kind, sql)
+			}
+			published := strings.Contains(sql, "learning_materials.status = 'published'") &&
+				strings.Contains(sql, `FROM "subject_modules" WHERE status = 'published'`)
+			if source.kind != "subject" && !published {
+				t.Errorf("%s %s query includes drafts:\n%s", name, source.kind, sql)
+			}
+		}
+
+		if sql := searchSQL(source.postgresQuery("goroutines", "")); strings.Contains(sql, "interest_id =") {
+			t.Errorf("%s query filters by interest without interest_id:\n%s", source.kind, sql)
+		}
+	}
+}
+
+func TestFallbackQueryNeedsEveryTerm(t *testing.T) {
+	useDryRunDB(t)
+
+	sql := searchSQL(searchSources[1].fallbackQuery([]string{"channel", "select"}, ""))
+	for _, term := range []string{"'%channel%'", "'%select%'"} {
+		if !strings.Contains(sql, "lower(coalesce(learning_materials.title, '') || ' ' || coalesce(learning_materials.content, '')) LIKE "+term) {
+			t.Errorf("query does not require %s:\n%s", term, sql)
+		}
+	}
+}
+
+func TestSearchSourcesOf(t *testing.T) {
+	tests := []struct {
+		types string
+		kinds []string
+		ok    bool
+	}{
+		{"", []string{"subject", "material", "attachment"}, true},
+		{"material", []string{"material"}, true},
+		{"attachment, subject", []string{"attachment", "subject"}, true},
+		{"material,video", nil, false},
+	}
+	for _, test := range tests {
+		sources, ok := searchSourcesOf(test.types)
+		var kinds []string
+		for _, source := range sources {
+			kinds = append(kinds, source.kind)
+		}
+		if ok != test.ok || !reflect.DeepEqual(kinds, test.kinds) {
+			t.Errorf("searchSourcesOf(%q) = %v, %v, want %v, %v", test.types, kinds, ok, test.kinds, test.ok)
+		}
+	}
+}
+
+func TestMarkSnippet(t *testing.T) {
+	snippet := "Use <b>" + markStart + "chan" + markStop + "</b> &\n  " + markStart + "select" + markStop
+	want := "Use &lt;b&gt;<mark>chan</mark>&lt;/b&gt; &amp; <mark>select</mark>"
+	if got := markSnippet(snippet); got != want {
+		t.Errorf("markSnippet = %q, want %q", got, want)
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	pattern := termPattern([]string{"chan"})
+
+	if got, want := highlight("A <chan> & a CHAN", pattern), "A &lt;<mark>chan</mark>&gt; &amp; a <mark>CHAN</mark>"; got != want {
+		t.Errorf("highlight = %q, want %q", got, want)
+	}
+
+	long := strings.Repeat("filler ", 40) + "chan " + strings.Repeat("more ", 60)
+	got := highlight(long, pattern)
+	if !strings.HasPrefix(got, "… ") || !strings.HasSuffix(got, " …") {
+		t.Errorf("highlight of a long text = %q, want a window with ellipses", got)
+	}
+	if !strings.Contains(got, "<mark>chan</mark>") {
+		t.Errorf("highlight of a long text = %q, want the match in the window", got)
+	}
+	if len(got) > snippetLength+len("… <mark></mark> …") {
+		t.Errorf("highlight window is %d bytes, want at most about %d", len(got), snippetLength)
+	}
+}
+
+func TestFallbackRanking(t *testing.T) {
+	pattern := termPattern([]string{"chan", "select"})
+	inTitle := fallbackRank("Chan basics", "nothing here", pattern)
+	inBody := fallbackRank("Basics", "chan and select", pattern)
+	if inTitle <= fallbackRank("Basics", "chan", pattern) {
+		t.Errorf("title match ranks %v, want above a single body match", inTitle)
+	}
+	if inBody != 0.8 {
+		t.Errorf("two body matches rank %v, want 0.8", inBody)
+	}
+
+	rows := []searchRow{
+		{Kind: "subject", ID: 2, Rank: 0.4},
+		{Kind: "material", ID: 9, Rank: 1},
+		{Kind: "subject", ID: 1, Rank: 0.4},
+		{Kind: "attachment", ID: 5, Rank: 0.4},
+	}
+	sortSearchRows(rows)
+	var order []string
+	for _, row := range rows {
+		order = append(order, fmt.Sprint(row.Kind, " ", row.ID))
+	}
+	want := []string{"material 9", "attachment 5", "subject 1", "subject 2"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("order = %v, want %v", order, want)
+	}
+}
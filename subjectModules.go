@@ -0,0 +1,456 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Modules and lessons are drafts until published. A lesson is shown to
+// students only when it and its module are published. Learning_Material is
+// the lesson; lessons outside any module come after all modules.
+const (
+	contentDraft     = "draft"
+	contentPublished = "published"
+)
+
+type Subject_Module struct {
+	gorm.Model
+	SubjectmoduleID uint                `gorm:"column:subject_module_id;primaryKey;autoIncrement;unique" json:"subject_module_id"`
+	SubjectID       uint                `gorm:"index" json:"subject_id"`
+	Title           string              `json:"title"`
+	Description     string              `json:"description"`
+	Position        int                 `json:"position"`
+	Status          string              `json:"status"`
+	Lessons         []Learning_Material `gorm:"-" json:"lessons"`
+}
+
+// tocLesson is a lesson as listed in a table of contents.
+type tocLesson struct {
+	LearningmaterialID uint   `json:"learning_material_id"`
+	Title              string `json:"title"`
+	Position           int    `json:"position"`
+	Status             string `json:"status"`
+}
+
+type tocModule struct {
+	SubjectmoduleID uint        `json:"subject_module_id"`
+	Title           string      `json:"title"`
+	Description     string      `json:"description"`
+	Position        int         `json:"position"`
+	Status          string      `json:"status"`
+	Lessons         []tocLesson `json:"lessons"`
+}
+
+// contentStatus applies the default status and reports whether it is valid.
+// Content is published unless created as a draft, so clients that predate
+// drafts keep working.
+func contentStatus(status *string) bool {
+	*status = strings.TrimSpace(*status)
+	if *status == "" {
+		*status = contentPublished
+	}
+	return *status == contentDraft || *status == contentPublished
+}
+
+// publishedMaterials limits a Learning_Material query to lessons students
+// can see.
+func publishedMaterials(query *gorm.DB) *gorm.DB {
+	return query.Where("learning_materials.status = ? AND (learning_materials.subjectmodule_id = 0 OR learning_materials.subjectmodule_id IN (?))",
+		contentPublished, db.Model(&Subject_Module{}).Select("subject_module_id").Where("status = ?", contentPublished))
+}
+
+// orderedMaterials sorts lessons in table of contents order.
+func orderedMaterials(query *gorm.DB) *gorm.DB {
+	return query.Joins("LEFT JOIN subject_modules ON subject_modules.subject_module_id = learning_materials.subjectmodule_id AND subject_modules.deleted_at IS NULL").
+		Order("learning_materials.subjectmodule_id = 0, subject_modules.position, learning_materials.position, learning_materials.learning_material_id")
+}
+
+func nextLessonPosition(tx *gorm.DB, subjectID uint, moduleID uint) int {
+	var last struct{ Position int }
+	tx.Model(&Learning_Material{}).Select("COALESCE(MAX(position), 0) AS position").Where("subject_id = ? AND subjectmodule_id = ?", subjectID, moduleID).Scan(&last)
+	return last.Position + 1
+}
+
+// compactLessons renumbers the lessons of a module, or of the subject
+// outside modules when moduleID is 0, as 1, 2, 3, ...
+func compactLessons(tx *gorm.DB, subjectID uint, moduleID uint) error {
+	var lessons []Learning_Material
+	tx.Where("subject_id = ? AND subjectmodule_id = ?", subjectID, moduleID).Order("position, learning_material_id").Find(&lessons)
+	for i, lesson := range lessons {
+		if lesson.Position != i+1 {
+			if err := tx.Model(&lesson).Update("position", i+1).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func compactModules(tx *gorm.DB, subjectID uint) error {
+	var modules []Subject_Module
+	tx.Where("subject_id = ?", subjectID).Order("position, subject_module_id").Find(&modules)
+	for i, module := range modules {
+		if module.Position != i+1 {
+			if err := tx.Model(&module).Update("position", i+1).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lessonModule checks that a lesson can be put in the module: it must
+// exist and belong to the lesson's subject. Module 0 means no module.
+func lessonModule(subjectID uint, moduleID uint) string {
+	if moduleID == 0 {
+		return ""
+	}
+	var module Subject_Module
+	if err := db.First(&module, moduleID).Error; err != nil {
+		return "Subject Module with that ID not found"
+	}
+	if module.SubjectID != subjectID {
+		return "Subject Module belongs to another subject"
+	}
+	return ""
+}
+
+// samePermutation reports whether ids lists every ID of current exactly
+// once.
+func samePermutation(current []uint, ids []uint) bool {
+	if len(current) != len(ids) {
+		return false
+	}
+	remaining := map[uint]bool{}
+	for _, id := range current {
+		remaining[id] = true
+	}
+	for _, id := range ids {
+		if !remaining[id] {
+			return false
+		}
+		delete(remaining, id)
+	}
+	return true
+}
+
+// migrateLessons publishes content created before drafts existed and gives
+// old lessons positions in creation order. Lessons from before modules have
+// NULL module and position columns, which neither publishedMaterials nor
+// the position queries match, so those are set to 0 first.
+func migrateLessons() {
+	db.Model(&Subject_Module{}).Where("status IS NULL OR status = ''").Update("status", contentPublished)
+	db.Model(&Learning_Material{}).Where("status IS NULL OR status = ''").Update("status", contentPublished)
+	db.Model(&Learning_Material{}).Where("subjectmodule_id IS NULL").Update("subjectmodule_id", 0)
+	db.Model(&Learning_Material{}).Where("position IS NULL").Update("position", 0)
+
+	var unordered []Learning_Material
+	db.Where("position = 0").Order("learning_material_id").Find(&unordered)
+	for _, lesson := range unordered {
+		db.Model(&lesson).Update("position", nextLessonPosition(db, lesson.SubjectID, lesson.SubjectmoduleID))
+	}
+}
+
+func createSubjectModule(c *gin.Context) {
+	var newModule Subject_Module
+	if err := c.ShouldBindJSON(&newModule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var subject Subject
+	if err := db.First(&subject, newModule.SubjectID).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Subject with that ID not found"})
+		return
+	}
+
+	newModule.Title = strings.TrimSpace(newModule.Title)
+	if newModule.Title == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "title is required"})
+		return
+	}
+
+	if !contentStatus(&newModule.Status) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be draft or published"})
+		return
+	}
+
+	var last struct{ Position int }
+	db.Model(&Subject_Module{}).Select("COALESCE(MAX(position), 0) AS position").Where("subject_id = ?", subject.SubjectID).Scan(&last)
+	newModule.Position = last.Position + 1
+	newModule.Lessons = []Learning_Material{}
+
+	if err := db.Create(&newModule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create subject module"})
+		return
+	}
+	c.JSON(http.StatusCreated, newModule)
+}
+
+func getSubjectModuleByID(c *gin.Context) {
+	id := c.Param("id")
+	var module Subject_Module
+	if err := db.First(&module, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subject Module not found"})
+		return
+	}
+
+	module.Lessons = []Learning_Material{}
+	db.Where("subjectmodule_id = ?", module.SubjectmoduleID).Order("position, learning_material_id").Find(&module.Lessons)
+	c.JSON(http.StatusOK, module)
+}
+
+func updateSubjectModule(c *gin.Context) {
+	id := c.Param("id")
+	var module Subject_Module
+	if err := db.First(&module, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subject Module not found"})
+		return
+	}
+
+	var input struct {
+		Title       *string `json:"title"`
+		Description *string `json:"description"`
+		Status      *string `json:"status"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updateData := map[string]interface{}{}
+
+	if input.Title != nil {
+		title := strings.TrimSpace(*input.Title)
+		if title == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "title is required"})
+			return
+		}
+		updateData["title"] = title
+	}
+
+	if input.Description != nil {
+		updateData["description"] = *input.Description
+	}
+
+	if input.Status != nil {
+		if !contentStatus(input.Status) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status must be draft or published"})
+			return
+		}
+		updateData["status"] = *input.Status
+	}
+
+	if len(updateData) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No valid fields to update"})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&module).Updates(updateData).Error; err != nil {
+			return err
+		}
+		// Publishing or hiding a module changes which lessons count.
+		if input.Status != nil {
+			return refreshSubjectEnrollments(tx, module.SubjectID)
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update subject module"})
+		return
+	}
+	c.JSON(http.StatusOK, module)
+}
+
+// deleteSubjectModule only deletes empty modules so lessons are never lost
+// by accident; move or delete them first.
+func deleteSubjectModule(c *gin.Context) {
+	id := c.Param("id")
+	var module Subject_Module
+	if err := db.First(&module, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subject Module not found"})
+		return
+	}
+
+	var lessons int64
+	db.Model(&Learning_Material{}).Where("subjectmodule_id = ?", module.SubjectmoduleID).Count(&lessons)
+	if lessons > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Subject Module still has lessons"})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&module).Error; err != nil {
+			return err
+		}
+		return compactModules(tx, module.SubjectID)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete subject module"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Subject Module deleted"})
+}
+
+func reorderSubjectModules(c *gin.Context) {
+	var subject Subject
+	if err := db.First(&subject, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subject not found"})
+		return
+	}
+
+	var input struct {
+		Subject_module_ids []uint `json:"subject_module_ids"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var current []uint
+	db.Model(&Subject_Module{}).Where("subject_id = ?", subject.SubjectID).Pluck("subject_module_id", &current)
+	if !samePermutation(current, input.Subject_module_ids) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "subject_module_ids must list every module of the subject exactly once"})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for i, id := range input.Subject_module_ids {
+			if err := tx.Model(&Subject_Module{}).Where("subject_module_id = ?", id).Update("position", i+1).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reorder modules"})
+		return
+	}
+
+	var modules []Subject_Module
+	db.Where("subject_id = ?", subject.SubjectID).Order("position").Find(&modules)
+	c.JSON(http.StatusOK, modules)
+}
+
+// reorderLessons orders the lessons of one module, or the lessons outside
+// modules when subject_module_id is 0 or left out.
+func reorderLessons(c *gin.Context) {
+	var subject Subject
+	if err := db.First(&subject, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subject not found"})
+		return
+	}
+
+	var input struct {
+		SubjectmoduleID       uint   `json:"subject_module_id"`
+		Learning_material_ids []uint `json:"learning_material_ids"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if msg := lessonModule(subject.SubjectID, input.SubjectmoduleID); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	var current []uint
+	db.Model(&Learning_Material{}).Where("subject_id = ? AND subjectmodule_id = ?", subject.SubjectID, input.SubjectmoduleID).Pluck("learning_material_id", &current)
+	if !samePermutation(current, input.Learning_material_ids) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "learning_material_ids must list every lesson of the module exactly once"})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for i, id := range input.Learning_material_ids {
+			if err := tx.Model(&Learning_Material{}).Where("learning_material_id = ?", id).Update("position", i+1).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reorder lessons"})
+		return
+	}
+
+	var lessons []Learning_Material
+	db.Where("subject_id = ? AND subjectmodule_id = ?", subject.SubjectID, input.SubjectmoduleID).Order("position").Find(&lessons)
+	c.JSON(http.StatusOK, lessons)
+}
+
+// getSubjectContents returns the table of contents of a subject. Drafts
+// are left out unless ?include_drafts=true.
+func getSubjectContents(c *gin.Context) {
+	var subject Subject
+	if err := db.First(&subject, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subject not found"})
+		return
+	}
+
+	includeDrafts := c.Query("include_drafts") == "true"
+
+	moduleQuery := db.Where("subject_id = ?", subject.SubjectID).Order("position, subject_module_id")
+	lessonQuery := db.Model(&Learning_Material{}).Where("learning_materials.subject_id = ?", subject.SubjectID)
+	if !includeDrafts {
+		moduleQuery = moduleQuery.Where("status = ?", contentPublished)
+		lessonQuery = lessonQuery.Scopes(publishedMaterials)
+	}
+
+	var modules []Subject_Module
+	moduleQuery.Find(&modules)
+
+	var lessons []Learning_Material
+	lessonQuery.Order("learning_materials.position, learning_materials.learning_material_id").Find(&lessons)
+
+	grouped := map[uint][]tocLesson{}
+	for _, lesson := range lessons {
+		title := lesson.Title
+		if title == "" {
+			title = materialPreview(plainText(lesson.Rendered_content))
+		}
+		grouped[lesson.SubjectmoduleID] = append(grouped[lesson.SubjectmoduleID], tocLesson{
+			LearningmaterialID: lesson.LearningmaterialID,
+			Title:              title,
+			Position:           lesson.Position,
+			Status:             lesson.Status,
+		})
+	}
+
+	toc := []tocModule{}
+	for _, module := range modules {
+		entry := tocModule{
+			SubjectmoduleID: module.SubjectmoduleID,
+			Title:           module.Title,
+			Description:     module.Description,
+			Position:        module.Position,
+			Status:          module.Status,
+			Lessons:         grouped[module.SubjectmoduleID],
+		}
+		if entry.Lessons == nil {
+			entry.Lessons = []tocLesson{}
+		}
+		toc = append(toc, entry)
+	}
+
+	unassigned := grouped[0]
+	if unassigned == nil {
+		unassigned = []tocLesson{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"subject_id":   subject.SubjectID,
+		"subject_name": subject.Subject_name,
+		"modules":      toc,
+		"lessons":      unassigned,
+	})
+}